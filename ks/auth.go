@@ -4,30 +4,118 @@
 package ks
 
 import (
+	"context"
+	"errors"
 	"net/http"
 
 	"github.com/golang/glog"
+	"github.com/gorilla/mux"
 )
 
 type handler func(w http.ResponseWriter, r *http.Request)
 
-func requireAuth(f handler, forwrite bool) handler {
-	if Config.SkipAuth {
+// A Principal is who a request has been authenticated as.
+type Principal struct {
+	// UserID is the userid (an email address) that the requester
+	// has proven they are.
+	UserID string
+	// Method names the authenticator that vouched for them. It is
+	// only used for logging.
+	Method string
+}
+
+// An Authenticator checks the credentials carried by a request.
+type Authenticator interface {
+	// Authenticate returns the principal that r is authenticated
+	// as. forwrite is true if r would change someone's keys.
+	//
+	// If r carries no credentials that the Authenticator
+	// understands, it returns ErrNoCredentials. Either way, the
+	// next one in the chain gets a go; the request is rejected if
+	// none of them vouches for it.
+	Authenticate(r *http.Request, forwrite bool) (*Principal, error)
+}
+
+// ErrNoCredentials is returned by an Authenticator that found nothing
+// it could check.
+var ErrNoCredentials = errors.New("no credentials")
+
+// AddAuthenticator appends a to the server's chain of authenticators.
+// It must be called before the server starts serving requests.
+func (s *Server) AddAuthenticator(a Authenticator) {
+	s.auth = append(s.auth, a)
+}
+
+// authenticate runs the chain of authenticators over r, and returns
+// the first principal any of them vouches for. (Several of them may
+// look at the same bearer token, for instance.) If none does, it
+// returns the first error other than ErrNoCredentials.
+func (s *Server) authenticate(r *http.Request, forwrite bool) (*Principal, error) {
+	var first error
+	for _, a := range s.auth {
+		p, err := a.Authenticate(r, forwrite)
+		if err == nil {
+			return p, nil
+		}
+		if first == nil && err != ErrNoCredentials {
+			first = err
+		}
+	}
+	if first == nil {
+		first = ErrNoCredentials
+	}
+	return nil, first
+}
+
+type contextKey int
+
+const principalKey contextKey = 0
+
+// principal returns the principal that requireAuth authenticated r
+// as.
+func principal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey).(*Principal)
+	return p
+}
+
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey, p))
+}
+
+func (s *Server) requireAuth(f handler, forwrite bool) handler {
+	if s.config.SkipAuth {
 		glog.Infof("requireAuth: skipping auth due to configuration")
 		return func(w http.ResponseWriter, r *http.Request) {
 			glog.Infof("NOAUTH: request %+v", r)
-			f(w, r)
+			// Everyone is whoever they say they are.
+			p := &Principal{UserID: mux.Vars(r)["userid"], Method: "none"}
+			f(w, withPrincipal(r, p))
 		}
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// When authentication is required, minimize what's logged to prevent
 		// logging usable authentication information.
+		p, err := s.authenticate(r, forwrite)
+		if err != nil {
+			glog.Warningf("%s %s: authentication failed: %s", r.Method, r.URL.Path, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		glog.V(2).Infof("%s %s: authenticated as %s by %s", r.Method, r.URL.Path, p.UserID, p.Method)
+		f(w, withPrincipal(r, p))
+	}
+}
 
-		// This is where you'd implement some sort of authentication scheme.
-		// Sorry, no implementation for Yahoo-external users provided just
-		// yet.
-		f(w, r)
-		return
+// requireSelf checks that the request's principal is userid, since
+// only a user can change their own keys. If not, it writes a 403 and
+// returns false.
+func requireSelf(w http.ResponseWriter, r *http.Request, userid string) bool {
+	p := principal(r)
+	if p == nil || p.UserID != userid {
+		glog.Warningf("%s %s: forbidden to %+v", r.Method, r.URL.Path, p)
+		w.WriteHeader(http.StatusForbidden)
+		return false
 	}
+	return true
 }
@@ -0,0 +1,82 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// A ClientCertAuthenticator accepts TLS client certificates that
+// chain to one of a set of client CAs. The certificate's (single)
+// email address SAN is the principal.
+type ClientCertAuthenticator struct {
+	roots *x509.CertPool
+}
+
+// NewClientCertAuthenticator returns a ClientCertAuthenticator that
+// trusts the CAs in roots.
+func NewClientCertAuthenticator(roots *x509.CertPool) *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{roots: roots}
+}
+
+// Authenticate implements Authenticator.
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request, forwrite bool) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+	// The TLS handshake may have checked the chain already, but
+	// against whatever the listener was configured with; check it
+	// against our own roots.
+	leaf := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %s", err)
+	}
+	if len(leaf.EmailAddresses) != 1 {
+		return nil, fmt.Errorf("client certificate has %d email addresses; want 1", len(leaf.EmailAddresses))
+	}
+	return &Principal{UserID: leaf.EmailAddresses[0], Method: "mtls"}, nil
+}
+
+// LoadCertPool reads a PEM file of CA certificates.
+func LoadCertPool(fn string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates in " + fn)
+	}
+	return pool, nil
+}
+
+// initClientCerts adds a ClientCertAuthenticator to the chain, if the
+// config names a client CA file.
+func (s *Server) initClientCerts() error {
+	fn := s.config.ClientCAFn
+	if fn == "" {
+		return nil
+	}
+	roots, err := LoadCertPool(fn)
+	if err != nil {
+		return fmt.Errorf("error loading client CAs: %s", err)
+	}
+	glog.Infof("accepting client certificates issued by the CAs in %s", fn)
+	s.AddAuthenticator(NewClientCertAuthenticator(roots))
+	return nil
+}
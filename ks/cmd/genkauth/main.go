@@ -11,39 +11,28 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/x509"
-	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/yahoo/keyshop/ks/kauth"
 )
 
 const prefix = "data/kauth/"
 
 var (
-	ecdsaCurve = flag.String("ecdsa-curve", "", "ECDSA curve to use to generate a key. Valid values are P224, P256, P384, P521")
-)
-
-func pemBlockForPrivateKey(priv *ecdsa.PrivateKey) *pem.Block {
-	b, err := x509.MarshalECPrivateKey(priv)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
-		os.Exit(2)
-	}
-	return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
-}
+	ecdsaCurve = flag.String("ecdsa-curve", "", "ECDSA curve to use to generate a key. Valid values are P256, P384, P521")
 
-func pemBlockForPublicKey(pub *ecdsa.PublicKey) *pem.Block {
-	b, err := x509.MarshalPKIXPublicKey(pub)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA public key: %v", err)
-		os.Exit(2)
-	}
-	return &pem.Block{Type: "EC PUBLIC KEY", Bytes: b}
-}
+	p11Module = flag.String("pkcs11", "", "generate the key in the token of this PKCS#11 module, and write only its public key")
+	p11Token  = flag.String("token", "kauth", "label of the PKCS#11 token")
+	p11PINFn  = flag.String("pinfile", prefix+"token.pin", "file holding the PKCS#11 token's user PIN")
+)
 
 // FIXME(dlg): This is hideous.
 func arrayForPublicKey(pub *ecdsa.PublicKey) string {
@@ -55,48 +44,150 @@ func arrayForPublicKey(pub *ecdsa.PublicKey) string {
 	return "[" + strings.Join(vals, ", ") + "]"
 }
 
-func main() {
-	flag.Parse()
-
-	var priv *ecdsa.PrivateKey
-	var err error
+// curve returns the curve named by -ecdsa-curve.
+func curve() (elliptic.Curve, error) {
 	switch *ecdsaCurve {
-	case "P224":
-		priv, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
 	case "P256":
-		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return elliptic.P256(), nil
 	case "P384":
-		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		return elliptic.P384(), nil
 	case "P521":
-		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
-	default:
+		return elliptic.P521(), nil
+	case "":
 		log.Printf("using P256 by default")
-		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return elliptic.P256(), nil
 	}
+	return nil, fmt.Errorf("unsupported curve %q", *ecdsaCurve)
+}
+
+// generateKey returns a new key, which is active as of now. If
+// -pkcs11 is given, it is made in the token, which keeps its private
+// key.
+func generateKey(now time.Time) (*kauth.Key, error) {
+	c, err := curve()
 	if err != nil {
-		log.Fatalf("failed to generate private key: %s", err)
+		return nil, err
 	}
-
-	keyOut, err := os.OpenFile(prefix+"kauth.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if *p11Module == "" {
+		priv, err := ecdsa.GenerateKey(c, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return kauth.NewKey(priv, now)
+	}
+	pin, err := ioutil.ReadFile(*p11PINFn)
 	if err != nil {
-		log.Print("failed to open kauth.pem for writing:", err)
-		return
+		return nil, err
+	}
+	signer, err := kauth.GeneratePKCS11(&kauth.PKCS11Config{
+		Module: *p11Module,
+		Token:  *p11Token,
+		PIN:    strings.TrimSpace(string(pin)),
+	}, c)
+	if err != nil {
+		return nil, err
+	}
+	defer signer.(io.Closer).Close()
+	k, err := kauth.NewPublicKey(signer.Public().(*ecdsa.PublicKey), now)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("made key %s in token %q", k.ID, *p11Token)
+	return k, nil
+}
+
+// writeFile replaces the file name with data, so that a kauth never
+// sees half a keyring.
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// write writes the keyring: its active private key and retired public
+// keys to kauth.pem, unless the active key is in a token, and all its
+// public keys to kauth.pem.pub.
+func write(kr *kauth.Keyring) {
+	if kr.Active() != nil {
+		b, err := kr.Marshal(true)
+		if err != nil {
+			log.Fatalf("failed to marshal keyring: %s", err)
+		}
+		if err := writeFile(prefix+"kauth.pem", b); err != nil {
+			log.Fatalf("failed to write kauth.pem: %s", err)
+		}
+		log.Print("wrote kauth.pem\n")
+	} else if _, err := os.Stat(prefix + "kauth.pem"); err == nil {
+		log.Printf("%skauth.pem holds a private key that is no longer active; remove it", prefix)
 	}
-	pem.Encode(keyOut, pemBlockForPrivateKey(priv))
-	keyOut.Close()
-	log.Print("wrote kauth.pem\n")
 
-	keyOut, err = os.OpenFile(prefix+"kauth.pem.pub", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	b, err := kr.Marshal(false)
 	if err != nil {
-		log.Print("failed to open kauth.pem.pub for writing:", err)
-		return
+		log.Fatalf("failed to marshal keyring: %s", err)
+	}
+	if err := writeFile(prefix+"kauth.pem.pub", b); err != nil {
+		log.Fatalf("failed to write kauth.pem.pub: %s", err)
+	}
+	active := kr.Keys[0]
+	if err := writeFile(prefix+"kauth.pub.js", []byte(arrayForPublicKey(active.Public))); err != nil {
+		log.Fatalf("failed to write kauth.pub.js: %s", err)
+	}
+	log.Printf("wrote kauth.pem.pub; the active kid is %s\n", active.ID)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] [rotate]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "With no command, makes a new keyring, with a new active key, in %s.\n", prefix)
+	fmt.Fprintf(os.Stderr, "rotate adds a new active key to the keyring there, and retires the\n")
+	fmt.Fprintf(os.Stderr, "old one; restart the keyshop to start signing with it.\n")
+	fmt.Fprintf(os.Stderr, "With -pkcs11, the new key is made in the token, and never leaves it.\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() > 1 || flag.NArg() == 1 && flag.Arg(0) != "rotate" {
+		usage()
+		os.Exit(2)
 	}
-	pem.Encode(keyOut, pemBlockForPublicKey(&priv.PublicKey))
-	keyOut.Close()
 
-	arrayOut, err := os.OpenFile(prefix+"kauth.pub.js", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	arrayOut.Write([]byte(arrayForPublicKey(&priv.PublicKey)))
-	arrayOut.Close()
+	// Read the keyring before making a key, so as not to leave one
+	// in a token for nothing.
+	var kr *kauth.Keyring
+	if flag.Arg(0) == "rotate" {
+		// With the active key in a token, the public keyring is
+		// the whole keyring.
+		fn := "kauth.pem"
+		if *p11Module != "" {
+			fn = "kauth.pem.pub"
+		}
+		b, err := ioutil.ReadFile(prefix + fn)
+		if err != nil {
+			log.Fatalf("failed to read %s: %s", fn, err)
+		}
+		if kr, err = kauth.ParseKeyring(b); err != nil {
+			log.Fatalf("failed to parse %s: %s", fn, err)
+		}
+		if *p11Module == "" && kr.Active() == nil {
+			log.Fatalf("kauth.pem has no active private key")
+		}
+	}
 
-	log.Print("wrote kauth.pem.pub\n")
+	key, err := generateKey(time.Now())
+	if err != nil {
+		log.Fatalf("failed to generate private key: %s", err)
+	}
+	if kr == nil {
+		write(&kauth.Keyring{Keys: []*kauth.Key{key}})
+		return
+	}
+	retired := kr.Keys[0]
+	if err := kr.Rotate(key); err != nil {
+		log.Fatalf("failed to rotate: %s", err)
+	}
+	log.Printf("retired kid %s", retired.ID)
+	write(kr)
 }
@@ -0,0 +1,160 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+//
+// kauthd is the keyshop's key authority, in a process of its own. It
+// holds the kauth's private key, and signs for the keyshop over a Unix
+// socket, so that the key never enters the keyshop's process. Every
+// request is logged, and only well-formed statements of the kinds the
+// keyshop signs, made just now, are signed: a compromised keyshop can
+// still sign lies about keys, but not arbitrary blobs, nor backdated
+// statements. Requests have to be MACed with a secret that kauthd
+// shares with the keyshop.
+//
+// Run it as a different user from the keyshop, which needs only to be
+// able to read the secret and connect to the socket:
+//
+//	kauthd -gensecret
+//	kauthd -alsologtostderr &
+//	ks -kauthd data/kauth/kauthd.sock ...
+//
+// The active key may be kept in a PKCS#11 token instead of kauth.pem,
+// if kauthd is built with -tags pkcs11, and the key was made there
+// with genkauth -pkcs11:
+//
+//	kauthd -pkcs11 /usr/lib/softhsm/libsofthsm2.so -kauth data/kauth/kauth.pem.pub
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/yahoo/keyshop/ks"
+	"github.com/yahoo/keyshop/ks/kauth"
+)
+
+var (
+	kauthFn   = flag.String("kauth", "data/kauth/kauth.pem", "PEM file of the kauth's keyring")
+	sockFn    = flag.String("socket", "data/kauth/kauthd.sock", "Unix socket to listen on")
+	secretFn  = flag.String("secret", "data/kauth/kauthd.key", "file holding the secret shared with the keyshop")
+	genSecret = flag.Bool("gensecret", false, "write a new random secret to the -secret file, and exit")
+	skew      = flag.Duration("skew", 5*time.Minute, "how far a statement's timestamp may be from now")
+	sockMode  = flag.Uint("mode", 0660, "permissions of the socket")
+
+	p11Module = flag.String("pkcs11", "", "PKCS#11 module of the token that holds the active key; -kauth is then its public keyring, e.g. data/kauth/kauth.pem.pub")
+	p11Token  = flag.String("token", "kauth", "label of the PKCS#11 token")
+	p11PINFn  = flag.String("pinfile", "data/kauth/token.pin", "file holding the PKCS#11 token's user PIN")
+)
+
+// openKauth returns the kauth whose keyring is in b: with its private
+// key in b too, or in a PKCS#11 token, if -pkcs11 is given.
+func openKauth(b []byte) (*kauth.Kauth, error) {
+	if *p11Module == "" {
+		return kauth.New(b)
+	}
+	keys, err := kauth.ParseKeyring(b)
+	if err != nil {
+		return nil, err
+	}
+	pin, err := ioutil.ReadFile(*p11PINFn)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := kauth.OpenPKCS11(&kauth.PKCS11Config{
+		Module: *p11Module,
+		Token:  *p11Token,
+		PIN:    strings.TrimSpace(string(pin)),
+	}, keys.Keys[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	ka, err := kauth.NewWithSigner(signer, keys)
+	if err != nil {
+		signer.(io.Closer).Close()
+		return nil, err
+	}
+	return ka, nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *genSecret {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			glog.Fatalf("error generating secret: %s", err)
+		}
+		f, err := os.OpenFile(*secretFn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if err != nil {
+			glog.Fatalf("error creating %s: %s", *secretFn, err)
+		}
+		if _, err := f.Write(secret); err != nil {
+			glog.Fatalf("error writing %s: %s", *secretFn, err)
+		}
+		if err := f.Close(); err != nil {
+			glog.Fatalf("error writing %s: %s", *secretFn, err)
+		}
+		glog.Infof("wrote %s", *secretFn)
+		return
+	}
+
+	b, err := ioutil.ReadFile(*kauthFn)
+	if err != nil {
+		glog.Fatalf("error reading kauth PEM file: %s", err)
+	}
+	ka, err := openKauth(b)
+	if err != nil {
+		glog.Fatalf("error loading kauth: %s", err)
+	}
+	secret, err := ioutil.ReadFile(*secretFn)
+	if err != nil {
+		glog.Fatalf("error reading secret: %s", err)
+	}
+	if len(secret) < 16 {
+		glog.Fatalf("the secret in %s is too short", *secretFn)
+	}
+	d := kauth.NewDaemon(ka, secret, func(msg []byte) (string, error) {
+		return ks.CheckStatement(msg, time.Now(), *skew)
+	})
+
+	// A socket left behind by a kauthd that didn't exit cleanly.
+	if err := os.Remove(*sockFn); err != nil && !os.IsNotExist(err) {
+		glog.Fatalf("error removing old socket: %s", err)
+	}
+	l, err := net.Listen("unix", *sockFn)
+	if err != nil {
+		glog.Fatalf("error listening on %s: %s", *sockFn, err)
+	}
+	if err := os.Chmod(*sockFn, os.FileMode(*sockMode)); err != nil {
+		glog.Fatalf("error setting the socket's permissions: %s", err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		glog.Infof("caught %s; exiting", sig)
+		close(done)
+		// Closing the listener removes the socket.
+		l.Close()
+	}()
+
+	glog.Infof("kauthd listening on %s", *sockFn)
+	err = d.Serve(l)
+	select {
+	case <-done:
+		ka.Close()
+		glog.Flush()
+	default:
+		glog.Fatalf("error serving: %s", err)
+	}
+}
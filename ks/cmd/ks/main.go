@@ -69,7 +69,7 @@ func serveFile(fn, mime string) func(w http.ResponseWriter, r *http.Request) {
 }
 
 func readPem(fn string) (raw, decoded []byte) {
-	fn = ks.Config.TLSPrefix + fn
+	fn = config.TLSPrefix + fn
 	raw, err := ioutil.ReadFile(fn)
 	if err != nil {
 		glog.Fatalf("error loading PEM from %s", fn)
@@ -82,13 +82,48 @@ func readPem(fn string) (raw, decoded []byte) {
 	return
 }
 
+var config = ks.DefaultConfig()
+
+func init() {
+	flag.StringVar(&config.Backend, "backend", config.Backend, `storage backend: "bolt", "sqlite" or "memory"`)
+	flag.StringVar(&config.DbFn, "db", config.DbFn, "database file for the bolt and sqlite backends")
+	flag.StringVar(&config.LogFn, "tlog", config.LogFn, "transparency log file (empty to keep it in memory)")
+	flag.StringVar(&config.KauthFn, "kauth", config.KauthFn, "PEM file of the kauth's keyring")
+	flag.StringVar(&config.KauthAddr, "kauthd", config.KauthAddr, "Unix socket of kauthd, to sign with instead of the -kauth keyring")
+	flag.StringVar(&config.KauthSecretFn, "kauthsecret", config.KauthSecretFn, "file holding the secret shared with kauthd")
+	flag.BoolVar(&config.SkipAuth, "skipauth", config.SkipAuth, "accept every request as coming from the user it names (for development only)")
+	flag.StringVar(&config.TokenSecretFn, "tokensecret", config.TokenSecretFn, "file holding the HMAC secret for bearer tokens")
+	flag.BoolVar(&config.TokenKauth, "tokenkauth", config.TokenKauth, "accept bearer tokens signed by the kauth")
+	flag.StringVar(&config.TokenAudience, "tokenaud", config.TokenAudience, "the audience bearer tokens must be addressed to")
+	flag.DurationVar(&config.TokenMaxTTL, "tokenmaxttl", config.TokenMaxTTL, "the longest a bearer token may be good for")
+	flag.StringVar(&config.ClientCAFn, "clientca", config.ClientCAFn, "PEM file of CAs whose client certificates to accept")
+	flag.StringVar(&config.OIDCIssuer, "oidciss", config.OIDCIssuer, "issuer of OpenID Connect ID tokens to accept")
+	flag.StringVar(&config.OIDCAudience, "oidcaud", config.OIDCAudience, "the client ID that ID tokens must be addressed to")
+	flag.StringVar(&config.OIDCKeys, "oidckeys", config.OIDCKeys, "file or URL of the ID token issuer's JWKS")
+	flag.BoolVar(&config.ConfirmEmail, "confirm", config.ConfirmEmail, "hold new keys until their user confirms their address by email")
+	flag.StringVar(&config.PublicURL, "publicurl", config.PublicURL, "the keyshop's URL, as seen by its users")
+	flag.StringVar(&config.SMTPAddr, "smtp", config.SMTPAddr, "SMTP server to send mail through")
+	flag.StringVar(&config.MailFrom, "mailfrom", config.MailFrom, "address to send mail from")
+	flag.StringVar(&config.MailDropDir, "maildrop", config.MailDropDir, "write mail to files in this directory, instead of sending it")
+	flag.BoolVar(&config.RequirePoP, "pop", config.RequirePoP, "require proof of possession of each key registered")
+	flag.BoolVar(&config.HKP, "hkp", config.HKP, "also speak the HTTP Keyserver Protocol")
+	flag.BoolVar(&config.WKD, "wkd", config.WKD, "also serve OpenPGP keys as a Web Key Directory")
+	flag.StringVar(&config.PolicyFn, "policy", config.PolicyFn, "JSON file of the registration policy")
+	flag.DurationVar(&config.EpochInterval, "epoch", config.EpochInterval, "how often to re-sign the key directory root")
+}
+
 func main() {
-	// Parse flags for Glog.
+	// Parse flags for Glog and the keyshop.
 	flag.Parse()
 
-	var err error
 	runtime.GOMAXPROCS(16)
 
+	srv, err := ks.NewServer(config)
+	if err != nil {
+		glog.Fatalf("error initializing keyshop: %s", err)
+	}
+	defer srv.Close()
+
 	chainPem, chainDer := readPem("chain.pem")
 
 	// Handle certificate paths
@@ -98,13 +133,11 @@ func main() {
 	c.HandleFunc("/chain.pem", serveBytes(chainPem)).Methods("GET")
 	c.HandleFunc("/chain.der", serveBytes(chainDer)).Methods("GET")
 
-	// Set up the subrouter for the keyshop
-	r := p.PathPrefix("/v1/k").Subrouter()
-	r.HandleFunc("/{userid}", ks.Get).Methods("GET")
-	r.HandleFunc("/{userid}/{deviceid}", ks.Post).Methods("POST")
+	// Everything else is the keyshop's.
+	p.PathPrefix("/").Handler(srv)
 
 	s := &http.Server{
-		Addr:           ks.Config.Addr,
+		Addr:           config.Addr,
 		ReadTimeout:    30 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
@@ -113,8 +146,8 @@ func main() {
 	glog.Infof("before handle")
 	http.Handle("/", p)
 
-	if ks.Config.UseTLS {
-		prefix := ks.Config.TLSPrefix
+	if config.UseTLS {
+		prefix := config.TLSPrefix
 		s.TLSConfig = &tls.Config{
 			SessionTicketsDisabled: true,
 			MinVersion:             tls.VersionTLS12,
@@ -135,7 +168,17 @@ func main() {
 			},
 			PreferServerCipherSuites: true,
 		}
-		glog.Infof("starting to serve %s:\n%+v\n", ks.Config.Addr, ks.Config, s.TLSConfig)
+		if config.ClientCAFn != "" {
+			// Client certificates are optional; requireAuth
+			// decides what to make of them.
+			pool, err := ks.LoadCertPool(config.ClientCAFn)
+			if err != nil {
+				glog.Fatalf("error loading client CAs: %s", err)
+			}
+			s.TLSConfig.ClientCAs = pool
+			s.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		glog.Infof("starting to serve %s:\n%+v\n", config.Addr, config, s.TLSConfig)
 
 		err = s.ListenAndServeTLS(prefix+"chain.pem", prefix+"privatekey.pem")
 	} else {
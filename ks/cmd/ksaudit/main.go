@@ -0,0 +1,434 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+//
+// ksaudit independently checks a keyshop's behaviour. Each run, it
+//
+//   - fetches the signed tree head of the transparency log, and checks
+//     that it is consistent with the last one it saw, and no older;
+//   - fetches the signed root of the key directory, and checks that
+//     its epoch and timestamp only move forward;
+//   - looks up each watched userid, checks the directory proof and
+//     that every key is in the transparency log, and alerts if the
+//     user's key set has changed since the last run.
+//
+// Everything has to be signed by the kauth's public key. What it has
+// seen is kept in a local state file between runs.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/yahoo/keyshop/ks"
+	"github.com/yahoo/keyshop/ks/kauth"
+	"github.com/yahoo/keyshop/ks/tlog"
+	"github.com/yahoo/keyshop/yenc"
+)
+
+var (
+	server   = flag.String("server", "https://localhost:25519", "base URL of the keyshop to audit")
+	pubFn    = flag.String("pub", "data/kauth/kauth.pem.pub", "the kauth's public key, as written by genkauth")
+	stateFn  = flag.String("state", "data/ksaudit.json", "where to keep state between runs")
+	caFn     = flag.String("ca", "", "PEM file of CA certificates to trust for TLS (default: the system roots)")
+	watch    = flag.String("watch", "", "comma-separated userids whose key sets to watch")
+	interval = flag.Duration("interval", 0, "audit every interval, instead of once")
+	tokenFn  = flag.String("token", "", "file holding a bearer token to look up watched userids with")
+)
+
+// auditState is what ksaudit remembers between runs.
+type auditState struct {
+	TreeHead *ks.TreeHead `json:"sth,omitempty"`
+	MapRoot  *ks.MapRoot  `json:"map,omitempty"`
+	// Watched maps each watched userid to its keys, as of the last
+	// run.
+	Watched map[string]map[string]string `json:"watched"`
+}
+
+type auditor struct {
+	client *http.Client
+	base   string
+	token  string
+	kauth  *kauth.Verifier
+	state  *auditState
+	alerts int
+}
+
+func (a *auditor) alert(format string, args ...interface{}) {
+	a.alerts++
+	glog.Errorf("ALERT: "+format, args...)
+}
+
+// fetch GETs path from the keyshop, and returns the body, as long as
+// the status is one of ok.
+func (a *auditor) fetch(path string, ok ...int) ([]byte, error) {
+	req, err := http.NewRequest("GET", a.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return body, nil
+		}
+	}
+	return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+}
+
+// fetchSigned fetches a signed statement, checks the kauth's
+// signature, and unmarshals its payload into v.
+func (a *auditor) fetchSigned(path string, v interface{}, ok ...int) error {
+	jws, err := a.fetch(path, ok...)
+	if err != nil {
+		return err
+	}
+	return a.verify(jws, v)
+}
+
+func (a *auditor) verify(jws []byte, v interface{}) error {
+	payload, err := a.kauth.Verify(jws)
+	if err != nil {
+		return fmt.Errorf("bad kauth signature: %s", err)
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func decodeHashes(enc []string) ([][]byte, error) {
+	hashes := make([][]byte, len(enc))
+	for i, e := range enc {
+		h, err := yenc.RawURL64.DecodeString(e)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = h
+	}
+	return hashes, nil
+}
+
+// checkLog checks the log's latest tree head against the last one we
+// trusted, and returns it (or the old one, if it can't be trusted).
+func (a *auditor) checkLog() (*ks.TreeHead, error) {
+	sth := new(ks.TreeHead)
+	if err := a.fetchSigned("/v1/log/sth", sth, http.StatusOK); err != nil {
+		return nil, err
+	}
+	root, err := yenc.RawURL64.DecodeString(sth.RootHash)
+	if err != nil {
+		return nil, err
+	}
+	prev := a.state.TreeHead
+	if prev == nil {
+		glog.Infof("first tree head: size %d", sth.TreeSize)
+		return sth, nil
+	}
+	prevRoot, err := yenc.RawURL64.DecodeString(prev.RootHash)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case sth.TreeSize < prev.TreeSize:
+		a.alert("log shrank from %d to %d entries", prev.TreeSize, sth.TreeSize)
+		return prev, nil
+	case sth.Timestamp < prev.Timestamp:
+		a.alert("tree head timestamp went backwards: %d, then %d", prev.Timestamp, sth.Timestamp)
+		return prev, nil
+	}
+	var proof ks.ConsistencyProof
+	body, err := a.fetch(fmt.Sprintf("/v1/log/consistency?first=%d&second=%d", prev.TreeSize, sth.TreeSize), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &proof); err != nil {
+		return nil, err
+	}
+	hashes, err := decodeHashes(proof.Proof)
+	if err != nil {
+		return nil, err
+	}
+	if !tlog.VerifyConsistency(prev.TreeSize, sth.TreeSize, prevRoot, root, hashes) {
+		a.alert("tree head of size %d is not consistent with the one of size %d", sth.TreeSize, prev.TreeSize)
+		return prev, nil
+	}
+	glog.Infof("log grew consistently from %d to %d entries", prev.TreeSize, sth.TreeSize)
+	return sth, nil
+}
+
+// checkMapRoot checks that a signed MapRoot doesn't go back on one we
+// saw before, whether in this run or, through the state file, an
+// earlier one: its epoch and timestamp may only move forward, and an
+// epoch has only one root. It returns the newer of the two, or prev if
+// root can't be trusted.
+func (a *auditor) checkMapRoot(root *ks.MapRoot, prev *ks.MapRoot) *ks.MapRoot {
+	if prev == nil {
+		return root
+	}
+	trusted := true
+	if root.Epoch < prev.Epoch {
+		a.alert("directory epoch went backwards: %d, then %d", prev.Epoch, root.Epoch)
+		trusted = false
+	}
+	if root.Epoch == prev.Epoch && root.RootHash != prev.RootHash {
+		a.alert("two different directory roots for epoch %d: %s and %s", root.Epoch, prev.RootHash, root.RootHash)
+		trusted = false
+	}
+	if root.Timestamp < prev.Timestamp {
+		a.alert("directory timestamp went backwards: %d, then %d", prev.Timestamp, root.Timestamp)
+		trusted = false
+	}
+	if !trusted {
+		return prev
+	}
+	return root
+}
+
+// checkLogged checks that dkey is in the log, as of sth.
+func (a *auditor) checkLogged(sth *ks.TreeHead, dkey string) error {
+	leaf := tlog.LeafHash([]byte(dkey))
+	q := url.Values{
+		"hash": {yenc.RawURL64.EncodeToString(leaf)},
+		"size": {fmt.Sprint(sth.TreeSize)},
+	}
+	body, err := a.fetch("/v1/log/inclusion?"+q.Encode(), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var proof ks.InclusionProof
+	if err := json.Unmarshal(body, &proof); err != nil {
+		return err
+	}
+	root, err := yenc.RawURL64.DecodeString(sth.RootHash)
+	if err != nil {
+		return err
+	}
+	hashes, err := decodeHashes(proof.AuditPath)
+	if err != nil {
+		return err
+	}
+	if !tlog.VerifyInclusion(leaf, proof.LeafIndex, sth.TreeSize, hashes, root) {
+		return fmt.Errorf("inclusion proof did not verify")
+	}
+	return nil
+}
+
+// checkUser looks up userid, checks the answer against the
+// directory, and returns the user's keys.
+func (a *auditor) checkUser(userid string, mapRoot *ks.MapRoot) (map[string]string, *ks.MapRoot, error) {
+	var ukeys ks.UKeys
+	if err := a.fetchSigned("/v1/k/"+url.PathEscape(userid), &ukeys, http.StatusOK, http.StatusNotFound); err != nil {
+		return nil, mapRoot, err
+	}
+	if ukeys.UserID != userid {
+		a.alert("asked for %s's keys, got %s's", userid, ukeys.UserID)
+		return nil, mapRoot, nil
+	}
+	var root ks.MapRoot
+	if err := a.verify([]byte(ukeys.Root), &root); err != nil {
+		a.alert("directory root in %s's keys: %s", userid, err)
+		return nil, mapRoot, nil
+	}
+	mapRoot = a.checkMapRoot(&root, mapRoot)
+	hash, err := yenc.RawURL64.DecodeString(root.RootHash)
+	if err != nil {
+		return nil, mapRoot, err
+	}
+	if ukeys.Proof == nil {
+		a.alert("no directory proof for %s", userid)
+	} else if err := ks.VerifyMapProof(ukeys.Proof, hash, userid, ukeys.Keys); err != nil {
+		a.alert("directory proof for %s: %s", userid, err)
+	}
+
+	prev, seen := a.state.Watched[userid]
+	a.state.Watched[userid] = ukeys.Keys
+	if !seen {
+		glog.Infof("now watching %s: %d keys", userid, len(ukeys.Keys))
+	} else if changes := diffKeys(prev, ukeys.Keys); len(changes) > 0 {
+		a.alert("key set for %s changed: %s", userid, strings.Join(changes, ", "))
+	}
+	return ukeys.Keys, mapRoot, nil
+}
+
+func diffKeys(old, new map[string]string) (changes []string) {
+	for deviceid, dkey := range new {
+		switch prev, ok := old[deviceid]; {
+		case !ok:
+			changes = append(changes, deviceid+" added")
+		case prev != dkey:
+			changes = append(changes, deviceid+" replaced")
+		}
+	}
+	for deviceid := range old {
+		if _, ok := new[deviceid]; !ok {
+			changes = append(changes, deviceid+" removed")
+		}
+	}
+	sort.Strings(changes)
+	return
+}
+
+// audit runs every check once. Errors talking to the server are
+// returned; misbehaviour is alerted on.
+func (a *auditor) audit(watched []string) error {
+	mapRoot := new(ks.MapRoot)
+	if err := a.fetchSigned("/v1/map/root", mapRoot, http.StatusOK); err != nil {
+		return err
+	}
+	mapRoot = a.checkMapRoot(mapRoot, a.state.MapRoot)
+	keys := make(map[string]map[string]string)
+	for _, userid := range watched {
+		var err error
+		if keys[userid], mapRoot, err = a.checkUser(userid, mapRoot); err != nil {
+			return err
+		}
+	}
+	a.state.MapRoot = mapRoot
+
+	// Fetch the tree head after the keys, so that every key we were
+	// given has to be in it.
+	sth, err := a.checkLog()
+	if err != nil {
+		return err
+	}
+	a.state.TreeHead = sth
+	for userid, devices := range keys {
+		for deviceid, dkey := range devices {
+			if err := a.checkLogged(sth, dkey); err != nil {
+				a.alert("key for %s/%s is not publicly logged: %s", userid, deviceid, err)
+			}
+		}
+	}
+	return nil
+}
+
+func loadState(fn string) (*auditState, error) {
+	st := &auditState{Watched: make(map[string]map[string]string)}
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	if st.Watched == nil {
+		st.Watched = make(map[string]map[string]string)
+	}
+	return st, nil
+}
+
+func saveState(fn string, st *auditState) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+func newClient(caFn string) (*http.Client, error) {
+	if caFn == "" {
+		return &http.Client{Timeout: 30 * time.Second}, nil
+	}
+	b, err := ioutil.ReadFile(caFn)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates in %s", caFn)
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+		},
+	}, nil
+}
+
+func main() {
+	flag.Parse()
+
+	pub, err := ioutil.ReadFile(*pubFn)
+	if err != nil {
+		glog.Fatalf("error reading kauth public key: %s", err)
+	}
+	verifier, err := kauth.NewVerifier(pub)
+	if err != nil {
+		glog.Fatalf("error parsing kauth public key: %s", err)
+	}
+	client, err := newClient(*caFn)
+	if err != nil {
+		glog.Fatalf("error setting up TLS: %s", err)
+	}
+	var tok string
+	if *tokenFn != "" {
+		b, err := ioutil.ReadFile(*tokenFn)
+		if err != nil {
+			glog.Fatalf("error reading token: %s", err)
+		}
+		tok = strings.TrimSpace(string(b))
+	}
+	st, err := loadState(*stateFn)
+	if err != nil {
+		glog.Fatalf("error loading state from %s: %s", *stateFn, err)
+	}
+	var watched []string
+	for _, userid := range strings.Split(*watch, ",") {
+		if userid = strings.TrimSpace(userid); userid != "" {
+			watched = append(watched, userid)
+		}
+	}
+
+	a := &auditor{
+		client: client,
+		base:   strings.TrimRight(*server, "/"),
+		token:  tok,
+		kauth:  verifier,
+		state:  st,
+	}
+	failed := false
+	for {
+		if err := a.audit(watched); err != nil {
+			glog.Errorf("error auditing %s: %s", a.base, err)
+			failed = true
+		}
+		if err := saveState(*stateFn, a.state); err != nil {
+			glog.Errorf("error saving state to %s: %s", *stateFn, err)
+		}
+		if *interval <= 0 {
+			break
+		}
+		time.Sleep(*interval)
+	}
+	glog.Flush()
+	switch {
+	case a.alerts > 0:
+		os.Exit(1)
+	case failed:
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/yahoo/keyshop/ks"
+	"github.com/yahoo/keyshop/ks/kauth"
+	"github.com/yahoo/keyshop/ks/tlog"
+	"github.com/yahoo/keyshop/yenc"
+)
+
+func TestCheckMapRoot(t *testing.T) {
+	a := &auditor{state: &auditState{}}
+	prev := &ks.MapRoot{Epoch: 5, RootHash: "r5", Timestamp: 1000}
+	for _, test := range []struct {
+		root   ks.MapRoot
+		alerts int
+		want   *ks.MapRoot
+	}{
+		{ks.MapRoot{Epoch: 6, RootHash: "r6", Timestamp: 1100}, 0, nil},
+		{ks.MapRoot{Epoch: 5, RootHash: "r5", Timestamp: 1000}, 0, nil},
+		{ks.MapRoot{Epoch: 4, RootHash: "r4", Timestamp: 1100}, 1, prev},
+		{ks.MapRoot{Epoch: 5, RootHash: "x5", Timestamp: 1000}, 1, prev},
+		{ks.MapRoot{Epoch: 6, RootHash: "r6", Timestamp: 900}, 1, prev},
+		{ks.MapRoot{Epoch: 4, RootHash: "r4", Timestamp: 900}, 2, prev},
+	} {
+		a.alerts = 0
+		root := test.root
+		want := test.want
+		if want == nil {
+			want = &root
+		}
+		if got := a.checkMapRoot(&root, prev); got != want || a.alerts != test.alerts {
+			t.Errorf("%+v after %+v: got %+v and %d alerts, want %+v and %d", root, *prev, *got, a.alerts, *want, test.alerts)
+		}
+	}
+}
+
+// TestCheckMapRootAcrossRestarts checks that what one run saw holds
+// the next to account, through the state file.
+func TestCheckMapRootAcrossRestarts(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ksaudit.json")
+	run := func(root ks.MapRoot) int {
+		st, err := loadState(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := &auditor{state: st}
+		st.MapRoot = a.checkMapRoot(&root, st.MapRoot)
+		if err := saveState(fn, st); err != nil {
+			t.Fatal(err)
+		}
+		return a.alerts
+	}
+
+	if n := run(ks.MapRoot{Epoch: 5, RootHash: "r5", Timestamp: 1000}); n != 0 {
+		t.Fatalf("first run: got %d alerts", n)
+	}
+	// A keyshop that carries on from where it was before it
+	// restarted.
+	if n := run(ks.MapRoot{Epoch: 6, RootHash: "r6", Timestamp: 1100}); n != 0 {
+		t.Fatalf("after a clean restart: got %d alerts", n)
+	}
+	// One that lost its epochs, and one whose clock went back.
+	if n := run(ks.MapRoot{Epoch: 1, RootHash: "r1", Timestamp: 1200}); n != 1 {
+		t.Fatalf("after the epochs were reset: got %d alerts, want 1", n)
+	}
+	if n := run(ks.MapRoot{Epoch: 7, RootHash: "r7", Timestamp: 1050}); n != 1 {
+		t.Fatalf("after the clock went back: got %d alerts, want 1", n)
+	}
+	// Neither was trusted, so the state still holds epoch 6.
+	if n := run(ks.MapRoot{Epoch: 7, RootHash: "r7", Timestamp: 1150}); n != 0 {
+		t.Fatalf("after recovering: got %d alerts", n)
+	}
+}
+
+// testLogServer serves a transparency log of eight entries, whose
+// tree head is whatever sth returns, signed. It returns an auditor
+// for it, and the log.
+func testLogServer(t *testing.T, sth func() *ks.TreeHead) (*auditor, *tlog.Log) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	ka, err := kauth.New(privPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := kauth.ParseKeyring(privPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := kr.Marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := kauth.NewVerifier(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := tlog.NewMemory()
+	for i := 0; i < 8; i++ {
+		l.Append([]byte(fmt.Sprintf("entry %d", i)))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/log/sth", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(sth())
+		signed, err := ka.Sign(data)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(signed)
+	})
+	mux.HandleFunc("/v1/log/consistency", func(w http.ResponseWriter, r *http.Request) {
+		var first, second int64
+		fmt.Sscan(r.URL.Query().Get("first"), &first)
+		fmt.Sscan(r.URL.Query().Get("second"), &second)
+		proof, err := l.ConsistencyProof(first, second)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		enc := make([]string, len(proof))
+		for i, h := range proof {
+			enc[i] = yenc.RawURL64.EncodeToString(h)
+		}
+		json.NewEncoder(w).Encode(&ks.ConsistencyProof{First: first, Proof: enc, Second: second})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return &auditor{client: srv.Client(), base: srv.URL, kauth: v, state: &auditState{}}, l
+}
+
+func TestCheckLog(t *testing.T) {
+	var head *ks.TreeHead
+	a, l := testLogServer(t, func() *ks.TreeHead { return head })
+	treeHead := func(size, timestamp int64) *ks.TreeHead {
+		root, err := l.Root(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ks.TreeHead{RootHash: yenc.RawURL64.EncodeToString(root), Timestamp: timestamp, TreeSize: size}
+	}
+	prev := treeHead(4, 1000)
+	forged := treeHead(6, 1100)
+	forged.RootHash = treeHead(5, 1100).RootHash
+
+	for _, test := range []struct {
+		name   string
+		sth    *ks.TreeHead
+		alerts int
+		want   *ks.TreeHead // nil for sth
+	}{
+		{"grown", treeHead(6, 1100), 0, nil},
+		{"unchanged", treeHead(4, 1000), 0, nil},
+		{"shrunk", treeHead(3, 1100), 1, prev},
+		{"backdated", treeHead(6, 900), 1, prev},
+		{"inconsistent", forged, 1, prev},
+	} {
+		a.state.TreeHead, a.alerts = prev, 0
+		head = test.sth
+		want := test.want
+		if want == nil {
+			want = test.sth
+		}
+		got, err := a.checkLog()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if *got != *want || a.alerts != test.alerts {
+			t.Errorf("%s: got %+v and %d alerts, want %+v and %d", test.name, *got, a.alerts, *want, test.alerts)
+		}
+	}
+}
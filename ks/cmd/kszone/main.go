@@ -0,0 +1,147 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+//
+// kszone reads a keyshop's store and writes a zone-file fragment of
+// RFC 7929 OPENPGPKEY records for every user in a domain who has an
+// OpenPGP key registered: one record per distinct key, at
+//
+//	<hex of SHA-256 of the local part, truncated to 28 bytes>._openpgpkey.<domain>.
+//
+// The store is opened read-only; a bolt store must not be open in a
+// running keyshop. E.g.:
+//
+//	kszone -domain example.com -sort > openpgpkey.example.com.zone
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/yahoo/keyshop/ks"
+)
+
+var (
+	config  = ks.DefaultConfig()
+	domain  = flag.String("domain", "", "the domain to write records for")
+	ttl     = flag.Duration("ttl", 0, "the records' TTL (default: the zone's)")
+	sorted  = flag.Bool("sort", false, "sort the records by name, so that diffs between runs stay small")
+	outFn   = flag.String("o", "", "file to write to (default: standard output)")
+	comment = flag.Bool("comment", true, "say which user each record is for, in a comment")
+)
+
+func init() {
+	flag.StringVar(&config.Backend, "backend", config.Backend, `storage backend: "bolt" or "sqlite"`)
+	flag.StringVar(&config.DbFn, "db", config.DbFn, "database file")
+}
+
+// owner returns the name of the OPENPGPKEY records for local@domain.
+func owner(local, domain string) string {
+	h := sha256.Sum256([]byte(local))
+	return hex.EncodeToString(h[:28]) + "._openpgpkey." + domain + "."
+}
+
+// A record is one OPENPGPKEY record, and the users it is for: more
+// than one if their addresses differ only in the domain's case.
+type record struct {
+	owner, key string
+	userids    []string
+}
+
+// zoneRecords returns the records for the users in domain d who have
+// OpenPGP keys in store, one for each distinct name and key. If
+// sorted is set, they are sorted by name, then by key; otherwise they
+// are in the store's order.
+func zoneRecords(store ks.KeyShop, d string, sorted bool) ([]record, error) {
+	var records []record
+	// seen maps each name and key to its record's index.
+	seen := make(map[[2]string]int)
+	err := store.ForEach(func(userid string, keys map[string]string) error {
+		at := strings.LastIndex(userid, "@")
+		if at < 0 || strings.ToLower(userid[at+1:]) != d {
+			return nil
+		}
+		pgpKeys, err := ks.OpenPGPKeys(keys)
+		if err != nil {
+			return fmt.Errorf("%s: %s", userid, err)
+		}
+		for _, key := range pgpKeys {
+			r := record{owner: owner(userid[:at], d), key: base64.StdEncoding.EncodeToString(key)}
+			if i, ok := seen[[2]string{r.owner, r.key}]; ok {
+				records[i].userids = append(records[i].userids, userid)
+				continue
+			}
+			r.userids = []string{userid}
+			seen[[2]string{r.owner, r.key}] = len(records)
+			records = append(records, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		sort.Strings(r.userids)
+	}
+	if sorted {
+		sort.Slice(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			if a.owner != b.owner {
+				return a.owner < b.owner
+			}
+			return a.key < b.key
+		})
+	}
+	return records, nil
+}
+
+func main() {
+	flag.Parse()
+	d := strings.TrimSuffix(strings.ToLower(*domain), ".")
+	if d == "" {
+		glog.Fatalf("-domain is required")
+	}
+	store, err := ks.OpenStoreReadOnly(config)
+	if err != nil {
+		glog.Fatalf("couldn't open %s store at %s: %s", config.Backend, config.DbFn, err)
+	}
+	defer store.Close()
+
+	records, err := zoneRecords(store, d, *sorted)
+	if err != nil {
+		glog.Fatalf("error reading the store: %s", err)
+	}
+
+	out := os.Stdout
+	if *outFn != "" {
+		if out, err = os.Create(*outFn); err != nil {
+			glog.Fatalf("%s", err)
+		}
+	}
+	w := bufio.NewWriter(out)
+	ttlField := ""
+	if *ttl > 0 {
+		ttlField = fmt.Sprintf(" %d", int64(*ttl/time.Second))
+	}
+	for _, r := range records {
+		if *comment {
+			fmt.Fprintf(w, "; %s\n", strings.Join(r.userids, ", "))
+		}
+		fmt.Fprintf(w, "%s%s IN OPENPGPKEY %s\n", r.owner, ttlField, r.key)
+	}
+	if err := w.Flush(); err != nil {
+		glog.Fatalf("%s", err)
+	}
+	if err := out.Close(); err != nil {
+		glog.Fatalf("%s", err)
+	}
+	glog.Infof("wrote %d OPENPGPKEY records for %s", len(records), d)
+}
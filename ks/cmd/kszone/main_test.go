@@ -0,0 +1,91 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/yahoo/keyshop/ks"
+	"github.com/yahoo/keyshop/yenc"
+)
+
+func TestOwner(t *testing.T) {
+	// RFC 7929, section 3.
+	const want = "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com."
+	if got := owner("hugh", "example.com"); got != want {
+		t.Fatalf("owner(hugh, example.com) = %s, want %s", got, want)
+	}
+}
+
+// dkey returns a DKey for key, as the store holds it; kszone doesn't
+// check the signature.
+func dkey(t *testing.T, userid, deviceid, typ string, key []byte) []byte {
+	payload, err := json.Marshal(&ks.DKey{
+		UserID:   userid,
+		DeviceID: deviceid,
+		Key:      yenc.RawURL64.EncodeToString(key),
+		Type:     typ,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte("e30." + base64.RawURLEncoding.EncodeToString(payload) + ".c2ln")
+}
+
+func TestZoneRecords(t *testing.T) {
+	store, err := ks.OpenStore(&ks.Config{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, k := range []struct {
+		userid, deviceid, typ, key string
+	}{
+		{"hugh@example.com", "laptop", ks.KeyTypePGP, "k2"},
+		{"hugh@example.com", "phone", "", "k1"},
+		// The same key on two devices makes one record.
+		{"hugh@example.com", "tablet", ks.KeyTypePGP, "k2"},
+		{"hugh@EXAMPLE.com", "laptop", ks.KeyTypePGP, "k2"},
+		{"amy@example.com", "laptop", ks.KeyTypePGP, "k3"},
+		{"amy@example.com", "ssh", ks.KeyTypeSSH, "k4"},
+		{"hugh@example.org", "laptop", ks.KeyTypePGP, "k5"},
+		{"hugh@mail.example.com", "laptop", ks.KeyTypePGP, "k6"},
+	} {
+		store.NewOrUpdate(k.userid, k.deviceid, dkey(t, k.userid, k.deviceid, k.typ, []byte(k.key)))
+	}
+
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	hugh := owner("hugh", "example.com")
+	amy := owner("amy", "example.com")
+	// hugh@EXAMPLE.com's key is hugh@example.com's, under the same
+	// name, so it makes no record of its own.
+	want := []record{
+		{hugh, b64("k1"), []string{"hugh@example.com"}},
+		{hugh, b64("k2"), []string{"hugh@EXAMPLE.com", "hugh@example.com"}},
+		{amy, b64("k3"), []string{"amy@example.com"}},
+	}
+	// Sorted by name, then by key.
+	sort.Slice(want, func(i, j int) bool {
+		a, b := want[i], want[j]
+		if a.owner != b.owner {
+			return a.owner < b.owner
+		}
+		return a.key < b.key
+	})
+
+	// The memory store visits users in a different order each time;
+	// -sort has to make up for it.
+	for i := 0; i < 10; i++ {
+		got, err := zoneRecords(store, "example.com", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
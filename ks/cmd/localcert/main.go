@@ -1,5 +1,11 @@
 // localcert is a small utility that generates a CA, signs a certificate
 // with it, and then throws away the key.
+//
+// With -keepca, it keeps the CA's key instead, so that
+//
+//	localcert client -prefix localhost. you@example.com
+//
+// can later issue client certificates for the keyshop's -clientca.
 
 // NOTE: Original version derived from Go distribution.
 
@@ -13,6 +19,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"os"
 	"strconv"
@@ -40,8 +47,8 @@ func serialNumber() *big.Int {
 	return serialNumber
 }
 
-func writePem(fn string, t string, derBytes []byte) {
-	certOut, err := os.Create(fn)
+func writePem(fn string, t string, derBytes []byte, perm os.FileMode) {
+	certOut, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		log.Fatalf("failed to open %s for writing: %s", fn, err)
 	}
@@ -50,8 +57,73 @@ func writePem(fn string, t string, derBytes []byte) {
 	log.Infof("written %s\n", fn)
 }
 
-func generate(c *cli.Context) {
+func readPem(fn string) []byte {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.Fatalf("failed to read %s: %s", fn, err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		log.Fatalf("no PEM block in %s", fn)
+	}
+	return block.Bytes
+}
+
+// client issues a client certificate for an email address, signed by
+// a CA kept with -keepca.
+func client(c *cli.Context) {
+	emails := c.Args()
+	if len(emails) != 1 {
+		log.Fatalf("usage: localcert client [-prefix PREFIX] EMAIL")
+	}
+	email := emails[0]
+	prefix := c.String("prefix")
+
+	ca, err := x509.ParseCertificate(readPem(prefix + "ca.pem"))
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	caPriv, err := x509.ParseECPrivateKey(readPem(prefix + "cakey.pem"))
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	notBefore := time.Now().UTC()
+	notAfter := notBefore.Add(time.Duration(c.Int("validfor")*24) * time.Hour)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+	clientName := ca.Subject
+	clientName.CommonName = email
+	clientTemplate := &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+
+		Issuer:         ca.Subject,
+		Subject:        clientName,
+		EmailAddresses: []string{email},
+
+		// Common fields:
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		SerialNumber: serialNumber(),
+	}
 
+	clientPriv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		log.Fatalf("error generating private key: %s", err)
+	}
+	clientDer, err := x509.CreateCertificate(rand.Reader, clientTemplate, ca, &clientPriv.PublicKey, caPriv)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	// Next to the CA they come from, not wherever localcert is run.
+	writePem(prefix+email+".client.pem", "CERTIFICATE", clientDer, 0644)
+	b, err := x509.MarshalECPrivateKey(clientPriv)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	writePem(prefix+email+".clientkey.pem", "EC PRIVATE KEY", b, 0600)
 }
 
 func main() {
@@ -80,6 +152,28 @@ func main() {
 			Name:  "prefix",
 			Value: "",
 		},
+		&cli.BoolFlag{
+			Name:  "keepca",
+			Usage: "keep the CA's private key, so that it can issue client certificates",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:   "client",
+			Usage:  "issue a client certificate for an email address from a kept CA",
+			Action: client,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "validfor",
+					Value: 30,
+				},
+				&cli.StringFlag{
+					Name:  "prefix",
+					Value: "localhost.",
+				},
+			},
+		},
 	}
 
 	app.Action = func(c *cli.Context) {
@@ -172,11 +266,25 @@ func main() {
 			log.Fatalf("error generating private key: %s", err)
 		}
 
+		if c.Bool("keepca") {
+			// The CA's extended key usages constrain those of
+			// the certificates it issues.
+			caTemplate.ExtKeyUsage = append(caTemplate.ExtKeyUsage,
+				x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+		}
+
 		caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caPriv.PublicKey, caPriv)
 		if err != nil {
 			log.Fatalf("%s", err)
 		}
-		writePem(prefix+"ca.pem", "CERTIFICATE", caDer)
+		writePem(prefix+"ca.pem", "CERTIFICATE", caDer, 0644)
+		if c.Bool("keepca") {
+			b, err := x509.MarshalECPrivateKey(caPriv)
+			if err != nil {
+				log.Fatalf("%s", err)
+			}
+			writePem(prefix+"cakey.pem", "EC PRIVATE KEY", b, 0600)
+		}
 
 		ca, err := x509.ParseCertificate(caDer)
 		if err != nil {
@@ -187,13 +295,13 @@ func main() {
 		if err != nil {
 			log.Fatalf("%s", err)
 		}
-		writePem(prefix+"server.pem", "CERTIFICATE", serverDer)
+		writePem(prefix+"server.pem", "CERTIFICATE", serverDer, 0644)
 
 		b, err := x509.MarshalECPrivateKey(serverPriv)
 		if err != nil {
 			log.Fatalf("%s", err)
 		}
-		writePem(prefix+"privatekey.pem", "EC PRIVATE KEY", b)
+		writePem(prefix+"privatekey.pem", "EC PRIVATE KEY", b, 0600)
 		return
 	}
 	app.Run(os.Args)
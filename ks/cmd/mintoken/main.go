@@ -0,0 +1,94 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+//
+// mintoken issues bearer tokens for a keyshop, for development and
+// testing. E.g.:
+//
+//	mintoken -gensecret
+//	ks -tokensecret data/token.key ...
+//	curl -H "Authorization: Bearer $(mintoken -sub you@example.com -scope write)" ...
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/square/go-jose"
+	"github.com/yahoo/keyshop/ks"
+	"github.com/yahoo/keyshop/ks/token"
+)
+
+var (
+	sub       = flag.String("sub", "", "the userid (email address) the token is for")
+	aud       = flag.String("aud", ks.DefaultConfig().TokenAudience, "the audience the token is addressed to")
+	scope     = flag.String("scope", token.ScopeRead, `"read" or "write"`)
+	ttl       = flag.Duration("ttl", time.Hour, "how long the token is good for")
+	secretFn  = flag.String("secret", "data/token.key", "file holding the HMAC secret")
+	kauthFn   = flag.String("kauth", "", "sign with the kauth's private key in this PEM file, instead of the HMAC secret")
+	genSecret = flag.Bool("gensecret", false, "write a new random HMAC secret to the -secret file, and exit")
+)
+
+func main() {
+	flag.Parse()
+
+	if *genSecret {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("error generating secret: %s", err)
+		}
+		f, err := os.OpenFile(*secretFn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalf("error creating %s: %s", *secretFn, err)
+		}
+		if _, err := f.Write(secret); err != nil {
+			log.Fatalf("error writing %s: %s", *secretFn, err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("error writing %s: %s", *secretFn, err)
+		}
+		log.Printf("wrote a new token secret to %s", *secretFn)
+		return
+	}
+
+	if *sub == "" {
+		log.Fatalf("-sub is required")
+	}
+	if *scope != token.ScopeRead && *scope != token.ScopeWrite {
+		log.Fatalf("unknown scope %q", *scope)
+	}
+
+	var key interface{}
+	if *kauthFn != "" {
+		b, err := ioutil.ReadFile(*kauthFn)
+		if err != nil {
+			log.Fatalf("error reading kauth PEM file: %s", err)
+		}
+		if key, err = jose.LoadPrivateKey(b); err != nil {
+			log.Fatalf("error parsing kauth PEM file: %s", err)
+		}
+	} else {
+		secret, err := ioutil.ReadFile(*secretFn)
+		if err != nil {
+			log.Fatalf("error reading token secret: %s", err)
+		}
+		key = secret
+	}
+
+	now := time.Now().UTC()
+	tok, err := token.Mint(&token.Claims{
+		Audience: *aud,
+		Expiry:   now.Add(*ttl).Unix(),
+		IssuedAt: now.Unix(),
+		Scope:    *scope,
+		Subject:  *sub,
+	}, key)
+	if err != nil {
+		log.Fatalf("error minting token: %s", err)
+	}
+	fmt.Println(tok)
+}
@@ -3,17 +3,47 @@
 // License: Apache 2
 package ks
 
-type config struct {
-	Addr      string
-	DbFn      string
-	KauthFn   string
-	SkipAuth  bool
-	TLSPrefix string
-	UseTLS    bool
+import (
+	"time"
+)
+
+// Config describes a single keyshop server.
+type Config struct {
+	Addr          string
+	Backend       string
+	ClientCAFn    string
+	ConfirmEmail  bool
+	ConfirmTTL    time.Duration
+	DbFn          string
+	EpochInterval time.Duration
+	HKP           bool
+	KauthAddr     string
+	KauthFn       string
+	KauthSecretFn string
+	LogFn         string
+	MailDropDir   string
+	MailFrom      string
+	OIDCAudience  string
+	OIDCIssuer    string
+	OIDCKeys      string
+	PolicyFn      string
+	PublicURL     string
+	RequirePoP    bool
+	SMTPAddr      string
+	SkipAuth      bool
+	TLSPrefix     string
+	TokenAudience string
+	TokenKauth    bool
+	TokenMaxTTL   time.Duration
+	TokenSecretFn string
+	UseTLS        bool
+	WKD           bool
 }
 
-var (
-	Config = &config{
+// DefaultConfig returns the configuration for a keyshop listening on
+// localhost, with its data files under data/.
+func DefaultConfig() *Config {
+	return &Config{
 		// Whether to do something sane or not.
 		UseTLS:   true,
 		SkipAuth: false,
@@ -21,9 +51,66 @@ var (
 		// be particularly useful, unless you only want to talk to
 		// yourself.
 		Addr: "localhost:25519",
-		// The location of data files.
-		DbFn:      "data/25519.db",
-		KauthFn:   "data/kauth/kauth.pem",
+		// The storage backend: one of "bolt", "sqlite" or "memory".
+		Backend: "bolt",
+		// The location of data files. (DbFn is ignored by the memory
+		// backend.)
+		DbFn:    "data/25519.db",
+		KauthFn: "data/kauth/kauth.pem",
+		// If KauthAddr is set, the private key isn't read from
+		// KauthFn: kauthd, listening on the Unix socket at
+		// KauthAddr, signs instead, for requests MACed with the
+		// secret in KauthSecretFn.
+		KauthAddr:     "",
+		KauthSecretFn: "data/kauth/kauthd.key",
+		// The transparency log of every signed DKey. (Kept in
+		// memory if empty, or with the memory backend.)
+		LogFn:     "data/25519-log.db",
 		TLSPrefix: "data/tls/localhost.",
+		// How often to re-sign the key directory's root, even if
+		// nothing has changed, so that clients can tell how fresh
+		// it is.
+		EpochInterval: time.Minute,
+		// Bearer tokens are accepted if they are MACed with the
+		// secret in TokenSecretFn, or (if TokenKauth is set)
+		// signed by the kauth, and addressed to TokenAudience.
+		TokenAudience: "keyshop",
+		// Tokens good for longer than TokenMaxTTL, from when
+		// they were issued, are refused.
+		TokenMaxTTL: 24 * time.Hour,
+		// If set, TLS client certificates issued by the CAs in
+		// this PEM file are accepted; their email address is the
+		// principal.
+		ClientCAFn: "",
+		// If OIDCIssuer is set, OpenID Connect ID tokens from it,
+		// addressed to OIDCAudience, are accepted; their verified
+		// email address is the principal. OIDCKeys is the file
+		// or URL of the issuer's JWKS.
+		OIDCIssuer: "",
+		// If ConfirmEmail is set, a new key is only registered
+		// once its user follows a link mailed to them, within
+		// ConfirmTTL. Links start with PublicURL. Mail goes
+		// through the SMTP server at SMTPAddr or, if MailDropDir
+		// is set, is written to files there instead.
+		ConfirmEmail: false,
+		ConfirmTTL:   24 * time.Hour,
+		PublicURL:    "https://localhost:25519",
+		SMTPAddr:     "localhost:25",
+		MailFrom:     "keyshop@localhost",
+		// If RequirePoP is set, a POST must carry a signature,
+		// made with the key being registered, over a nonce from
+		// GET /v1/challenge/{userid}.
+		RequirePoP: false,
+		// If set, a JSON Policy limiting which addresses are
+		// served, and how many devices each may register.
+		PolicyFn: "",
+		// If WKD is set, users' OpenPGP keys are also served,
+		// to anyone, at the Web Key Directory's well-known
+		// paths.
+		WKD: false,
+		// If HKP is set, the keyshop also speaks the HTTP
+		// Keyserver Protocol, at /pks/: lookups are public, and
+		// adding a key is like POSTing it to /v1/k.
+		HKP: false,
 	}
-)
+}
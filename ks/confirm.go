@@ -0,0 +1,125 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/yahoo/keyshop/yenc"
+)
+
+// activate makes dkey the key for userid/deviceid: it is logged, and
+// then stored and published in the key directory. If the policy
+// doesn't let the user register another device, it returns a 403, and
+// the policy's Error, instead.
+func (s *Server) activate(userid, deviceid string, dkey []byte) (status int, kerr *Error) {
+	status = s.update(userid, func() int {
+		// Nothing else can change userid's keys until update
+		// returns, so two registrations can't both fit under the
+		// limit.
+		var st int
+		if st, kerr = s.checkDevices(userid, deviceid); st != http.StatusOK {
+			return st
+		}
+		// Log the DKey before anyone can be handed it.
+		if _, err := s.log.Append(dkey); err != nil {
+			glog.Errorf("error appending DKey to the transparency log: %s", err)
+			return http.StatusInternalServerError
+		}
+		// If this fails, the first GET of the tree head signs it.
+		if _, err := s.signTreeHead(); err != nil {
+			glog.Errorf("error signing tree head: %s", err)
+		}
+		return s.store.NewOrUpdate(userid, deviceid, dkey)
+	})
+	return status, kerr
+}
+
+// pendingID is what a confirmation token is stored under, so that
+// the store never holds anything that could confirm a registration.
+func pendingID(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return yenc.RawURL64.EncodeToString(h[:])
+}
+
+const confirmBody = `Someone, hopefully you, asked to register a key for %s
+on the device %q with this keyshop.
+
+To confirm that this is your address, and make the key available to
+anyone looking you up, visit
+
+    %s
+
+within %s. If it wasn't you, ignore this message, and nothing will
+be registered.
+`
+
+// pend holds dkey until userid confirms that they control their
+// mailbox, by following a one-time link that is mailed to them.
+func (s *Server) pend(userid, deviceid string, dkey []byte) (status int) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		glog.Errorf("error generating confirmation token: %s", err)
+		return http.StatusInternalServerError
+	}
+	token := yenc.RawURL64.EncodeToString(b)
+	status = s.store.PutPending(pendingID(token), &Pending{
+		UserID:   userid,
+		DeviceID: deviceid,
+		DKey:     string(dkey),
+		Expires:  time.Now().Add(s.config.ConfirmTTL).UTC().Unix(),
+	})
+	if status != http.StatusOK {
+		return status
+	}
+	link := strings.TrimRight(s.config.PublicURL, "/") + "/v1/confirm/" + token
+	body := fmt.Sprintf(confirmBody, userid, deviceid, link, s.config.ConfirmTTL)
+	if err := s.mailer.Send(userid, "Confirm your keyshop registration", body); err != nil {
+		glog.Errorf("error mailing confirmation to %s: %s", userid, err)
+		return http.StatusInternalServerError
+	}
+	glog.Infof("sent confirmation for %s/%s", userid, deviceid)
+	return http.StatusOK
+}
+
+// GET /v1/confirm/<token>
+// Returns:
+//   200 StatusOK      : The key is registered; the body is the signed DKey
+//   403 StatusForbidden: If the user now has too many devices; the body is an Error
+//   404 StatusNotFound: If the token is unknown, or was already used
+//   410 StatusGone    : If the token has expired
+//   5xx               : Random server issues that should never occur
+func (s *Server) confirm(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	p, status := s.store.TakePending(pendingID(token))
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	if time.Now().UTC().Unix() > p.Expires {
+		glog.Infof("confirmation for %s/%s has expired", p.UserID, p.DeviceID)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	glog.Infof("confirmed %s/%s", p.UserID, p.DeviceID)
+	// The user may have registered other devices meanwhile.
+	status, kerr := s.activate(p.UserID, p.DeviceID, []byte(p.DKey))
+	if kerr != nil {
+		writeError(w, status, kerr)
+		return
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/jws")
+	w.Write([]byte(p.DKey))
+}
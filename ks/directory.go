@@ -0,0 +1,219 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/yahoo/keyshop/ks/smt"
+	"github.com/yahoo/keyshop/yenc"
+)
+
+// The key directory is a sparse Merkle tree, keyed by the SHA-256
+// hash of each userid, whose leaves commit to each user's current
+// keys. Every change to a user's keys, and every EpochInterval in
+// any case, starts a new epoch: the kauth signs a MapRoot for it, and
+// GET answers carry a proof against the latest one. The latest epoch
+// is kept in the store, so that epochs carry on across restarts.
+type directory struct {
+	mu    sync.RWMutex
+	tree  *smt.Tree
+	epoch uint64
+	root  []byte // the signed MapRoot for epoch
+	// unsynced are the users whose keys have changed in the store
+	// since their leaves were last set.
+	unsynced map[string]bool
+	// stale is set when the store has changed since root was
+	// signed, and publishing it failed: proofs against the tree
+	// wouldn't verify against root, so none are given until a
+	// publish succeeds.
+	stale bool
+	stop  chan struct{}
+}
+
+// keysHash returns the value committed to in the key directory for
+// keys, or nil if there are none.
+func keysHash(keys map[string]string) []byte {
+	if len(keys) == 0 {
+		return nil
+	}
+	// encoding/json sorts map keys, so this is canonical.
+	data, err := json.Marshal(keys)
+	if err != nil {
+		panic(err)
+	}
+	return smt.ValueHash(data)
+}
+
+// VerifyMapProof checks that p proves that keys are userid's keys
+// (or, if keys is empty, that userid has none) in the key directory
+// with the given root hash.
+func VerifyMapProof(p *MapProof, root []byte, userid string, keys map[string]string) error {
+	proof := &smt.Proof{Siblings: make([][]byte, len(p.Siblings))}
+	for i, sib := range p.Siblings {
+		b, err := yenc.RawURL64.DecodeString(sib)
+		if err != nil {
+			return fmt.Errorf("bad sibling %d: %s", i, err)
+		}
+		proof.Siblings[i] = b
+	}
+	if p.Index != "" {
+		var err error
+		if proof.Index, err = yenc.RawURL64.DecodeString(p.Index); err != nil {
+			return fmt.Errorf("bad index: %s", err)
+		}
+		if proof.Value, err = yenc.RawURL64.DecodeString(p.Value); err != nil {
+			return fmt.Errorf("bad value: %s", err)
+		}
+	}
+	return proof.Verify(root, smt.Index([]byte(userid)), keysHash(keys))
+}
+
+func encodeMapProof(p *smt.Proof) *MapProof {
+	mp := &MapProof{Siblings: encodeHashes(p.Siblings)}
+	if p.Index != nil {
+		mp.Index = yenc.RawURL64.EncodeToString(p.Index)
+		mp.Value = yenc.RawURL64.EncodeToString(p.Value)
+	}
+	return mp
+}
+
+// initDirectory builds the key directory from the store, publishes
+// the epoch after the last one the store has, and starts publishing
+// one every EpochInterval.
+func (s *Server) initDirectory() error {
+	d := &directory{tree: smt.New(), unsynced: make(map[string]bool), stop: make(chan struct{})}
+	err := s.store.ForEach(func(userid string, keys map[string]string) error {
+		d.tree.Set(smt.Index([]byte(userid)), keysHash(keys))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error building key directory: %s", err)
+	}
+	switch epoch, root, status := s.store.MapRoot(); status {
+	case http.StatusOK:
+		d.epoch, d.root = epoch, root
+	case http.StatusNotFound:
+	default:
+		return fmt.Errorf("error reading the key directory's last epoch: status %d", status)
+	}
+	s.dir = d
+	d.mu.Lock()
+	err = s.publishLocked()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.config.EpochInterval > 0 {
+		go s.publishEvery(s.config.EpochInterval)
+	}
+	return nil
+}
+
+func (s *Server) publishEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.dir.mu.Lock()
+			if err := s.publishLocked(); err != nil {
+				glog.Errorf("error publishing key directory epoch: %s", err)
+			}
+			s.dir.mu.Unlock()
+		case <-s.dir.stop:
+			return
+		}
+	}
+}
+
+// publishLocked brings the tree up to date with the store, starts a
+// new epoch, signing the directory's current root, and stores it
+// before anyone sees it. The caller must hold s.dir.mu.
+func (s *Server) publishLocked() error {
+	d := s.dir
+	for userid := range d.unsynced {
+		keys, status := s.store.Get(userid)
+		if status != http.StatusOK && status != http.StatusNotFound {
+			return fmt.Errorf("error re-reading keys for %s: status %d", userid, status)
+		}
+		d.tree.Set(smt.Index([]byte(userid)), keysHash(keys))
+		delete(d.unsynced, userid)
+	}
+	data, err := json.Marshal(&MapRoot{
+		Epoch:     d.epoch + 1,
+		RootHash:  yenc.RawURL64.EncodeToString(d.tree.Root()),
+		Timestamp: time.Now().UTC().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	signed, err := s.ka.Sign(data)
+	if err != nil {
+		return fmt.Errorf("error getting signature from kauth: %s", err)
+	}
+	if status := s.store.PutMapRoot(d.epoch+1, signed); status != http.StatusOK {
+		return fmt.Errorf("error storing epoch %d: status %d", d.epoch+1, status)
+	}
+	d.epoch++
+	d.root = signed
+	d.stale = false
+	return nil
+}
+
+// update runs mutate, which changes userid's keys in the store and
+// returns the store's status. If it succeeds, the key directory is
+// brought up to date and a new epoch is published, before anyone can
+// read userid's keys again. If that fails, the change stays in the
+// store, but update returns a 500, and no keys are served until an
+// epoch is published.
+func (s *Server) update(userid string, mutate func() int) (status int) {
+	s.dir.mu.Lock()
+	defer s.dir.mu.Unlock()
+	if status = mutate(); status != http.StatusOK {
+		return status
+	}
+	s.dir.unsynced[userid] = true
+	if err := s.publishLocked(); err != nil {
+		glog.Errorf("error publishing key directory epoch: %s", err)
+		s.dir.stale = true
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// lookup returns userid's keys, along with a proof of them against
+// the latest signed MapRoot. While the directory is stale, it returns
+// a 503 instead.
+func (s *Server) lookup(userid string) (keys map[string]string, status int, proof *MapProof, root []byte) {
+	s.dir.mu.RLock()
+	defer s.dir.mu.RUnlock()
+	if s.dir.stale {
+		glog.Errorf("not serving keys for %s until the key directory is published", userid)
+		return nil, http.StatusServiceUnavailable, nil, nil
+	}
+	keys, status = s.store.Get(userid)
+	p := s.dir.tree.Prove(smt.Index([]byte(userid)))
+	return keys, status, encodeMapProof(p), s.dir.root
+}
+
+// GET /v1/map/root
+func (s *Server) mapRoot(w http.ResponseWriter, r *http.Request) {
+	s.dir.mu.RLock()
+	root := s.dir.root
+	s.dir.mu.RUnlock()
+	h := w.Header()
+	h.Set("Content-Type", "application/jws")
+	w.Write(root)
+}
+
+func (s *Server) closeDirectory() {
+	if s.dir != nil {
+		close(s.dir.stop)
+	}
+}
@@ -4,8 +4,14 @@
 package ks
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -13,68 +19,258 @@ import (
 )
 
 var (
-	ks      *state
 	buckets = []string{"issued"}
 	errNsk  = errors.New("no such key")
 	errNsu  = errors.New("no such user")
 )
 
+// Root buckets that don't belong to a user start with a NUL byte;
+// see reserved.
+var (
+	historyBucket = []byte("\x00history")
+	pendingBucket = []byte("\x00pending")
+	ownersBucket  = []byte("\x00owners")
+	mapRootBucket = []byte("\x00maproot")
+	// pendingDevicesBucket maps each device to the id of its pending
+	// registration, and pendingExpiryBucket orders the ids by when
+	// they expire; see pendingExpiryKey.
+	pendingDevicesBucket = []byte("\x00pendingdevices")
+	pendingExpiryBucket  = []byte("\x00pendingexpiry")
+)
+
+// reserved reports whether userid names one of the store's own root
+// buckets rather than a user's.
+func reserved(userid string) bool {
+	return strings.HasPrefix(userid, "\x00")
+}
+
 type Key struct {
 	Userid   []byte
 	Deviceid []byte
 	Key      []byte
 }
 
+// A KeyShop stores the signed DKey for each of a user's devices.
+//
+// Methods return the HTTP status that the handlers should pass
+// back to the client.
 type KeyShop interface {
-	New(userid, deviceid, key []byte) int
-	Update(userid, deviceid, key []byte) int
-	Get(userid []byte) (map[string][]byte, int)
+	// NewOrUpdate stores the signed DKey for userid/deviceid,
+	// replacing any key already registered for the device, and
+	// appends it to the device's history.
+	NewOrUpdate(userid, deviceid string, dkey []byte) (status int)
+	// Get returns a map from deviceid to signed DKey for userid.
+	Get(userid string) (keys map[string]string, status int)
+	// Revoke removes the key registered for userid/deviceid and
+	// appends the signed Revocation to the device's history.
+	Revoke(userid, deviceid string, revocation []byte) (status int)
+	// History returns every DKey ever stored for userid/deviceid,
+	// and every revocation, oldest first. Revoking a key does not
+	// remove it from the history.
+	History(userid, deviceid string) (entries []HistoryEntry, status int)
+	// ForEach calls fn with the keys of every user that has any,
+	// stopping at the first error. fn must not modify the store.
+	ForEach(fn func(userid string, keys map[string]string) error) error
+	// PutPending stores a registration awaiting confirmation under
+	// id, replacing any earlier one for the same device, whose link
+	// would otherwise overwrite the newer key, and discarding any that
+	// have expired.
+	PutPending(id string, p *Pending) (status int)
+	// TakePending removes and returns the registration stored
+	// under id, whether or not it has expired.
+	TakePending(id string) (p *Pending, status int)
+	// PutMapRoot stores the signed MapRoot of the key directory's
+	// latest epoch, so that a restarted server carries on from it.
+	PutMapRoot(epoch uint64, root []byte) (status int)
+	// MapRoot returns what PutMapRoot last stored, or a 404 if it
+	// never has been.
+	MapRoot() (epoch uint64, root []byte, status int)
+	// Owners returns the devices whose current key has the
+	// OpenPGP fingerprint or key ID keyid; see keyIDs.
+	Owners(keyid string) (owners []Owner, status int)
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// backends maps the names accepted in Config.Backend to a
+// constructor for that storage backend. The arguments are Config.DbFn,
+// and whether to open it read-only; see OpenStoreReadOnly.
+var backends = map[string]func(fn string, readOnly bool) (KeyShop, error){
+	"bolt":   openBolt,
+	"memory": openMemory,
+	"sqlite": openSQL,
 }
 
+// OpenStore opens the storage backend selected by c.Backend, creating
+// it, or bringing it up to date, if need be.
+func OpenStore(c *Config) (KeyShop, error) {
+	return openStore(c, false)
+}
+
+// OpenStoreReadOnly opens the existing store selected by c.Backend
+// for tools that read it directly, such as kszone. It is neither
+// created nor changed, and the KeyShop's methods that write fail. A
+// bolt store can only be read while no server has it open.
+func OpenStoreReadOnly(c *Config) (KeyShop, error) {
+	return openStore(c, true)
+}
+
+func openStore(c *Config, readOnly bool) (KeyShop, error) {
+	open, ok := backends[c.Backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q", c.Backend)
+	}
+	return open(c.DbFn, readOnly)
+}
+
+// state is a KeyShop backed by a single bolt file. Each user has a
+// bucket, mapping deviceid to the signed DKey for the device.
+// Device histories live under historyBucket, in a bucket per user
+// and then per device, keyed by a big-endian sequence number. The
+// fingerprint index lives in ownersBucket, keyed by key ID, then
+// userid, then deviceid, separated by NULs. The latest signed MapRoot
+// and its epoch live in mapRootBucket.
 type state struct {
 	db *bolt.DB
-	KeyShop
 }
 
-func (s *state) New(userid, deviceid, key []byte) (status int) {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(userid)
-		if err != nil {
+func openBolt(fn string, readOnly bool) (KeyShop, error) {
+	if readOnly {
+		// Bolt creates a missing file, even read-only.
+		if _, err := os.Stat(fn); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(fn, 0600, &bolt.Options{
+		Timeout:  1 * time.Second,
+		ReadOnly: readOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return &state{db: db}, nil
+	}
+	// Index databases from before there was an index.
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(ownersBucket) != nil {
+			return nil
+		}
+		glog.Infof("building the fingerprint index of %s", fn)
+		if _, err := tx.CreateBucket(ownersBucket); err != nil {
 			return err
 		}
-		d, err := b.CreateBucketIfNotExists(deviceid)
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if reserved(string(name)) {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				return indexKey(tx, string(name), string(k), v)
+			})
+		})
+	})
+	if err == nil {
+		err = db.Update(indexOldPending)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &state{db: db}, nil
+}
+
+// indexOldPending indexes the pending registrations of databases from
+// before they were indexed, keeping only the latest for each device.
+func indexOldPending(tx *bolt.Tx) error {
+	b := tx.Bucket(pendingBucket)
+	if b == nil || tx.Bucket(pendingExpiryBucket) != nil {
+		return nil
+	}
+	glog.Infof("indexing pending registrations")
+	var ids []string
+	if err := b.ForEach(func(k, v []byte) error {
+		ids = append(ids, string(k))
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		p, err := getPending(tx, id)
 		if err != nil {
+			// It can be neither confirmed nor expired.
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		if older, _ := getPending(tx, pendingOf(tx, p)); older != nil && older.Expires > p.Expires {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := putPending(tx, id, p); err != nil {
 			return err
 		}
-		d.Put([]byte("key"), key)
-		t, _ := time.Now().UTC().GobEncode()
-		d.Put([]byte("updated"), t)
+	}
+	return nil
+}
+
+func ownerKey(keyid, userid, deviceid string) []byte {
+	return []byte(keyid + "\x00" + userid + "\x00" + deviceid)
+}
+
+// indexKey adds userid/deviceid to the owners of the key in dkey.
+func indexKey(tx *bolt.Tx, userid, deviceid string, dkey []byte) error {
+	b, err := tx.CreateBucketIfNotExists(ownersBucket)
+	if err != nil {
+		return err
+	}
+	for _, id := range keyIDs(dkey) {
+		if err := b.Put(ownerKey(id, userid, deviceid), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexKey removes userid/deviceid from the owners of the key in
+// dkey.
+func unindexKey(tx *bolt.Tx, userid, deviceid string, dkey []byte) error {
+	b := tx.Bucket(ownersBucket)
+	if b == nil {
 		return nil
-	})
-	switch err {
-	case bolt.ErrBucketExists:
-		return http.StatusConflict
-	case nil:
-		return http.StatusCreated
-	default:
-		return http.StatusInternalServerError
 	}
+	for _, id := range keyIDs(dkey) {
+		if err := b.Delete(ownerKey(id, userid, deviceid)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (s *state) Update(userid, deviceid, key []byte) (status int) {
+func (s *state) NewOrUpdate(userid, deviceid string, dkey []byte) (status int) {
+	if reserved(userid) {
+		return http.StatusBadRequest
+	}
 	err := s.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(userid)
+		b, err := tx.CreateBucketIfNotExists([]byte(userid))
 		if err != nil {
+			glog.Errorf("error creating or getting %s/%s bucket: %s", userid, deviceid, err)
 			return err
 		}
-		d := b.Bucket(deviceid)
-		if b == nil {
-			return errNsk
+		if old := b.Get([]byte(deviceid)); old != nil {
+			if err := unindexKey(tx, userid, deviceid, old); err != nil {
+				return err
+			}
 		}
-		d.Put([]byte("key"), key)
-		t, _ := time.Now().UTC().GobEncode()
-		d.Put([]byte("updated"), t)
-		return nil
+		if err := b.Put([]byte(deviceid), dkey); err != nil {
+			return err
+		}
+		if err := indexKey(tx, userid, deviceid, dkey); err != nil {
+			return err
+		}
+		return appendHistory(tx, userid, deviceid, HistoryEntry{DKey: string(dkey)})
 	})
 	if err != nil {
 		return http.StatusInternalServerError
@@ -82,23 +278,53 @@ func (s *state) Update(userid, deviceid, key []byte) (status int) {
 	return http.StatusOK
 }
 
-func (s *state) NewOrUpdate(userid, deviceid, key []byte) (status int) {
+// Revoke removes the key for a single device. If it was the user's
+// last device, the user's bucket is removed as well, so that later
+// lookups get the signed "no keys" answer.
+func (s *state) Revoke(userid, deviceid string, revocation []byte) (status int) {
+	if reserved(userid) {
+		return http.StatusNotFound
+	}
 	err := s.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(userid)
-		if err != nil {
-			glog.Errorf("error creating or getting %s/%s bucket: %s", userid, deviceid, err)
+		b := tx.Bucket([]byte(userid))
+		if b == nil {
+			return errNsu
+		}
+		old := b.Get([]byte(deviceid))
+		if old == nil {
+			return errNsk
+		}
+		if err := unindexKey(tx, userid, deviceid, old); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(deviceid)); err != nil {
+			glog.Errorf("error deleting %s/%s: %s", userid, deviceid, err)
 			return err
 		}
-		b.Put(deviceid, key)
+		if err := appendHistory(tx, userid, deviceid, HistoryEntry{Revocation: string(revocation)}); err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			return tx.DeleteBucket([]byte(userid))
+		}
 		return nil
 	})
-	if err != nil {
+	switch err {
+	case errNsu, errNsk:
+		glog.Infof("no key to revoke for %s/%s", userid, deviceid)
+		return http.StatusNotFound
+	case nil:
+		return http.StatusOK
+	default:
+		glog.Errorf("error revoking key for %s/%s: %s", userid, deviceid, err)
 		return http.StatusInternalServerError
 	}
-	return http.StatusOK
 }
 
 func (s *state) Get(userid string) (keys map[string]string, status int) {
+	if reserved(userid) {
+		return nil, http.StatusNotFound
+	}
 	keys = make(map[string]string)
 	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(userid))
@@ -125,3 +351,317 @@ func (s *state) Get(userid string) (keys map[string]string, status int) {
 		return nil, http.StatusInternalServerError
 	}
 }
+
+func (s *state) ForEach(fn func(userid string, keys map[string]string) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if reserved(string(name)) {
+				return nil
+			}
+			keys := make(map[string]string)
+			b.ForEach(func(k, v []byte) error {
+				keys[string(k)] = string(v)
+				return nil
+			})
+			return fn(string(name), keys)
+		})
+	})
+}
+
+// appendHistory stamps e with the current time and appends it to the
+// history of userid/deviceid.
+func appendHistory(tx *bolt.Tx, userid, deviceid string, e HistoryEntry) error {
+	h, err := tx.CreateBucketIfNotExists(historyBucket)
+	if err != nil {
+		return err
+	}
+	u, err := h.CreateBucketIfNotExists([]byte(userid))
+	if err != nil {
+		return err
+	}
+	d, err := u.CreateBucketIfNotExists([]byte(deviceid))
+	if err != nil {
+		return err
+	}
+	seq, err := d.NextSequence()
+	if err != nil {
+		return err
+	}
+	e.Timestamp = time.Now().UTC().Unix()
+	entry, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return d.Put(k, entry)
+}
+
+func (s *state) History(userid, deviceid string) (entries []HistoryEntry, status int) {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var d *bolt.Bucket
+		if h := tx.Bucket(historyBucket); h != nil {
+			if u := h.Bucket([]byte(userid)); u != nil {
+				d = u.Bucket([]byte(deviceid))
+			}
+		}
+		if d == nil {
+			return errNsk
+		}
+		// Bolt iterates in key order, which is the order the
+		// entries were appended in.
+		return d.ForEach(func(k, v []byte) error {
+			var e HistoryEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	switch err {
+	case errNsk:
+		glog.Infof("no history for %s/%s", userid, deviceid)
+		return nil, http.StatusNotFound
+	case nil:
+		return entries, http.StatusOK
+	default:
+		glog.Errorf("error reading history for %s/%s: %s", userid, deviceid, err)
+		return nil, http.StatusInternalServerError
+	}
+}
+
+func pendingDeviceKey(userid, deviceid string) []byte {
+	return []byte(userid + "\x00" + deviceid)
+}
+
+// pendingExpiryKey is id's key in pendingExpiryBucket: when it
+// expires, big-endian, so that a cursor finds the first to expire
+// first, followed by id.
+func pendingExpiryKey(expires int64, id string) []byte {
+	k := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(expires))
+	return append(k, id...)
+}
+
+// getPending returns the registration pending under id, or errNsk.
+func getPending(tx *bolt.Tx, id string) (*Pending, error) {
+	b := tx.Bucket(pendingBucket)
+	if b == nil {
+		return nil, errNsk
+	}
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, errNsk
+	}
+	p := new(Pending)
+	if err := json.Unmarshal(v, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// pendingOf returns the id of the registration pending for p's
+// device, or "".
+func pendingOf(tx *bolt.Tx, p *Pending) string {
+	b := tx.Bucket(pendingDevicesBucket)
+	if b == nil {
+		return ""
+	}
+	return string(b.Get(pendingDeviceKey(p.UserID, p.DeviceID)))
+}
+
+// putPending stores p under id, and indexes it, replacing whatever
+// was pending for its device.
+func putPending(tx *bolt.Tx, id string, p *Pending) error {
+	if old := pendingOf(tx, p); old != "" && old != id {
+		if err := deletePending(tx, old); err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	b, err := tx.CreateBucketIfNotExists(pendingBucket)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(id), v); err != nil {
+		return err
+	}
+	devices, err := tx.CreateBucketIfNotExists(pendingDevicesBucket)
+	if err != nil {
+		return err
+	}
+	if err := devices.Put(pendingDeviceKey(p.UserID, p.DeviceID), []byte(id)); err != nil {
+		return err
+	}
+	expiry, err := tx.CreateBucketIfNotExists(pendingExpiryBucket)
+	if err != nil {
+		return err
+	}
+	return expiry.Put(pendingExpiryKey(p.Expires, id), nil)
+}
+
+// deletePending removes the registration pending under id, if any,
+// and its index entries.
+func deletePending(tx *bolt.Tx, id string) error {
+	p, err := getPending(tx, id)
+	switch err {
+	case errNsk:
+		return nil
+	case nil:
+	default:
+		// Without the registration, its index entries can't be
+		// found; expirePending will get to them.
+		return tx.Bucket(pendingBucket).Delete([]byte(id))
+	}
+	if err := tx.Bucket(pendingBucket).Delete([]byte(id)); err != nil {
+		return err
+	}
+	if pendingOf(tx, p) == id {
+		if err := tx.Bucket(pendingDevicesBucket).Delete(pendingDeviceKey(p.UserID, p.DeviceID)); err != nil {
+			return err
+		}
+	}
+	if b := tx.Bucket(pendingExpiryBucket); b != nil {
+		return b.Delete(pendingExpiryKey(p.Expires, id))
+	}
+	return nil
+}
+
+// expirePending removes the registrations that expired before now,
+// first to expire first, stopping at the first that hasn't.
+func expirePending(tx *bolt.Tx, now int64) error {
+	b := tx.Bucket(pendingExpiryBucket)
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.First() {
+		if len(k) >= 8 && int64(binary.BigEndian.Uint64(k)) >= now {
+			return nil
+		}
+		// k is only valid until the bucket changes.
+		k = append([]byte(nil), k...)
+		if len(k) >= 8 {
+			if err := deletePending(tx, string(k[8:])); err != nil {
+				return err
+			}
+		}
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *state) PutPending(id string, p *Pending) (status int) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := expirePending(tx, time.Now().UTC().Unix()); err != nil {
+			return err
+		}
+		return putPending(tx, id, p)
+	})
+	if err != nil {
+		glog.Errorf("error storing pending registration for %s/%s: %s", p.UserID, p.DeviceID, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+func (s *state) PutMapRoot(epoch uint64, root []byte) (status int) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(mapRootBucket)
+		if err != nil {
+			return err
+		}
+		e := make([]byte, 8)
+		binary.BigEndian.PutUint64(e, epoch)
+		if err := b.Put([]byte("epoch"), e); err != nil {
+			return err
+		}
+		return b.Put([]byte("root"), root)
+	})
+	if err != nil {
+		glog.Errorf("error storing map root for epoch %d: %s", epoch, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+func (s *state) MapRoot() (epoch uint64, root []byte, status int) {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mapRootBucket)
+		if b == nil {
+			return errNsk
+		}
+		e := b.Get([]byte("epoch"))
+		if len(e) != 8 {
+			return errors.New("malformed epoch")
+		}
+		epoch = binary.BigEndian.Uint64(e)
+		root = append([]byte(nil), b.Get([]byte("root"))...)
+		return nil
+	})
+	switch err {
+	case errNsk:
+		return 0, nil, http.StatusNotFound
+	case nil:
+		return epoch, root, http.StatusOK
+	default:
+		glog.Errorf("error reading map root: %s", err)
+		return 0, nil, http.StatusInternalServerError
+	}
+}
+
+func (s *state) TakePending(id string) (p *Pending, status int) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if p, err = getPending(tx, id); err != nil {
+			return err
+		}
+		return deletePending(tx, id)
+	})
+	switch err {
+	case errNsk:
+		return nil, http.StatusNotFound
+	case nil:
+		return p, http.StatusOK
+	default:
+		glog.Errorf("error taking pending registration: %s", err)
+		return nil, http.StatusInternalServerError
+	}
+}
+
+func (s *state) Owners(keyid string) (owners []Owner, status int) {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ownersBucket)
+		if b == nil {
+			return nil
+		}
+		prefix := []byte(keyid + "\x00")
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			parts := strings.SplitN(string(k[len(prefix):]), "\x00", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("bad index entry %q", k)
+			}
+			owners = append(owners, Owner{UserID: parts[0], DeviceID: parts[1]})
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Errorf("error looking up owners of %s: %s", keyid, err)
+		return nil, http.StatusInternalServerError
+	}
+	if len(owners) == 0 {
+		return nil, http.StatusNotFound
+	}
+	return owners, http.StatusOK
+}
+
+func (s *state) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/yahoo/keyshop/yenc"
+	"golang.org/x/crypto/openpgp"
+)
+
+// The fingerprint index maps the fingerprint and the 64-bit key ID of
+// every OpenPGP key and subkey that is registered to the devices it is
+// registered for, so that a signature's issuer can be traced back to
+// an account. Both are upper-case hex; see normalizeKeyID.
+
+// keyIDs returns the fingerprints and key IDs of the OpenPGP key in a
+// signed DKey, or none if it holds another type of key.
+func keyIDs(dkey []byte) []string {
+	d, err := dkeyOf(string(dkey))
+	if err != nil {
+		glog.Errorf("can't index a bad DKey: %s", err)
+		return nil
+	}
+	if d.Type != "" && d.Type != KeyTypePGP {
+		return nil
+	}
+	key, err := yenc.RawURL64.DecodeString(d.Key)
+	if err != nil {
+		glog.Errorf("can't index the key for %s/%s: %s", d.UserID, d.DeviceID, err)
+		return nil
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(key))
+	if err != nil {
+		glog.Errorf("can't index the key for %s/%s: %s", d.UserID, d.DeviceID, err)
+		return nil
+	}
+	var ids []string
+	for _, e := range el {
+		ids = append(ids, fmt.Sprintf("%X", e.PrimaryKey.Fingerprint), fmt.Sprintf("%016X", e.PrimaryKey.KeyId))
+		for _, sub := range e.Subkeys {
+			ids = append(ids, fmt.Sprintf("%X", sub.PublicKey.Fingerprint), fmt.Sprintf("%016X", sub.PublicKey.KeyId))
+		}
+	}
+	return ids
+}
+
+// normalizeKeyID returns a fingerprint (40 hex digits) or a key ID (16
+// of them), as written by people or tools, in the form it is indexed
+// under. Short, 8-digit, key IDs are too easy to collide to be
+// accepted.
+func normalizeKeyID(id string) (string, bool) {
+	id = strings.ToUpper(strings.Replace(id, " ", "", -1))
+	id = strings.TrimPrefix(id, "0X")
+	if len(id) != 16 && len(id) != 40 {
+		return "", false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'F') {
+			return "", false
+		}
+	}
+	return id, true
+}
+
+// GET /v1/fp/<fingerprint or key ID>
+// Returns:
+//   200 StatusOK          : The body is a signed KeyOwners
+//   400 StatusBadRequest  : If the fingerprint or key ID is malformed
+//   401 StatusUnauthorized: If the requester isn't authenticated
+//   404 StatusNotFound    : The body is a signed KeyOwners with no owners
+//   5xx                   : Random server issues that should never occur
+func (s *Server) owners(w http.ResponseWriter, r *http.Request) {
+	id, ok := normalizeKeyID(mux.Vars(r)["fingerprint"])
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	owners, status := s.store.Owners(id)
+	switch status {
+	case http.StatusOK:
+		sort.Slice(owners, func(i, j int) bool {
+			if owners[i].UserID != owners[j].UserID {
+				return owners[i].UserID < owners[j].UserID
+			}
+			return owners[i].DeviceID < owners[j].DeviceID
+		})
+	case http.StatusNotFound:
+		owners = []Owner{}
+	default:
+		w.WriteHeader(status)
+		return
+	}
+	s.signAndWrite(w, status, &KeyOwners{
+		KeyID:     id,
+		Owners:    owners,
+		Timestamp: time.Now().UTC().Unix(),
+	})
+}
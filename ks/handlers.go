@@ -11,7 +11,6 @@ import (
 	"encoding/json"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
-	"github.com/yahoo/keyshop/yenc"
 )
 
 const (
@@ -25,59 +24,77 @@ var (
 	bucket = []byte("keys")
 )
 
-var (
-	// Post handles requests to /v1/k/{userid}/{deviceid}
-	// The body of the request is the key to associate with
-	// this user's device {deviceid}
-	// It requires that
-	//    {userid}
-	//    body.userid
-	// are identical.
-	Post = requireAuth(post, true)
-	Get  = requireAuth(get, false)
-)
-
-func post(w http.ResponseWriter, r *http.Request) {
+func (s *Server) post(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userid, deviceid := vars["userid"], vars["deviceid"]
 
-	// The RequireAuth wrapper ensures that the userid
-	// muxed out of the URL is identical to the YBY's
-	// userid.
 	glog.Infof("POST /v1/k/%s/%s", userid, deviceid)
 
-	if r.ContentLength <= 0 || r.ContentLength > maxKeyLen {
+	// The requireAuth wrapper has authenticated the requester;
+	// only userid themselves may register keys for userid, and
+	// only if we serve them.
+	if !requireSelf(w, r, userid) || !s.allowUser(w, userid) {
+		return
+	}
+
+	if r.ContentLength <= 0 || r.ContentLength > maxBodyLen {
 		// Bail; we don't want to ReadAll...
 		glog.Warningf("request content length invalid: %d", r.ContentLength)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// Read the key
-	enc, err := ioutil.ReadAll(r.Body)
+	// Read the key, in whichever format it was sent.
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		glog.Warningf("couldn't read the full request: %s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	var key []byte
-	encKey := string(enc)
-
 	// FIXME(OSS): This does not necessarily guarantee that the output
 	// is terminal-safe.
-	glog.V(4).Infof("got body of %s", encKey)
-	key, err = yenc.RawURL64.DecodeString(encKey)
-	if err != nil {
-		glog.Warningf("invalid base64: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+	glog.V(4).Infof("got body of %q", body)
+	// Check that the key is valid and, for an OpenPGP key, that
+	// its userid is the authenticated principal's,
+	pk, status, kerr := readKey(r, userid, body)
+	if kerr != nil {
+		glog.Warningf("was not a valid key for userid %s: %s", userid, kerr.Message)
+		writeError(w, status, kerr)
+		return
+	}
+	s.register(w, r, userid, deviceid, pk)
+}
+
+// register registers pk, a key that has been checked, for userid's
+// device, once it has checked that the policy accepts it,
+func (s *Server) register(w http.ResponseWriter, r *http.Request, userid, deviceid string, pk *parsedKey) {
+	if kerr := s.policy.CheckKey(pk); kerr != nil {
+		glog.Infof("policy: key for %s: %s", userid, kerr.Message)
+		writeError(w, http.StatusForbidden, kerr)
 		return
 	}
-	// Check that the key's userid and userid are the same,
-	//   FIXME(OSS): This is a stub for some other authentication
-	//   mechanism.
-	// also validating that the key is valid.
-	if !validKeyForUser(userid, userid, key) {
-		glog.Warningf("was not a valid key for userid %s", userid)
-		w.WriteHeader(http.StatusUnauthorized)
+	// and, if we're asked to, that the sender holds its private
+	// key.
+	if s.config.RequirePoP {
+		if pk.entity == nil {
+			writeError(w, http.StatusUnauthorized, &Error{
+				Code:    CodePoPNotSupported,
+				Message: "proof of possession is only supported for pgp keys",
+			})
+			return
+		}
+		if err := s.checkPossession(r, userid, pk.entity); err != nil {
+			glog.Warningf("no proof of possession of the key for %s: %s", userid, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Registering a key for a new device must not take the user
+	// over the policy's limit. This only saves signing a key that
+	// will be refused; activate checks again, so that concurrent
+	// registrations can't both get in.
+	if !s.allowDevice(w, userid, deviceid) {
 		return
 	}
 
@@ -85,7 +102,8 @@ func post(w http.ResponseWriter, r *http.Request) {
 	prekey := &DKey{
 		UserID:    userid,
 		DeviceID:  deviceid,
-		Key:       encKey,
+		Key:       pk.Canonical,
+		Type:      pk.Type,
 		Timestamp: time.Now().UTC().Unix(),
 	}
 	data, err := json.Marshal(prekey)
@@ -95,28 +113,47 @@ func post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	glog.V(4).Infof("marshalled prekey: %s", data)
-	dkey, err := ka.Sign(data)
+	dkey, err := s.ka.Sign(data)
 	if err != nil {
 		glog.Errorf("error getting signature from kauth: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	status := ks.NewOrUpdate([]byte(userid), []byte(deviceid), dkey)
+	// If the user has to confirm their address first, the key
+	// waits, unlogged and unpublished, until they do.
+	if s.config.ConfirmEmail {
+		if status := s.pend(userid, deviceid, dkey); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	status, kerr := s.activate(userid, deviceid, dkey)
+	if kerr != nil {
+		writeError(w, status, kerr)
+		return
+	}
 	if status != http.StatusOK {
-		glog.Infof("post: status %s", status)
+		glog.Infof("register: status %d", status)
+		w.WriteHeader(status)
+		return
 	}
 	h := w.Header()
 	h.Set("Content-Type", "application/jws")
-	w.WriteHeader(status)
 	w.Write(dkey)
-	return
 }
 
 // GET /<userid>
 // Returns (checks are sequential):
-//   401 StatusUnauthorized: If the Bouncer auth is invalid or not present
+//   401 StatusUnauthorized: If the requester isn't authenticated
+//   403 StatusForbidden   : If the policy doesn't serve userid; the body is an Error
 //   404 StatusNotFound    : If no public keys are registered for the userid
+//   503 StatusServiceUnavailable: If the key directory couldn't be published since it last changed
 //   5xx                   : Random server issues that should never occur
-func get(w http.ResponseWriter, r *http.Request) {
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userid, ok := vars["userid"]
 	if !ok {
@@ -125,45 +162,170 @@ func get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// FIXME(OSS): Check that you're willing to accept registrations
-	// for this email address.
+	// Refuse to answer for addresses we don't serve, rather than
+	// sign a statement that they have no keys.
+	if !s.allowUser(w, userid) {
+		return
+	}
 
-	keys, status := ks.Get(userid)
+	keys, status, proof, root := s.lookup(userid)
 	switch status {
 	case http.StatusOK:
 		break
 	case http.StatusNotFound:
-		// We sign a statement that there are no registered keys.
+		// We sign a statement that there are no registered keys;
+		// the proof shows that the directory agrees.
 		// FIXME(OSS): This should be cached up to some max-freshness period.
 		keys = make(map[string]string)
-		w.WriteHeader(http.StatusNotFound)
 	default:
 		w.WriteHeader(status)
 		return
 	}
 
+	types := make(map[string]string, len(keys))
+	for deviceid, jws := range keys {
+		dkey, err := dkeyOf(jws)
+		if err != nil {
+			glog.Errorf("bad DKey for %s/%s in the store: %s", userid, deviceid, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		types[deviceid] = dkey.Type
+		if dkey.Type == "" {
+			types[deviceid] = KeyTypePGP
+		}
+	}
+
 	ukeys := &UKeys{
 		Timestamp: time.Now().UTC().Unix(),
 		UserID:    userid,
 		Keys:      keys,
+		Types:     types,
+		Proof:     proof,
+		Root:      string(root),
+	}
+	s.signAndWrite(w, status, ukeys)
+}
+
+// DELETE /<userid>/<deviceid>
+// Returns:
+//   401 StatusUnauthorized: If the requester isn't authenticated
+//   403 StatusForbidden   : If the requester isn't userid
+//   200 StatusOK      : The key was revoked; the body is a signed Revocation
+//   404 StatusNotFound: If there is no key registered for the device
+//   5xx               : Random server issues that should never occur
+func (s *Server) del(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userid, deviceid := vars["userid"], vars["deviceid"]
+	glog.Infof("DELETE /v1/k/%s/%s", userid, deviceid)
+	if !requireSelf(w, r, userid) {
+		return
 	}
-	data, err := json.Marshal(ukeys)
-	glog.Infof("data: %s", data)
+
+	// Sign the revocation first, so that we never revoke a key
+	// without being able to say so, and so that the device's history
+	// records the same Revocation the client gets.
+	rev := &Revocation{
+		UserID:    userid,
+		DeviceID:  deviceid,
+		Revoked:   true,
+		Timestamp: time.Now().UTC().Unix(),
+	}
+	data, err := json.Marshal(rev)
 	if err != nil {
-		glog.Errorf("error marshalling keys: %s", err)
+		glog.Errorf("error marshalling revocation: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	signed, err := ka.Sign(data)
+	signed, err := s.ka.Sign(data)
 	if err != nil {
-		glog.Errorf("error marshaling signed keybundle: %s", err)
+		glog.Errorf("error getting signature from kauth: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	status := s.update(userid, func() int {
+		return s.store.Revoke(userid, deviceid, signed)
+	})
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
 	h := w.Header()
 	h.Set("Content-Type", "application/jws")
-	glog.Infof("signed: %s", signed)
+	w.Write(signed)
+}
+
+// GET /<userid>/<deviceid>/history
+// Returns:
+//   200 StatusOK      : The body is a signed KeyHistory, oldest key first,
+//                       with the signed Revocation wherever a key was revoked
+//   403 StatusForbidden: If the policy doesn't serve userid; the body is an Error
+//   404 StatusNotFound: If no key was ever registered for the device
+//   5xx               : Random server issues that should never occur
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userid, deviceid := vars["userid"], vars["deviceid"]
+	glog.Infof("GET /v1/k/%s/%s/history", userid, deviceid)
+	if !s.allowUser(w, userid) {
+		return
+	}
+
+	entries, status := s.store.History(userid, deviceid)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	s.signAndWrite(w, http.StatusOK, &KeyHistory{
+		Timestamp: time.Now().UTC().Unix(),
+		UserID:    userid,
+		DeviceID:  deviceid,
+		Entries:   entries,
+	})
+}
+
+// writeJSON marshals v as the body of a 200 response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		glog.Errorf("error marshalling %T: %s", v, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// writeError writes e as the JSON body of a response with the given
+// status.
+func writeError(w http.ResponseWriter, status int, e *Error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("error marshalling %T: %s", e, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// signAndWrite marshals v, has the kauth sign it, and writes the JWS
+// as the body of a response with the given status.
+func (s *Server) signAndWrite(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		glog.Errorf("error marshalling %T: %s", v, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	signed, err := s.ka.Sign(data)
+	if err != nil {
+		glog.Errorf("error getting signature from kauth: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jws")
+	w.WriteHeader(status)
 	w.Write(signed)
 }
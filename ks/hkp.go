@@ -0,0 +1,273 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/yahoo/keyshop/yenc"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// HKP, the HTTP Keyserver Protocol (draft-shaw-openpgp-hkp), is what
+// gpg --keyserver and most other OpenPGP tools speak. Lookups by
+// address, like the WKD's, are public; lookups by fingerprint or key
+// ID tell whose a key is, so, like GET /v1/fp, they need
+// authentication. Adding a key needs the same authentication, and
+// passes the same checks, as POSTing it to /v1/k. Keys added over HKP
+// are registered for the device hkpDevice.
+const hkpDevice = "hkp"
+
+// hkpRoutes answers HKP requests, if the config asks for it.
+func (s *Server) hkpRoutes() {
+	if !s.config.HKP {
+		return
+	}
+	p := s.router.PathPrefix("/pks").Subrouter()
+	p.HandleFunc("/lookup", s.hkpLookup).Methods("GET")
+	p.HandleFunc("/add", s.requireAuth(s.hkpAdd, true)).Methods("POST")
+}
+
+// An hkpKey is one registered OpenPGP key.
+type hkpKey struct {
+	userid, deviceid string
+	key              []byte
+}
+
+// hkpByKeyID reports whether search is for a fingerprint or key ID,
+// rather than an address.
+func hkpByKeyID(search string) bool {
+	return strings.HasPrefix(search, "0x") || strings.HasPrefix(search, "0X")
+}
+
+// hkpSearch returns the OpenPGP keys that match search: either a
+// fingerprint or 16-digit key ID, starting with 0x, or an email
+// address. An owner whose keys can't be read is skipped; its status
+// is returned only if nothing else is found.
+func (s *Server) hkpSearch(search string) (found []hkpKey, status int) {
+	var owners []Owner
+	if hkpByKeyID(search) {
+		id, ok := normalizeKeyID(search)
+		if !ok {
+			return nil, http.StatusBadRequest
+		}
+		if owners, status = s.store.Owners(id); status != http.StatusOK {
+			return nil, status
+		}
+	} else {
+		// Either "alice@example.com", or "Alice <alice@example.com>".
+		userid := strings.TrimSpace(search)
+		if i := strings.LastIndex(userid, "<"); i >= 0 {
+			userid = strings.TrimSuffix(userid[i+1:], ">")
+		}
+		if s.policy.CheckUser(userid) != nil {
+			return nil, http.StatusNotFound
+		}
+		owners = []Owner{{UserID: userid}}
+	}
+
+	seen := make(map[string]bool)
+	status = http.StatusNotFound
+	for _, o := range owners {
+		keys, st := s.store.Get(o.UserID)
+		if st != http.StatusOK {
+			if st != http.StatusNotFound {
+				glog.Errorf("HKP: error getting keys for %s: %d", o.UserID, st)
+				status = st
+			}
+			continue
+		}
+		for deviceid, jws := range keys {
+			if o.DeviceID != "" && deviceid != o.DeviceID {
+				continue
+			}
+			dkey, err := dkeyOf(jws)
+			if err != nil {
+				glog.Errorf("bad DKey for %s/%s in the store: %s", o.UserID, deviceid, err)
+				return nil, http.StatusInternalServerError
+			}
+			if dkey.Type != "" && dkey.Type != KeyTypePGP || seen[dkey.Key] {
+				continue
+			}
+			seen[dkey.Key] = true
+			key, err := yenc.RawURL64.DecodeString(dkey.Key)
+			if err != nil {
+				glog.Errorf("bad key for %s/%s in the store: %s", o.UserID, deviceid, err)
+				return nil, http.StatusInternalServerError
+			}
+			found = append(found, hkpKey{userid: o.UserID, deviceid: deviceid, key: key})
+		}
+	}
+	if len(found) == 0 {
+		return nil, status
+	}
+	return found, http.StatusOK
+}
+
+// GET /pks/lookup?op=<get|index|vindex>&search=<email or 0xfingerprint>
+// Returns:
+//   200 StatusOK            : The body is the armored keys (get), or a machine-readable index
+//   400 StatusBadRequest    : If search is missing or malformed
+//   401 StatusUnauthorized  : If search is a fingerprint or key ID, and the requester isn't authenticated
+//   404 StatusNotFound      : If no key matches
+//   501 StatusNotImplemented: For any other op
+//   5xx                     : Random server issues that should never occur
+func (s *Server) hkpLookup(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	op, search := q.Get("op"), q.Get("search")
+	glog.Infof("HKP %s %s", op, search)
+	if op != "get" && op != "index" && op != "vindex" {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if search == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if hkpByKeyID(search) && !s.config.SkipAuth {
+		if _, err := s.authenticate(r, false); err != nil {
+			glog.Warningf("%s %s: authentication failed: %s", r.Method, r.URL.Path, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	found, status := s.hkpSearch(search)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	var buf bytes.Buffer
+	if op == "get" {
+		aw, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		if err != nil {
+			glog.Errorf("error armoring keys: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, k := range found {
+			aw.Write(k.key)
+		}
+		aw.Close()
+		buf.WriteByte('\n')
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		w.Write(buf.Bytes())
+		return
+	}
+	// Whatever the options, the index is machine-readable.
+	fmt.Fprintf(&buf, "info:1:%d\n", len(found))
+	for _, k := range found {
+		if err := writeHKPIndex(&buf, k.key); err != nil {
+			glog.Errorf("bad key for %s/%s in the store: %s", k.userid, k.deviceid, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeHKPIndex writes the pub: and uid: lines of a machine-readable
+// index for key.
+func writeHKPIndex(w io.Writer, key []byte) error {
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(key))
+	if err != nil {
+		return err
+	}
+	for _, e := range el {
+		pk := e.PrimaryKey
+		bits, _ := pk.BitLength()
+		expires := ""
+		for _, id := range e.Identities {
+			if sig := id.SelfSignature; sig.KeyLifetimeSecs != nil && *sig.KeyLifetimeSecs > 0 {
+				expires = fmt.Sprint(pk.CreationTime.Unix() + int64(*sig.KeyLifetimeSecs))
+			}
+		}
+		fmt.Fprintf(w, "pub:%X:%d:%d:%d:%s:\n", pk.Fingerprint, pk.PubKeyAlgo, bits, pk.CreationTime.Unix(), expires)
+		for name, id := range e.Identities {
+			fmt.Fprintf(w, "uid:%s:%d::\n", hkpEscape(name), id.SelfSignature.CreationTime.Unix())
+		}
+	}
+	return nil
+}
+
+// hkpEscape escapes a user ID for an index line.
+func hkpEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ':' || c == '%' || c < 0x20 || c > 0x7e {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// POST /pks/add
+// The body is a form, whose keytext is a single armored key, with a
+// single user ID for the requester's address.
+// Returns:
+//   200 StatusOK          : The key is registered; the body is the signed DKey
+//   202 StatusAccepted    : If the user has to confirm their address first
+//   400 StatusBadRequest  : If keytext is missing, or not an armored key
+//   401 StatusUnauthorized: If the requester isn't authenticated, or the key isn't valid
+//   403 StatusForbidden   : If the requester isn't the key's user, or the policy refuses it
+//   5xx                   : Random server issues that should never occur
+func (s *Server) hkpAdd(w http.ResponseWriter, r *http.Request) {
+	// keytext is armored, and then form-encoded, which can triple
+	// its size.
+	r.Body = http.MaxBytesReader(w, r.Body, 3*maxBodyLen)
+	if err := r.ParseForm(); err != nil {
+		glog.Warningf("HKP add: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key, err := decodePGP(armoredKeyType, []byte(r.PostForm.Get("keytext")))
+	if err != nil {
+		glog.Warningf("HKP add: %s", err)
+		writeError(w, http.StatusBadRequest, &Error{Code: CodeMalformedKey, Message: err.Error()})
+		return
+	}
+	userid, ok := keyEmail(key)
+	if !ok {
+		writeError(w, http.StatusBadRequest, invalidKey("expected one key, with one user ID"))
+		return
+	}
+	glog.Infof("HKP add for %s", userid)
+	if s.config.SkipAuth {
+		// Everyone is whoever their key says they are.
+		r = withPrincipal(r, &Principal{UserID: userid, Method: "none"})
+	}
+	if !requireSelf(w, r, userid) || !s.allowUser(w, userid) {
+		return
+	}
+	pk, kerr := checkPGP(userid, principal(r).UserID, key)
+	if kerr != nil {
+		glog.Warningf("was not a valid key for userid %s: %s", userid, kerr.Message)
+		writeError(w, http.StatusUnauthorized, kerr)
+		return
+	}
+	pk.Type = KeyTypePGP
+	s.register(w, r, userid, hkpDevice, pk)
+}
+
+// keyEmail returns the email address in the single user ID of the
+// single OpenPGP key in key.
+func keyEmail(key []byte) (string, bool) {
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(key))
+	if err != nil || len(el) != 1 || len(el[0].Identities) != 1 {
+		return "", false
+	}
+	for _, id := range el[0].Identities {
+		return id.UserId.Email, id.UserId.Email != ""
+	}
+	return "", false
+}
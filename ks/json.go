@@ -8,12 +8,127 @@ type DKey struct {
 	DeviceID  string `json:"deviceid"`
 	Key       string `json:"key"`
 	Timestamp int64  `json:"t"`
-	UserID    string `json:"userid"`
+	// Type is the key's type, e.g. KeyTypePGP; DKeys signed before
+	// there were other types have none, and are OpenPGP keys.
+	Type   string `json:"type,omitempty"`
+	UserID string `json:"userid"`
 }
 
 // UKeys represents a keyset for a single user.
+//
+// Proof shows that Keys are the user's keys (or, if there are none,
+// that the user has no keys) in the key directory, as of the signed
+// MapRoot in Root.
 type UKeys struct {
 	Timestamp int64             `json:"t"`
 	UserID    string            `json:"userid"`
 	Keys      map[string]string `json:"keys"`
+	// Types maps each device in Keys to its key's type.
+	Types map[string]string `json:"types,omitempty"`
+	Proof *MapProof         `json:"proof,omitempty"`
+	Root  string            `json:"root,omitempty"`
+}
+
+// A Revocation records that the key for a single device has been
+// revoked.
+type Revocation struct {
+	DeviceID  string `json:"deviceid"`
+	Revoked   bool   `json:"revoked"`
+	Timestamp int64  `json:"t"`
+	UserID    string `json:"userid"`
+}
+
+// A HistoryEntry is either a signed DKey that was accepted for a
+// device or the signed Revocation of the device's key, along with the
+// time it was recorded.
+type HistoryEntry struct {
+	Timestamp  int64  `json:"t"`
+	DKey       string `json:"dkey,omitempty"`
+	Revocation string `json:"revocation,omitempty"`
+}
+
+// KeyHistory represents every key a single device has had, oldest
+// first.
+type KeyHistory struct {
+	DeviceID  string         `json:"deviceid"`
+	Entries   []HistoryEntry `json:"history"`
+	Timestamp int64          `json:"t"`
+	UserID    string         `json:"userid"`
+}
+
+// A TreeHead is a signed statement of the size and root hash of the
+// key log at a point in time.
+type TreeHead struct {
+	RootHash  string `json:"root"`
+	Timestamp int64  `json:"t"`
+	TreeSize  int64  `json:"size"`
+}
+
+// An InclusionProof is the audit path showing that an entry is in
+// the key log.
+type InclusionProof struct {
+	AuditPath []string `json:"path"`
+	LeafIndex int64    `json:"index"`
+	TreeSize  int64    `json:"size"`
+}
+
+// A ConsistencyProof shows that the key log of size First is a
+// prefix of the key log of size Second.
+type ConsistencyProof struct {
+	First  int64    `json:"first"`
+	Proof  []string `json:"proof"`
+	Second int64    `json:"second"`
+}
+
+// A MapRoot is a signed statement of the root hash of the key
+// directory for an epoch.
+type MapRoot struct {
+	Epoch     uint64 `json:"epoch"`
+	RootHash  string `json:"root"`
+	Timestamp int64  `json:"t"`
+}
+
+// A MapProof shows that a user's keys are in the key directory, or
+// that the user has none; see smt.Proof, and VerifyMapProof.
+type MapProof struct {
+	Index    string   `json:"index,omitempty"`
+	Siblings []string `json:"siblings"`
+	Value    string   `json:"value,omitempty"`
+}
+
+// A Pending registration is a signed DKey that will only be stored
+// once its user confirms that they control their mailbox.
+type Pending struct {
+	DeviceID string `json:"deviceid"`
+	DKey     string `json:"dkey"`
+	Expires  int64  `json:"expires"`
+	UserID   string `json:"userid"`
+}
+
+// A Challenge is a nonce for proving possession of a key that is
+// about to be registered.
+type Challenge struct {
+	Expires int64  `json:"expires"`
+	Nonce   string `json:"nonce"`
+}
+
+// An Error explains why a request was refused. Code is meant for
+// programs, and Message for people.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+// An Owner is a device that a key is registered for.
+type Owner struct {
+	DeviceID string `json:"deviceid"`
+	UserID   string `json:"userid"`
+}
+
+// KeyOwners lists the devices whose current key has an OpenPGP
+// fingerprint or key ID; if there are none, Owners is empty.
+type KeyOwners struct {
+	KeyID     string  `json:"keyid"`
+	Owners    []Owner `json:"owners"`
+	Timestamp int64   `json:"t"`
 }
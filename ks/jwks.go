@@ -0,0 +1,37 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// A Keyholder is an Authority that publishes its public keys, active
+// and retired, as a JWK Set, so that clients can check signatures by
+// their kid headers. *kauth.Kauth is one.
+type Keyholder interface {
+	JWKS() ([]byte, error)
+}
+
+// GET /.well-known/jwks.json
+// Returns:
+//   200 StatusOK      : The body is the kauth's keys, as a JWK Set
+//   404 StatusNotFound: If the kauth doesn't publish its keys
+//   5xx               : Random server issues that should never occur
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	ka, ok := s.ka.(Keyholder)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b, err := ka.JWKS()
+	if err != nil {
+		glog.Errorf("error getting keys from kauth: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Write(b)
+}
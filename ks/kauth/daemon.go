@@ -0,0 +1,124 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package kauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"io"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Once a request has been read, a Daemon has timeout, as a Remote
+// does, to answer it; between requests, a connection may be idle for
+// idleTimeout. At most maxConns connections are served at once: the
+// keyshop only needs one, and the rest wait to be accepted.
+const (
+	idleTimeout = 5 * time.Minute
+	maxConns    = 16
+)
+
+// A Daemon is the side of the kauthd protocol that holds the key: it
+// signs for clients that share its secret, as a Remote does.
+type Daemon struct {
+	ka     *Kauth
+	secret []byte
+	check  func(msg []byte) (string, error)
+
+	// idle and maxConns are idleTimeout and maxConns, but for tests.
+	idle     time.Duration
+	maxConns int
+}
+
+// NewDaemon returns a Daemon that signs with ka for clients that know
+// secret. Every message is passed to check before it is signed; check
+// returns what kind of statement the message is, or why it won't be
+// signed.
+func NewDaemon(ka *Kauth, secret []byte, check func(msg []byte) (string, error)) *Daemon {
+	return &Daemon{ka: ka, secret: secret, check: check, idle: idleTimeout, maxConns: maxConns}
+}
+
+// Serve accepts connections on l, and answers them, until l is closed.
+func (d *Daemon) Serve(l net.Listener) error {
+	open := make(chan struct{}, d.maxConns)
+	for {
+		select {
+		case open <- struct{}{}:
+		default:
+			glog.Warningf("kauthd: %d connections open; waiting for one to close", d.maxConns)
+			open <- struct{}{}
+		}
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer func() { <-open }()
+			d.serveConn(c)
+		}()
+	}
+}
+
+func (d *Daemon) serveConn(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		glog.Errorf("kauthd: error making nonce: %s", err)
+		return
+	}
+	if err := writeFrame(c, &hello{Nonce: nonce}); err != nil {
+		glog.Errorf("kauthd: error writing hello: %s", err)
+		return
+	}
+	for seq := uint64(1); ; seq++ {
+		var req request
+		c.SetDeadline(time.Now().Add(d.idle))
+		if err := readFrame(c, &req); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				glog.Infof("kauthd: hanging up an idle connection")
+			} else if err != io.EOF {
+				glog.Errorf("kauthd: error reading request: %s", err)
+			}
+			return
+		}
+		c.SetDeadline(time.Now().Add(timeout))
+		if req.Seq != seq || !hmac.Equal(req.MAC, req.mac(d.secret, nonce)) {
+			glog.Warningf("kauthd: request %d has a bad MAC; hanging up", seq)
+			return
+		}
+		resp := &response{Seq: seq}
+		var err error
+		switch req.Op {
+		case OpSign:
+			resp.Result, err = d.sign(seq, req.Msg)
+		case OpKeys:
+			resp.Result, err = d.ka.JWKS()
+		default:
+			glog.Warningf("kauthd: request %d: unknown op %q", seq, req.Op)
+			resp.Error = "unknown op"
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.MAC = resp.mac(d.secret, nonce)
+		if err := writeFrame(c, resp); err != nil {
+			glog.Errorf("kauthd: error writing response: %s", err)
+			return
+		}
+	}
+}
+
+// sign logs, checks and signs msg.
+func (d *Daemon) sign(seq uint64, msg []byte) ([]byte, error) {
+	kind, err := d.check(msg)
+	if err != nil {
+		glog.Warningf("kauthd: request %d: refused to sign %q: %s", seq, msg, err)
+		return nil, err
+	}
+	glog.Infof("kauthd: request %d: signing %s %s", seq, kind, msg)
+	return d.ka.Sign(msg)
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package kauth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDaemon starts a Daemon with a new key, which only signs messages
+// that start with "ok", and returns its socket and its keyring.
+func testDaemon(t *testing.T, secret []byte) (string, *Keyring) {
+	return testDaemonWith(t, secret, func(*Daemon) {})
+}
+
+// testDaemonWith is testDaemon, but calls configure before serving.
+func testDaemonWith(t *testing.T, secret []byte, configure func(*Daemon)) (string, *Keyring) {
+	kr := &Keyring{Keys: []*Key{newKey(t, time.Now())}}
+	ka, err := New(marshal(t, kr, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(ka, secret, func(msg []byte) (string, error) {
+		if !bytes.HasPrefix(msg, []byte("ok")) {
+			return "", errors.New("not ok")
+		}
+		return "ok", nil
+	})
+	configure(d)
+	sock := filepath.Join(t.TempDir(), "kauthd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go d.Serve(l)
+	return sock, kr
+}
+
+func TestRemote(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	sock, kr := testDaemon(t, secret)
+	r, err := Dial(sock, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Public() == nil {
+		t.Fatal("no public key")
+	}
+
+	v, err := NewVerifier(marshal(t, kr, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"ok 1", "ok 2"} {
+		jws, err := r.Sign([]byte(msg))
+		if err != nil {
+			t.Fatalf("signing %q: %s", msg, err)
+		}
+		if payload, err := v.Verify(jws); err != nil || string(payload) != msg {
+			t.Fatalf("verifying %q: got %q, %v", msg, payload, err)
+		}
+	}
+	if _, err := r.Sign([]byte("arbitrary blob")); err == nil || !strings.Contains(err.Error(), "not ok") {
+		t.Fatalf("signing what the check refuses: got %v", err)
+	}
+	// A refusal doesn't cost the connection.
+	if _, err := r.Sign([]byte("ok 3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a hang-up, the Remote redials.
+	r.mu.Lock()
+	r.conn.Close()
+	r.mu.Unlock()
+	if _, err := r.Sign([]byte("ok 4")); err != nil {
+		t.Fatalf("after a hang-up: %s", err)
+	}
+}
+
+func TestRemoteWrongSecret(t *testing.T) {
+	sock, _ := testDaemon(t, []byte("0123456789abcdef"))
+	if _, err := Dial(sock, []byte("fedcba9876543210")); err == nil {
+		t.Fatal("dialed kauthd with the wrong secret")
+	}
+}
+
+// readHello reads the daemon's hello from c, waiting for at most wait.
+func readHello(t *testing.T, c net.Conn, wait time.Duration) error {
+	c.SetDeadline(time.Now().Add(wait))
+	var h hello
+	return readFrame(c, &h)
+}
+
+func TestDaemonHangsUpIdleConnections(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	sock, _ := testDaemonWith(t, secret, func(d *Daemon) { d.idle = 50 * time.Millisecond })
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := readHello(t, c, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("reading from an idle connection: got %v, want EOF", err)
+	}
+
+	// A Remote redials.
+	r, err := Dial(sock, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := r.Sign([]byte("ok")); err != nil {
+		t.Fatalf("signing after being idle: %s", err)
+	}
+}
+
+func TestDaemonLimitsConnections(t *testing.T) {
+	sock, _ := testDaemonWith(t, []byte("0123456789abcdef"), func(d *Daemon) { d.maxConns = 1 })
+	first, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readHello(t, first, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	second, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := readHello(t, second, 100*time.Millisecond); err == nil {
+		t.Fatal("served a second connection while the first was open")
+	}
+	first.Close()
+	if err := readHello(t, second, time.Second); err != nil {
+		t.Fatalf("once the first connection closed: %s", err)
+	}
+}
@@ -4,42 +4,126 @@
 package kauth
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+
 	"github.com/golang/glog"
 	"github.com/square/go-jose"
 )
 
-// A stub for a proper privileged-separated key authority.
+// A key authority that signs in-process, with a Signer: its private
+// key in memory, or in a PKCS#11 token. For privilege separation, run
+// it in kauthd, and have the keyshop use a Remote.
 type Kauth struct {
-	signer jose.Signer
+	signer Signer
+	pub    *ecdsa.PublicKey
+	kid    string
+	keys   *Keyring
+}
+
+// Public returns the key authority's public key.
+func (a *Kauth) Public() crypto.PublicKey {
+	return a.pub
+}
+
+// JWKS returns the key authority's public keys, active and retired, as
+// a JWK Set.
+func (a *Kauth) JWKS() ([]byte, error) {
+	return a.keys.JWKS()
 }
 
 // Sign submits a message to the key authority for signing.
-// (In this case, it just signs it...)
+// (In this case, it just signs it...) The JWS's kid header names the
+// key that signed it.
 func (a *Kauth) Sign(msg []byte) (b []byte, err error) {
 	glog.Infof("msg: %s", msg)
-	obj, err := a.signer.Sign(msg)
+	b, err = signJWS(a.signer, a.pub, a.kid, msg)
 	if err != nil {
 		glog.Errorf("error signing message: %s", err)
-		return
 	}
-	s, err := obj.CompactSerialize()
-	if err != nil {
-		glog.Errorf("error serializing object: %s", err)
+	return
+}
+
+// Close releases the key authority's signer, if it holds anything,
+// such as a session with a token.
+func (a *Kauth) Close() error {
+	if c, ok := a.signer.(io.Closer); ok {
+		return c.Close()
 	}
-	return []byte(s), nil
+	return nil
 }
 
 // New initializes a new key authority from a PEM file
-// containing the authority's private key.
+// containing the authority's keyring: its active private key,
+// and any retired public keys.
 func New(kauthPem []byte) (ka *Kauth, err error) {
-	priv, err := jose.LoadPrivateKey(kauthPem)
+	keys, err := ParseKeyring(kauthPem)
 	if err != nil {
 		return
 	}
-	signer, err := jose.NewSigner(jose.ES256, priv)
+	active := keys.Active()
+	if active == nil {
+		err = errors.New("kauth: no private key")
+		return
+	}
+	return NewWithSigner(active.priv, keys)
+}
+
+// NewWithSigner initializes a new key authority that signs with s,
+// whose public key has to be the newest in keys.
+func NewWithSigner(s Signer, keys *Keyring) (*Kauth, error) {
+	pub, ok := s.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("kauth: not an ECDSA signer")
+	}
+	active := keys.Keys[0]
+	if pub.Curve != active.Public.Curve || pub.X.Cmp(active.Public.X) != 0 || pub.Y.Cmp(active.Public.Y) != 0 {
+		return nil, fmt.Errorf("kauth: the signer's key is not the keyring's newest, %s", active.ID)
+	}
+	return &Kauth{signer: s, pub: active.Public, kid: active.ID, keys: keys}, nil
+}
+
+// A Verifier checks statements signed by a key authority.
+type Verifier struct {
+	keys *Keyring
+}
+
+// NewVerifier returns a Verifier for the key authority whose public
+// keys are in kauthPubPem (as written to kauth.pem.pub by genkauth).
+func NewVerifier(kauthPubPem []byte) (v *Verifier, err error) {
+	keys, err := ParseKeyring(kauthPubPem)
 	if err != nil {
 		return
 	}
-	ka = &Kauth{signer: signer}
+	v = &Verifier{keys: keys}
 	return
 }
+
+// Verify checks the signature on a compact-serialized JWS, and
+// returns its payload. A JWS with a kid header has to be signed by
+// that key; one without, as signed before keys had kids, by any.
+func (v *Verifier) Verify(jws []byte) ([]byte, error) {
+	obj, err := jose.ParseSigned(string(jws))
+	if err != nil {
+		return nil, err
+	}
+	if len(obj.Signatures) != 1 {
+		return nil, errors.New("kauth: expected one signature")
+	}
+	if kid := obj.Signatures[0].Header.KeyID; kid != "" {
+		k := v.keys.Key(kid)
+		if k == nil {
+			return nil, fmt.Errorf("kauth: unknown kid %q", kid)
+		}
+		return obj.Verify(k.Public)
+	}
+	for _, k := range v.keys.Keys {
+		if payload, err := obj.Verify(k.Public); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("kauth: no key verifies the signature")
+}
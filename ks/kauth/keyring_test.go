@@ -0,0 +1,174 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package kauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func newKey(t *testing.T, now time.Time) *Key {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKey(priv, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func marshal(t *testing.T, kr *Keyring, private bool) []byte {
+	b, err := kr.Marshal(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func sign(t *testing.T, kauthPem []byte, msg string) []byte {
+	ka, err := New(kauthPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := ka.Sign([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jws
+}
+
+func TestRotate(t *testing.T) {
+	t0 := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.AddDate(0, 3, 0)
+	first := newKey(t, t0)
+	kr := &Keyring{Keys: []*Key{first}}
+	before := sign(t, marshal(t, kr, true), "before")
+
+	second := newKey(t, t1)
+	if err := kr.Rotate(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Rotate(second); err == nil {
+		t.Fatal("rotated to the active key again")
+	}
+	private := marshal(t, kr, true)
+	after := sign(t, private, "after")
+
+	// Only the active key's private key is kept.
+	kr, err := ParseKeyring(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kr.Keys) != 2 || kr.Active() != kr.Keys[0] || kr.Keys[0].ID != second.ID || kr.Keys[1].priv != nil {
+		t.Fatalf("got %+v", kr.Keys)
+	}
+	if old := kr.Keys[1]; old.ID != first.ID || !old.NotBefore.Equal(t0) || !old.NotAfter.Equal(t1) {
+		t.Fatalf("retired key: got %+v", old)
+	}
+
+	v, err := NewVerifier(marshal(t, kr, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for msg, jws := range map[string][]byte{"before": before, "after": after} {
+		payload, err := v.Verify(jws)
+		if err != nil || string(payload) != msg {
+			t.Errorf("verifying %q: got %q, %v", msg, payload, err)
+		}
+	}
+
+	// A verifier that only knows the new key refuses the old kid.
+	kr.Keys = kr.Keys[:1]
+	v, err = NewVerifier(marshal(t, kr, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(before); err == nil {
+		t.Error("verified a signature by an unknown kid")
+	}
+}
+
+func TestLegacyPEM(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := ParseKeyring(pem.EncodeToMemory(&pem.Block{Type: privateKeyType, Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := Thumbprint(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := kr.Active(); k == nil || k.ID != id || !k.NotBefore.IsZero() {
+		t.Fatalf("got %+v", kr.Keys)
+	}
+
+	var set struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	b, err := kr.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0]["kid"] != id || set.Keys[0]["crv"] != "P-256" || set.Keys[0]["nbf"] != nil {
+		t.Fatalf("got %s", b)
+	}
+}
+
+// opaqueSigner hides that it is an *ecdsa.PrivateKey, as a key in a
+// token would.
+type opaqueSigner struct {
+	Signer
+}
+
+func TestNewWithSigner(t *testing.T) {
+	for _, c := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		priv, err := ecdsa.GenerateKey(c, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := NewPublicKey(&priv.PublicKey, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		kr := &Keyring{Keys: []*Key{key}}
+		ka, err := NewWithSigner(opaqueSigner{priv}, kr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := ka.Sign([]byte("msg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := NewVerifier(marshal(t, kr, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload, err := v.Verify(jws); err != nil || string(payload) != "msg" {
+			t.Errorf("%s: got %q, %v", c.Params().Name, payload, err)
+		}
+	}
+
+	// The signer has to hold the keyring's newest key.
+	kr := &Keyring{Keys: []*Key{newKey(t, time.Now())}}
+	if _, err := NewWithSigner(newKey(t, time.Now()).priv, kr); err == nil {
+		t.Fatal("signed for a keyring with another key")
+	}
+}
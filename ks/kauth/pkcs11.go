@@ -0,0 +1,285 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+
+//go:build pkcs11
+// +build pkcs11
+
+package kauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11Supported is true if the package was built with the pkcs11
+// tag, and so can keep the active key in a token.
+const PKCS11Supported = true
+
+var curveOIDs = map[elliptic.Curve]asn1.ObjectIdentifier{
+	elliptic.P256(): {1, 2, 840, 10045, 3, 1, 7},
+	elliptic.P384(): {1, 3, 132, 0, 34},
+	elliptic.P521(): {1, 3, 132, 0, 35},
+}
+
+// modules counts the open PKCS11Signers using each PKCS#11 module. A
+// module is initialized once per process, however often it's loaded,
+// so it's only finalized once the last of them is closed.
+var modules = struct {
+	sync.Mutex
+	open map[string]int
+}{open: make(map[string]int)}
+
+// A PKCS11Signer is a Signer whose private key is in a PKCS#11 token,
+// which signs with it, and never lets it out.
+type PKCS11Signer struct {
+	module   string
+	ctx      *pkcs11.Ctx
+	session  pkcs11.SessionHandle
+	loggedIn bool
+	key      pkcs11.ObjectHandle
+	pub      *ecdsa.PublicKey
+
+	// A session can only do one thing at a time.
+	mu sync.Mutex
+}
+
+// openSession loads the module in c, and logs in to its token.
+func openSession(c *PKCS11Config) (*PKCS11Signer, error) {
+	ctx := pkcs11.New(c.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("kauth: can't load PKCS#11 module %s", c.Module)
+	}
+	modules.Lock()
+	// Another signer may have initialized the module already.
+	if err := ctx.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		modules.Unlock()
+		ctx.Destroy()
+		return nil, fmt.Errorf("kauth: %s", err)
+	}
+	modules.open[c.Module]++
+	modules.Unlock()
+	s := &PKCS11Signer{module: c.Module, ctx: ctx}
+	if err := s.login(c); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PKCS11Signer) login(c *PKCS11Config) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("kauth: %s", err)
+	}
+	for _, slot := range slots {
+		info, err := s.ctx.GetTokenInfo(slot)
+		if err != nil || strings.TrimSpace(info.Label) != c.Token {
+			continue
+		}
+		if s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION); err != nil {
+			return fmt.Errorf("kauth: %s", err)
+		}
+		// Logging in is for the whole process, so another signer
+		// may have done it already.
+		if err := s.ctx.Login(s.session, pkcs11.CKU_USER, c.PIN); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			s.ctx.CloseSession(s.session)
+			return fmt.Errorf("kauth: logging in to token %q: %s", c.Token, err)
+		}
+		s.loggedIn = true
+		return nil
+	}
+	return fmt.Errorf("kauth: no PKCS#11 token labelled %q", c.Token)
+}
+
+// OpenPKCS11 returns a Signer for the key labelled kid in the token
+// described by c.
+func OpenPKCS11(c *PKCS11Config, kid string) (Signer, error) {
+	s, err := openSession(c)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := s.find(pkcs11.CKO_PRIVATE_KEY, kid)
+	if err == nil {
+		var pubObj pkcs11.ObjectHandle
+		if pubObj, err = s.find(pkcs11.CKO_PUBLIC_KEY, kid); err == nil {
+			s.key = priv
+			s.pub, err = s.publicKey(pubObj)
+		}
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// GeneratePKCS11 makes a new key pair on curve in the token described
+// by c, whose private key can't be exported, and returns a Signer for
+// it. The keys are labelled with the kid of the public key.
+func GeneratePKCS11(c *PKCS11Config, curve elliptic.Curve) (Signer, error) {
+	oid, ok := curveOIDs[curve]
+	if !ok {
+		return nil, fmt.Errorf("kauth: unsupported curve %s", curve.Params().Name)
+	}
+	params, err := asn1.Marshal(oid)
+	if err != nil {
+		return nil, err
+	}
+	s, err := openSession(c)
+	if err != nil {
+		return nil, err
+	}
+	pubObj, priv, err := s.ctx.GenerateKeyPair(s.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		})
+	if err == nil {
+		s.key = priv
+		if s.pub, err = s.publicKey(pubObj); err == nil {
+			err = s.label(pubObj, priv)
+		}
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("kauth: generating a key: %s", err)
+	}
+	return s, nil
+}
+
+// label labels a new key pair, and gives it an ID, with its kid.
+func (s *PKCS11Signer) label(objs ...pkcs11.ObjectHandle) error {
+	kid, err := Thumbprint(s.pub)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		if err := s.ctx.SetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, kid),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(kid)),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the one object of class labelled label.
+func (s *PKCS11Signer) find(class uint, label string) (pkcs11.ObjectHandle, error) {
+	if err := s.ctx.FindObjectsInit(s.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}); err != nil {
+		return 0, fmt.Errorf("kauth: %s", err)
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 2)
+	s.ctx.FindObjectsFinal(s.session)
+	if err != nil {
+		return 0, fmt.Errorf("kauth: %s", err)
+	}
+	if len(objs) != 1 {
+		return 0, fmt.Errorf("kauth: %d keys in the token are labelled %q", len(objs), label)
+	}
+	return objs[0], nil
+}
+
+// publicKey reads an EC public key object.
+func (s *PKCS11Signer) publicKey(obj pkcs11.ObjectHandle) (*ecdsa.PublicKey, error) {
+	attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kauth: %s", err)
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+		return nil, fmt.Errorf("kauth: bad EC params: %s", err)
+	}
+	var curve elliptic.Curve
+	for c, o := range curveOIDs {
+		if o.Equal(oid) {
+			curve = c
+		}
+	}
+	if curve == nil {
+		return nil, fmt.Errorf("kauth: unsupported curve %s", oid)
+	}
+	// The point is DER-encoded as an OCTET STRING.
+	var point []byte
+	if _, err := asn1.Unmarshal(attrs[1].Value, &point); err != nil {
+		return nil, fmt.Errorf("kauth: bad EC point: %s", err)
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.New("kauth: bad EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// Public implements crypto.Signer.
+func (s *PKCS11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign implements crypto.Signer. The token signs the digest; rand is
+// ignored.
+func (s *PKCS11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.key); err != nil {
+		return nil, fmt.Errorf("kauth: %s", err)
+	}
+	raw, err := s.ctx.Sign(s.session, digest)
+	if err != nil {
+		return nil, fmt.Errorf("kauth: %s", err)
+	}
+	// The token returns r and s end to end; crypto.Signer wants
+	// them ASN.1-encoded.
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, errors.New("kauth: the token returned a malformed signature")
+	}
+	n := len(raw) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(raw[:n]),
+		new(big.Int).SetBytes(raw[n:]),
+	})
+}
+
+// Close closes s's session, and unloads its module, finalizing it
+// unless other signers are still using it. Closing the token's last
+// session logs out of it; logging out before then would log the other
+// signers out too.
+func (s *PKCS11Signer) Close() error {
+	if s.loggedIn {
+		s.ctx.CloseSession(s.session)
+	}
+	modules.Lock()
+	defer modules.Unlock()
+	var err error
+	if modules.open[s.module]--; modules.open[s.module] == 0 {
+		delete(modules.open, s.module)
+		err = s.ctx.Finalize()
+	}
+	s.ctx.Destroy()
+	return err
+}
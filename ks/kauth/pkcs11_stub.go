@@ -0,0 +1,30 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+
+//go:build !pkcs11
+// +build !pkcs11
+
+package kauth
+
+import (
+	"crypto/elliptic"
+	"errors"
+)
+
+// PKCS11Supported is true if the package was built with the pkcs11
+// tag, and so can keep the active key in a token.
+const PKCS11Supported = false
+
+var errNoPKCS11 = errors.New("kauth: built without PKCS#11 support; rebuild with -tags pkcs11")
+
+// OpenPKCS11 returns a Signer for the key labelled kid in the token
+// described by c.
+func OpenPKCS11(c *PKCS11Config, kid string) (Signer, error) {
+	return nil, errNoPKCS11
+}
+
+// GeneratePKCS11 makes a new key pair on curve in the token described
+// by c, and returns a Signer for it.
+func GeneratePKCS11(c *PKCS11Config, curve elliptic.Curve) (Signer, error) {
+	return nil, errNoPKCS11
+}
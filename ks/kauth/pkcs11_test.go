@@ -0,0 +1,129 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+
+//go:build pkcs11
+// +build pkcs11
+
+package kauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// testPKCS11Config returns the token to test with, as described by
+// the environment. With SoftHSM2:
+//
+//	softhsm2-util --init-token --free --label kauth-test --pin 1234 --so-pin 5678
+//	KAUTH_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so \
+//	KAUTH_PKCS11_TOKEN=kauth-test KAUTH_PKCS11_PIN=1234 \
+//	go test -tags pkcs11 ./ks/kauth
+func testPKCS11Config(t *testing.T) *PKCS11Config {
+	c := &PKCS11Config{
+		Module: os.Getenv("KAUTH_PKCS11_MODULE"),
+		Token:  os.Getenv("KAUTH_PKCS11_TOKEN"),
+		PIN:    os.Getenv("KAUTH_PKCS11_PIN"),
+	}
+	if c.Module == "" {
+		t.Skip("KAUTH_PKCS11_MODULE isn't set")
+	}
+	return c
+}
+
+func TestPKCS11(t *testing.T) {
+	c := testPKCS11Config(t)
+	signer, err := GeneratePKCS11(c, elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := signer.(*PKCS11Signer)
+	// Remove the test key from the token, while s can still see it.
+	defer func() {
+		kid, _ := Thumbprint(s.pub)
+		for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+			obj, err := s.find(class, kid)
+			if err == nil {
+				err = s.ctx.DestroyObject(s.session, obj)
+			}
+			if err != nil {
+				t.Errorf("removing the test key: %s", err)
+			}
+		}
+		s.Close()
+	}()
+
+	// The private key can't be read out of the token.
+	attrs, err := s.ctx.GetAttributeValue(s.session, s.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs[0].Value[0] != 0 || attrs[1].Value[0] != 1 {
+		t.Fatalf("extractable %v, sensitive %v", attrs[0].Value, attrs[1].Value)
+	}
+	if _, err := s.ctx.GetAttributeValue(s.session, s.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	}); err == nil {
+		t.Fatal("read the private key's value")
+	}
+
+	key, err := NewPublicKey(s.Public().(*ecdsa.PublicKey), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := &Keyring{Keys: []*Key{key}}
+	pub := marshal(t, kr, false)
+	v, err := NewVerifier(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka, err := NewWithSigner(signer, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := ka.Sign([]byte("msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := v.Verify(jws); err != nil || string(payload) != "msg" {
+		t.Fatalf("got %q, %v", payload, err)
+	}
+
+	// The key is found again by its kid, as kauthd finds it.
+	kr, err = ParseKeyring(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := OpenPKCS11(c, kr.Keys[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka, err = NewWithSigner(again, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jws, err = ka.Sign([]byte("again")); err != nil {
+		ka.Close()
+		t.Fatal(err)
+	}
+	if payload, err := v.Verify(jws); err != nil || string(payload) != "again" {
+		ka.Close()
+		t.Fatalf("got %q, %v", payload, err)
+	}
+
+	// Closing one signer leaves the others working.
+	if err := ka.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Sign(nil, make([]byte, 32), crypto.SHA256); err != nil {
+		t.Fatalf("signing after another signer was closed: %s", err)
+	}
+}
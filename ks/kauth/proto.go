@@ -0,0 +1,109 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package kauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The kauthd protocol, spoken by a Daemon and a Remote over a Unix
+// socket. When a client connects, the daemon sends it a hello with a
+// fresh random nonce. After that, the client sends requests, and the
+// daemon answers each in turn. Every message is a frame: a 4-byte
+// big-endian length, then that many bytes of JSON.
+//
+// Requests and responses carry a sequence number, starting at 1, and
+// an HMAC-SHA256, under a secret the two share, of the connection's
+// nonce and everything else in them. So only a client that holds the
+// secret can have anything signed, and neither side can be fed a
+// message replayed from another connection, or out of order.
+
+// The operations a client may ask for.
+const (
+	// OpSign asks for Msg to be signed.
+	OpSign = "sign"
+	// OpKeys asks for the kauth's JWK Set.
+	OpKeys = "keys"
+)
+
+// maxFrame bounds the length of a frame.
+const maxFrame = 1 << 20
+
+type hello struct {
+	Nonce []byte `json:"nonce"`
+}
+
+type request struct {
+	Op  string `json:"op"`
+	Seq uint64 `json:"seq"`
+	Msg []byte `json:"msg,omitempty"`
+	MAC []byte `json:"mac"`
+}
+
+type response struct {
+	Seq    uint64 `json:"seq"`
+	Result []byte `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	MAC    []byte `json:"mac"`
+}
+
+func (r *request) mac(secret, nonce []byte) []byte {
+	return mac(secret, nonce, "request", r.Seq, []byte(r.Op), r.Msg)
+}
+
+func (r *response) mac(secret, nonce []byte) []byte {
+	return mac(secret, nonce, "response", r.Seq, []byte(r.Error), r.Result)
+}
+
+// mac MACs the nonce, which way a message is going, its sequence
+// number and its fields, each prefixed with its length so that no two
+// messages MAC the same input.
+func mac(secret, nonce []byte, dir string, seq uint64, fields ...[]byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	var n [8]byte
+	for _, b := range append([][]byte{nonce, []byte(dir)}, fields...) {
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	binary.BigEndian.PutUint64(n[:], seq)
+	h.Write(n[:])
+	return h.Sum(nil)
+}
+
+func writeFrame(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxFrame {
+		return errors.New("kauth: message too long")
+	}
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	_, err = w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader, v interface{}) error {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > maxFrame {
+		return fmt.Errorf("kauth: %d-byte frame is too long", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package kauth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+// timeout bounds each call to kauthd.
+const timeout = 10 * time.Second
+
+// A Remote is a key authority in another process, kauthd, which holds
+// the private key; a Remote only holds the secret that it shares with
+// kauthd, and asks it, over a Unix socket, to sign. It implements the
+// same methods as Kauth.
+type Remote struct {
+	addr   string
+	secret []byte
+	pub    crypto.PublicKey
+
+	mu    sync.Mutex
+	conn  net.Conn
+	nonce []byte
+	seq   uint64
+}
+
+// Dial returns a Remote for the kauthd listening on the Unix socket at
+// addr, which shares secret.
+func Dial(addr string, secret []byte) (*Remote, error) {
+	r := &Remote{addr: addr, secret: secret}
+	b, err := r.JWKS()
+	if err != nil {
+		return nil, err
+	}
+	var set jose.JsonWebKeySet
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("kauth: bad JWK Set: %s", err)
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("kauth: kauthd has no keys")
+	}
+	// The active key is first.
+	r.pub = set.Keys[0].Key
+	return r, nil
+}
+
+// Public returns the public key that kauthd was signing with when r
+// was dialed.
+func (r *Remote) Public() crypto.PublicKey {
+	return r.pub
+}
+
+// JWKS returns kauthd's public keys as a JWK Set.
+func (r *Remote) JWKS() ([]byte, error) {
+	return r.call(OpKeys, nil)
+}
+
+// Sign asks kauthd to sign msg. It refuses messages that aren't
+// statements that the keyshop makes.
+func (r *Remote) Sign(msg []byte) ([]byte, error) {
+	return r.call(OpSign, msg)
+}
+
+// Close closes r's connection to kauthd.
+func (r *Remote) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hangUp()
+}
+
+// call asks kauthd to carry out op. If the connection fails, as it
+// will if kauthd has been restarted, or has hung up on it for being
+// idle, it redials once.
+func (r *Remote) call(op string, msg []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp, err := r.roundTrip(op, msg)
+	if err != nil {
+		r.hangUp()
+		if resp, err = r.roundTrip(op, msg); err != nil {
+			r.hangUp()
+			return nil, err
+		}
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("kauthd: %s", resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// roundTrip sends one request, and reads its response. r.mu must be
+// held.
+func (r *Remote) roundTrip(op string, msg []byte) (*response, error) {
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			return nil, err
+		}
+	}
+	r.conn.SetDeadline(time.Now().Add(timeout))
+	r.seq++
+	req := &request{Op: op, Seq: r.seq, Msg: msg}
+	req.MAC = req.mac(r.secret, r.nonce)
+	if err := writeFrame(r.conn, req); err != nil {
+		return nil, fmt.Errorf("kauth: error writing to kauthd: %s", err)
+	}
+	resp := new(response)
+	if err := readFrame(r.conn, resp); err != nil {
+		return nil, fmt.Errorf("kauth: error reading from kauthd: %s", err)
+	}
+	if resp.Seq != r.seq || !hmac.Equal(resp.MAC, resp.mac(r.secret, r.nonce)) {
+		return nil, errors.New("kauth: kauthd's response has a bad MAC")
+	}
+	return resp, nil
+}
+
+// dial connects to kauthd, and reads its hello. r.mu must be held.
+func (r *Remote) dial() error {
+	c, err := net.DialTimeout("unix", r.addr, timeout)
+	if err != nil {
+		return fmt.Errorf("kauth: error connecting to kauthd: %s", err)
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	var h hello
+	if err := readFrame(c, &h); err != nil {
+		c.Close()
+		return fmt.Errorf("kauth: error reading kauthd's hello: %s", err)
+	}
+	if len(h.Nonce) < 16 {
+		c.Close()
+		return errors.New("kauth: kauthd's nonce is too short")
+	}
+	r.conn, r.nonce, r.seq = c, h.Nonce, 0
+	return nil
+}
+
+// hangUp closes r's connection, if it has one. r.mu must be held.
+func (r *Remote) hangUp() error {
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package kauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/square/go-jose"
+)
+
+// A Signer holds a key authority's active private key, and signs
+// digests with it, as crypto.Signer does: an ECDSA signature is
+// returned ASN.1-encoded. Its Public key is an *ecdsa.PublicKey.
+//
+// The *ecdsa.PrivateKey in a PEM keyring is one Signer; a key in a
+// PKCS#11 token, which never leaves it, is another.
+type Signer interface {
+	crypto.Signer
+}
+
+// A PKCS11Config describes a PKCS#11 token that a Signer's key is
+// kept in. Unless the package is built with the pkcs11 tag, it can't
+// be used.
+type PKCS11Config struct {
+	// Module is the token's PKCS#11 module, e.g.
+	// /usr/lib/softhsm/libsofthsm2.so.
+	Module string
+	// Token is the token's label.
+	Token string
+	// PIN is the user PIN that unlocks the token.
+	PIN string
+}
+
+// hashes gives the digest that each algorithm signs.
+var hashes = map[jose.SignatureAlgorithm]crypto.Hash{
+	jose.ES256: crypto.SHA256,
+	jose.ES384: crypto.SHA384,
+	jose.ES512: crypto.SHA512,
+}
+
+// signJWS returns the compact serialization of a JWS over payload,
+// signed by s, whose public key is pub, and whose protected header
+// names kid.
+func signJWS(s Signer, pub *ecdsa.PublicKey, kid string, payload []byte) ([]byte, error) {
+	alg := algorithms[pub.Curve]
+	header, err := json.Marshal(&struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{string(alg), kid})
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	hash := hashes[alg]
+	h := hash.New()
+	h.Write([]byte(input))
+	der, err := s.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, err
+	}
+	// JWS wants r and s, each as long as the curve's order, end to
+	// end.
+	var sig struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) > 0 {
+		return nil, errors.New("kauth: the signer returned a malformed ECDSA signature")
+	}
+	size := (pub.Params().BitSize + 7) / 8
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.BitLen() > size*8 || sig.S.BitLen() > size*8 {
+		return nil, errors.New("kauth: the signer returned a malformed ECDSA signature")
+	}
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return []byte(input + "." + enc.EncodeToString(raw)), nil
+}
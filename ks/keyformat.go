@@ -0,0 +1,264 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/yahoo/keyshop/yenc"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+// The types of key that may be registered, as in DKey.Type. A POST
+// names its key's type with ?type=; if it doesn't, a JWK is expected if
+// its Content-Type is jwkType, and an OpenPGP key otherwise.
+const (
+	KeyTypePGP     = "pgp"
+	KeyTypeJWK     = "jwk"
+	KeyTypeX25519  = "x25519"
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeSSH     = "ssh"
+)
+
+// Codes for the errors that key types are refused with.
+const (
+	CodeUnknownKeyType  = "unknown_key_type"
+	CodeKeyTypeRefused  = "key_type_not_allowed"
+	CodeMalformedKey    = "malformed_key"
+	CodePoPNotSupported = "pop_not_supported"
+)
+
+// The formats a key may be POSTed in, by Content-Type. Anything else,
+// including no Content-Type at all, is taken to be base64url, as it
+// always has been.
+const (
+	armoredKeyType = "application/pgp-keys"
+	binaryKeyType  = "application/octet-stream"
+	jwkType        = "application/jwk+json"
+)
+
+// maxBodyLen bounds a POST's body: enough for a key of maxKeyLen bytes
+// once armored.
+const maxBodyLen = 2 * maxKeyLen
+
+// A keyType checks and canonicalizes keys of one type.
+type keyType struct {
+	// decode returns the key in a body sent with mediaType.
+	decode func(mediaType string, body []byte) ([]byte, error)
+	// check checks that key is a valid key for userid, who
+	// authenticated as email, and returns it.
+	check func(userid, email string, key []byte) (*parsedKey, *Error)
+}
+
+// A parsedKey is a key that has been checked, in the canonical form
+// in which it is stored and signed. Whatever format it was sent in,
+// the same key always has the same canonical form.
+type parsedKey struct {
+	Type      string
+	Canonical string
+	// entity is set for OpenPGP keys.
+	entity *openpgp.Entity
+}
+
+var keyTypes = map[string]*keyType{
+	KeyTypePGP:     {decode: decodePGP, check: checkPGP},
+	KeyTypeJWK:     {decode: decodeText, check: checkJWK},
+	KeyTypeX25519:  {decode: decodeBytes, check: checkRaw25519},
+	KeyTypeEd25519: {decode: decodeBytes, check: checkRaw25519},
+	KeyTypeSSH:     {decode: decodeText, check: checkSSH},
+}
+
+// readKey decodes and checks the key POSTed in r, with body, for
+// userid. If it can't, it returns the status to reply with, and why.
+func readKey(r *http.Request, userid string, body []byte) (*parsedKey, int, *Error) {
+	mediaType := ""
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return nil, http.StatusBadRequest, &Error{Code: CodeMalformedKey, Message: fmt.Sprintf("bad Content-Type: %s", err)}
+		}
+	}
+	name := r.URL.Query().Get("type")
+	if name == "" {
+		name = KeyTypePGP
+		if mediaType == jwkType {
+			name = KeyTypeJWK
+		}
+	}
+	kt, ok := keyTypes[name]
+	if !ok {
+		return nil, http.StatusBadRequest, &Error{Code: CodeUnknownKeyType, Message: fmt.Sprintf("unknown key type %q", name)}
+	}
+	key, err := kt.decode(mediaType, body)
+	if err != nil {
+		return nil, http.StatusBadRequest, &Error{Code: CodeMalformedKey, Message: err.Error()}
+	}
+	if len(key) == 0 || len(key) > maxKeyLen {
+		return nil, http.StatusBadRequest, &Error{Code: CodeMalformedKey, Message: "key too long, or empty"}
+	}
+	pk, kerr := kt.check(userid, principal(r).UserID, key)
+	if kerr != nil {
+		return nil, http.StatusUnauthorized, kerr
+	}
+	pk.Type = name
+	return pk, http.StatusOK, nil
+}
+
+// decodePGP decodes an OpenPGP key, armored or as decodeBytes does.
+func decodePGP(mediaType string, body []byte) ([]byte, error) {
+	if mediaType != armoredKeyType {
+		return decodeBytes(mediaType, body)
+	}
+	block, err := armor.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid armor: %s", err)
+	}
+	if block.Type != openpgp.PublicKeyType {
+		return nil, fmt.Errorf("armored %s, not a public key", block.Type)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(block.Body); err != nil {
+		return nil, fmt.Errorf("invalid armor: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeBytes decodes a binary key, sent as is, or base64url-encoded.
+func decodeBytes(mediaType string, body []byte) ([]byte, error) {
+	if mediaType == binaryKeyType {
+		return body, nil
+	}
+	key, err := yenc.RawURL64.DecodeString(string(bytes.TrimSpace(body)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %s", err)
+	}
+	return key, nil
+}
+
+// decodeText decodes a key that is sent as text.
+func decodeText(mediaType string, body []byte) ([]byte, error) {
+	return bytes.TrimSpace(body), nil
+}
+
+func checkPGP(userid, email string, key []byte) (*parsedKey, *Error) {
+	e, kerr := validKeyForUser(userid, email, key)
+	if kerr != nil {
+		return nil, kerr
+	}
+	var buf bytes.Buffer
+	if err := e.Serialize(&buf); err != nil {
+		return nil, invalidKey("error serializing key: %s", err)
+	}
+	return &parsedKey{Canonical: yenc.RawURL64.EncodeToString(buf.Bytes()), entity: e}, nil
+}
+
+// A jwk is the public part of a JSON Web Key, with its members in the
+// order that RFC 7638 thumbprints them in.
+type jwk struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// checkJWK checks a public EC or OKP JWK. Its canonical form is its
+// RFC 7638 thumbprint input: members other than those that make up
+// the public key, including any private key, are dropped. As JOSE
+// requires, and unlike the rest of the keyshop, its base64url isn't
+// padded.
+func checkJWK(userid, email string, key []byte) (*parsedKey, *Error) {
+	var k jwk
+	if err := json.Unmarshal(key, &k); err != nil {
+		return nil, invalidKey("invalid JWK: %s", err)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, invalidKey("invalid JWK x: %s", err)
+	}
+	canonical := jwk{Crv: k.Crv, Kty: k.Kty, X: base64.RawURLEncoding.EncodeToString(x)}
+	switch k.Kty {
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, invalidKey("unsupported EC curve %q", k.Crv)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, invalidKey("invalid JWK y: %s", err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size ||
+			!curve.IsOnCurve(new(big.Int).SetBytes(x), new(big.Int).SetBytes(y)) {
+			return nil, invalidKey("the point is not on %s", k.Crv)
+		}
+		canonical.Y = base64.RawURLEncoding.EncodeToString(y)
+	case "OKP":
+		if k.Crv != "Ed25519" && k.Crv != "X25519" {
+			return nil, invalidKey("unsupported OKP curve %q", k.Crv)
+		}
+		if kerr := check25519(x); kerr != nil {
+			return nil, kerr
+		}
+	default:
+		return nil, invalidKey("unsupported JWK key type %q", k.Kty)
+	}
+	b, err := json.Marshal(&canonical)
+	if err != nil {
+		return nil, invalidKey("%s", err)
+	}
+	return &parsedKey{Canonical: string(b)}, nil
+}
+
+// checkRaw25519 checks a raw X25519 or Ed25519 public key, whose
+// canonical form is base64url.
+func checkRaw25519(userid, email string, key []byte) (*parsedKey, *Error) {
+	if kerr := check25519(key); kerr != nil {
+		return nil, kerr
+	}
+	return &parsedKey{Canonical: yenc.RawURL64.EncodeToString(key)}, nil
+}
+
+func check25519(key []byte) *Error {
+	if len(key) != 32 {
+		return invalidKey("a 25519 key is 32 bytes, not %d", len(key))
+	}
+	if bytes.Equal(key, make([]byte, 32)) {
+		return invalidKey("the key is all zeros")
+	}
+	return nil
+}
+
+// checkSSH checks a single OpenSSH authorized_keys line. Its canonical
+// form is the key's type and base64, without options or a comment.
+func checkSSH(userid, email string, key []byte) (*parsedKey, *Error) {
+	pub, _, _, rest, err := ssh.ParseAuthorizedKey(key)
+	if err != nil {
+		return nil, invalidKey("invalid authorized_keys line: %s", err)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, invalidKey("expected one key, got more")
+	}
+	switch pub.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSA:
+	default:
+		return nil, invalidKey("unsupported SSH key type %s", pub.Type())
+	}
+	canonical := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	return &parsedKey{Canonical: canonical}, nil
+}
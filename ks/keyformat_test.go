@@ -0,0 +1,167 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/yahoo/keyshop/yenc"
+	"golang.org/x/crypto/ssh"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestServerKeyTypes(t *testing.T) {
+	s, pub := testServer(t)
+	s.policy = &Policy{Types: []string{KeyTypePGP, KeyTypeJWK, KeyTypeX25519, KeyTypeEd25519, KeyTypeSSH}}
+	if err := s.policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+	const userid = "alice@example.com"
+
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := ec.X.FillBytes(make([]byte, 32)), ec.Y.FillBytes(make([]byte, 32))
+	x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub := x25519.PublicKey().Bytes()
+	edpub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpub, err := ssh.NewPublicKey(edpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshpub)))
+
+	for _, test := range []struct {
+		device, query, contentType, body string
+		typ, want                        string
+	}{
+		{
+			"ec", "", "application/jwk+json",
+			fmt.Sprintf(`{"kty":"EC","crv":"P-256","x":"%s","y":"%s","use":"enc","kid":"1"}`, b64(x), b64(y)),
+			KeyTypeJWK,
+			fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(x), b64(y)),
+		},
+		{
+			"okp", "?type=jwk", "application/json",
+			fmt.Sprintf(`{"kty":"OKP","crv":"X25519","x":"%s"}`, b64(xpub)),
+			KeyTypeJWK,
+			fmt.Sprintf(`{"crv":"X25519","kty":"OKP","x":"%s"}`, b64(xpub)),
+		},
+		{
+			"x25519", "?type=x25519", "application/octet-stream", string(xpub),
+			KeyTypeX25519, yenc.RawURL64.EncodeToString(xpub),
+		},
+		{
+			"ed25519", "?type=ed25519", "", yenc.RawURL64.EncodeToString(edpub),
+			KeyTypeEd25519, yenc.RawURL64.EncodeToString(edpub),
+		},
+		{
+			"ssh", "?type=ssh", "text/plain", `no-pty ` + sshLine + " alice@laptop\n",
+			KeyTypeSSH, sshLine,
+		},
+	} {
+		w := doWithType(s, "POST", "/v1/k/"+userid+"/"+test.device+test.query, test.contentType, []byte(test.body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST %s: got %d %s", test.device, w.Code, w.Body)
+		}
+		var dkey DKey
+		verify(t, pub, w.Body.Bytes(), &dkey)
+		if dkey.Type != test.typ || dkey.Key != test.want {
+			t.Fatalf("POST %s: stored %s key %s, want %s key %s", test.device, dkey.Type, dkey.Key, test.typ, test.want)
+		}
+	}
+	if w := do(s, "POST", "/v1/k/"+userid+"/pgp", yenc.RawURL64.EncodeToString(testKey(t, userid))); w.Code != http.StatusOK {
+		t.Fatalf("POST pgp: got %d", w.Code)
+	}
+
+	w := do(s, "GET", "/v1/k/"+userid, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d", w.Code)
+	}
+	var ukeys UKeys
+	verify(t, pub, w.Body.Bytes(), &ukeys)
+	want := map[string]string{
+		"ec": KeyTypeJWK, "okp": KeyTypeJWK, "x25519": KeyTypeX25519,
+		"ed25519": KeyTypeEd25519, "ssh": KeyTypeSSH, "pgp": KeyTypePGP,
+	}
+	if len(ukeys.Types) != len(want) {
+		t.Fatalf("GET: got types %v, want %v", ukeys.Types, want)
+	}
+	for device, typ := range want {
+		if ukeys.Types[device] != typ {
+			t.Fatalf("GET: got types %v, want %v", ukeys.Types, want)
+		}
+	}
+
+	x[0] ^= 1
+	for _, test := range []struct {
+		name, query, contentType, body string
+		status                         int
+		code                           string
+	}{
+		{"unknown type", "?type=rot13", "", "AAAA", http.StatusBadRequest, CodeUnknownKeyType},
+		{"point not on the curve", "", "application/jwk+json",
+			fmt.Sprintf(`{"kty":"EC","crv":"P-256","x":"%s","y":"%s"}`, b64(x), b64(y)),
+			http.StatusUnauthorized, CodeInvalidKey},
+		{"RSA JWK", "", "application/jwk+json", `{"kty":"RSA","n":"AQAB","e":"AQAB"}`, http.StatusUnauthorized, CodeInvalidKey},
+		{"short X25519 key", "?type=x25519", "application/octet-stream", "short", http.StatusUnauthorized, CodeInvalidKey},
+		{"two SSH keys", "?type=ssh", "", sshLine + "\n" + sshLine, http.StatusUnauthorized, CodeInvalidKey},
+	} {
+		w := doWithType(s, "POST", "/v1/k/"+userid+"/bad"+test.query, test.contentType, []byte(test.body))
+		var e Error
+		if w.Code != test.status || json.Unmarshal(w.Body.Bytes(), &e) != nil || e.Code != test.code {
+			t.Errorf("POST of %s: got %d %s, want %d %s", test.name, w.Code, w.Body, test.status, test.code)
+		}
+	}
+}
+
+func TestServerKeyTypePolicy(t *testing.T) {
+	// Without a policy file, only OpenPGP keys are accepted, as with
+	// an empty one.
+	d, _ := testServer(t)
+	x := yenc.RawURL64.EncodeToString(append(make([]byte, 31), 9))
+	if w := do(d, "POST", "/v1/k/alice@example.com/laptop?type=x25519", x); w.Code != http.StatusForbidden {
+		t.Fatalf("POST of an X25519 key with the default policy: got %d %s", w.Code, w.Body)
+	}
+
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.RequirePoP = true
+	s, _ := testServerWith(t, c)
+	s.policy = &Policy{Types: []string{KeyTypePGP, KeyTypeX25519}}
+	if err := s.policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+	const userid = "alice@example.com"
+	key := yenc.RawURL64.EncodeToString(append(make([]byte, 31), 9))
+
+	w := do(s, "POST", "/v1/k/"+userid+"/laptop?type=ed25519", key)
+	var e Error
+	if w.Code != http.StatusForbidden || json.Unmarshal(w.Body.Bytes(), &e) != nil || e.Code != CodeKeyTypeRefused {
+		t.Fatalf("POST of a refused type: got %d %s", w.Code, w.Body)
+	}
+	w = do(s, "POST", "/v1/k/"+userid+"/laptop?type=x25519", key)
+	if w.Code != http.StatusUnauthorized || json.Unmarshal(w.Body.Bytes(), &e) != nil || e.Code != CodePoPNotSupported {
+		t.Fatalf("POST of an X25519 key with proof of possession required: got %d %s", w.Code, w.Body)
+	}
+}
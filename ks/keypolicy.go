@@ -0,0 +1,148 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Codes for the errors that keys are rejected with.
+const (
+	CodeInvalidKey       = "invalid_key"
+	CodeKeyUserID        = "key_userid_mismatch"
+	CodeKeyRevoked       = "key_revoked"
+	CodeKeyExpired       = "key_expired"
+	CodeAlgorithmRefused = "algorithm_not_allowed"
+	CodeKeyTooSmall      = "key_too_small"
+	CodeNoEncryptionKey  = "no_encryption_subkey"
+	CodeValidityTooLong  = "validity_too_long"
+)
+
+// pgpAlgorithms names the OpenPGP public-key algorithms for KeyPolicy.
+// EdDSA (RFC 4880bis) isn't one: the openpgp package can't read EdDSA
+// keys, so none could ever be registered.
+var pgpAlgorithms = map[string][]packet.PublicKeyAlgorithm{
+	"rsa":     {packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly},
+	"dsa":     {packet.PubKeyAlgoDSA},
+	"elgamal": {packet.PubKeyAlgoElGamal},
+	"ecdh":    {packet.PubKeyAlgoECDH},
+	"ecdsa":   {packet.PubKeyAlgoECDSA},
+}
+
+// A KeyPolicy limits the OpenPGP keys that may be registered, over and
+// above their being well-formed, self-signed, unrevoked and unexpired,
+// which is always required. It is the "keys" section of a Policy:
+//
+//	"keys": {
+//	  "algorithms": ["rsa", "ecdh", "ecdsa"],
+//	  "min_rsa_bits": 3072,
+//	  "require_encryption_subkey": true,
+//	  "max_validity_days": 730
+//	}
+type KeyPolicy struct {
+	// Algorithms, if not empty, are the public-key algorithms the
+	// primary key and every subkey must use: any of "rsa", "dsa",
+	// "elgamal", "ecdh" and "ecdsa".
+	Algorithms []string `json:"algorithms"`
+	// MinRSABits is the smallest RSA modulus accepted.
+	MinRSABits int `json:"min_rsa_bits"`
+	// RequireEncryption requires a subkey that may be used for
+	// encryption.
+	RequireEncryption bool `json:"require_encryption_subkey"`
+	// MaxValidityDays, if not 0, requires the key and its subkeys
+	// to expire within that many days of being made.
+	MaxValidityDays int `json:"max_validity_days"`
+
+	algorithms map[packet.PublicKeyAlgorithm]bool
+}
+
+func (p *KeyPolicy) compile() error {
+	if p.MinRSABits < 0 || p.MaxValidityDays < 0 {
+		return fmt.Errorf("negative min_rsa_bits or max_validity_days")
+	}
+	if len(p.Algorithms) == 0 {
+		return nil
+	}
+	p.algorithms = make(map[packet.PublicKeyAlgorithm]bool)
+	for _, name := range p.Algorithms {
+		algos, ok := pgpAlgorithms[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown algorithm %q", name)
+		}
+		for _, a := range algos {
+			p.algorithms[a] = true
+		}
+	}
+	return nil
+}
+
+// limited reports whether p limits keys at all.
+func (p *KeyPolicy) limited() bool {
+	return len(p.Algorithms) > 0 || p.MinRSABits > 0 || p.RequireEncryption || p.MaxValidityDays > 0
+}
+
+// CheckKey returns an Error if e isn't acceptable.
+func (p *KeyPolicy) CheckKey(e *openpgp.Entity) *Error {
+	var lifetime *uint32
+	for _, id := range e.Identities {
+		lifetime = id.SelfSignature.KeyLifetimeSecs
+	}
+	if kerr := p.checkPublicKey("the key", e.PrimaryKey, lifetime); kerr != nil {
+		return kerr
+	}
+	canEncrypt := false
+	for i, sub := range e.Subkeys {
+		what := fmt.Sprintf("subkey %d", i)
+		if kerr := p.checkPublicKey(what, sub.PublicKey, sub.Sig.KeyLifetimeSecs); kerr != nil {
+			return kerr
+		}
+		flags := sub.Sig
+		if sub.PublicKey.PubKeyAlgo.CanEncrypt() && flags.FlagsValid &&
+			(flags.FlagEncryptCommunications || flags.FlagEncryptStorage) {
+			canEncrypt = true
+		}
+	}
+	if p.RequireEncryption && !canEncrypt {
+		return &Error{Code: CodeNoEncryptionKey, Message: "the key has no subkey for encryption"}
+	}
+	return nil
+}
+
+// checkPublicKey checks a primary key or subkey, described by what,
+// with the given lifetime in seconds (nil if it doesn't expire).
+func (p *KeyPolicy) checkPublicKey(what string, pk *packet.PublicKey, lifetime *uint32) *Error {
+	if p.algorithms != nil && !p.algorithms[pk.PubKeyAlgo] {
+		return &Error{
+			Code:    CodeAlgorithmRefused,
+			Message: fmt.Sprintf("%s uses public-key algorithm %d; allowed are %s", what, pk.PubKeyAlgo, strings.Join(p.Algorithms, ", ")),
+		}
+	}
+	switch pk.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		bits, err := pk.BitLength()
+		if err != nil {
+			return invalidKey("%s: %s", what, err)
+		}
+		if int(bits) < p.MinRSABits {
+			return &Error{
+				Code:    CodeKeyTooSmall,
+				Message: fmt.Sprintf("%s is %d-bit RSA; at least %d bits are required", what, bits, p.MinRSABits),
+			}
+		}
+	}
+	if p.MaxValidityDays > 0 {
+		max := time.Duration(p.MaxValidityDays) * 24 * time.Hour
+		if lifetime == nil || *lifetime == 0 || time.Duration(*lifetime)*time.Second > max {
+			return &Error{
+				Code:    CodeValidityTooLong,
+				Message: fmt.Sprintf("%s must expire within %d days of being made", what, p.MaxValidityDays),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/yahoo/keyshop/yenc"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// withLifetime sets the lifetime of e and its subkeys, without
+// re-signing them; CheckKey doesn't check signatures.
+func withLifetime(e *openpgp.Entity, days uint32) *openpgp.Entity {
+	secs := days * 24 * 60 * 60
+	for _, id := range e.Identities {
+		id.SelfSignature.KeyLifetimeSecs = &secs
+	}
+	for _, sub := range e.Subkeys {
+		sub.Sig.KeyLifetimeSecs = &secs
+	}
+	return e
+}
+
+func TestKeyPolicy(t *testing.T) {
+	const email = "alice@example.com"
+	// openpgp.NewEntity makes a 2048-bit RSA key, with an RSA
+	// encryption subkey, that doesn't expire.
+	e := testEntity(t, email)
+	noSubkeys := testEntity(t, email)
+	noSubkeys.Subkeys = nil
+
+	for _, test := range []struct {
+		policy KeyPolicy
+		e      *openpgp.Entity
+		code   string
+	}{
+		{KeyPolicy{}, e, ""},
+		{KeyPolicy{}, noSubkeys, ""},
+		{KeyPolicy{Algorithms: []string{"rsa"}}, e, ""},
+		{KeyPolicy{Algorithms: []string{"ecdh", "ECDSA"}}, e, CodeAlgorithmRefused},
+		{KeyPolicy{MinRSABits: 2048}, e, ""},
+		{KeyPolicy{MinRSABits: 3072}, e, CodeKeyTooSmall},
+		{KeyPolicy{RequireEncryption: true}, e, ""},
+		{KeyPolicy{RequireEncryption: true}, noSubkeys, CodeNoEncryptionKey},
+		{KeyPolicy{MaxValidityDays: 365}, e, CodeValidityTooLong},
+		{KeyPolicy{MaxValidityDays: 365}, withLifetime(testEntity(t, email), 400), CodeValidityTooLong},
+		{KeyPolicy{MaxValidityDays: 365}, withLifetime(testEntity(t, email), 30), ""},
+	} {
+		if err := test.policy.compile(); err != nil {
+			t.Fatalf("%+v: %s", test.policy, err)
+		}
+		kerr := test.policy.CheckKey(test.e)
+		switch {
+		case test.code == "" && kerr != nil:
+			t.Errorf("%+v: got %+v, want the key accepted", test.policy, kerr)
+		case test.code != "" && (kerr == nil || kerr.Code != test.code):
+			t.Errorf("%+v: got %+v, want code %s", test.policy, kerr, test.code)
+		}
+	}
+
+	for _, name := range []string{"rot13", "eddsa"} {
+		p := KeyPolicy{Algorithms: []string{name}}
+		if err := p.compile(); err == nil {
+			t.Errorf("unknown algorithm %q accepted", name)
+		}
+	}
+}
+
+func TestServerKeyPolicy(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "policy.json")
+	if err := ioutil.WriteFile(fn, []byte(`{"keys": {"min_rsa_bits": 3072}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.PolicyFn = fn
+	s, _ := testServerWith(t, c)
+
+	const userid = "alice@example.com"
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	w := do(s, "POST", "/v1/k/"+userid+"/laptop", key)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("POST of a 2048-bit key: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	var kerr Error
+	if err := json.Unmarshal(w.Body.Bytes(), &kerr); err != nil || kerr.Code != CodeKeyTooSmall {
+		t.Fatalf("POST of a 2048-bit key: got %s, want code %s", w.Body, CodeKeyTooSmall)
+	}
+
+	// Keys of other types can't be checked against the policy, so
+	// they aren't accepted at all.
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = do(s, "POST", "/v1/k/"+userid+"/laptop?type=ssh", string(ssh.MarshalAuthorizedKey(sshpub)))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("POST of a 1024-bit ssh-rsa key: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &kerr); err != nil || kerr.Code != CodeKeyTypeRefused {
+		t.Fatalf("POST of a 1024-bit ssh-rsa key: got %s, want code %s", w.Body, CodeKeyTypeRefused)
+	}
+
+	p := &Policy{Types: []string{KeyTypePGP, KeyTypeSSH}, Keys: KeyPolicy{MinRSABits: 3072}}
+	if err := p.compile(); err == nil {
+		t.Errorf("policy limiting keys that accepts SSH keys compiled")
+	}
+}
@@ -5,65 +5,134 @@ package ks
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"regexp"
+	"strings"
+	"time"
 
-	"github.com/golang/glog"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
-func validYmail(email string) bool {
-	// FIXME(OSS): Should be obvious where this goes, and
-	// how you should modify it. Note, however, that Match
-	// does require the ^$ bracketing in Go -- unlike in
-	// Python. Yipes.
-	r := regexp.MustCompile(`^[a-z][a-z0-9]{2,64}@(yahoo-inc\.com|uk\.yahoo-inc\.com|yahoo-corp\.jp|tumblr\.com|yahoo\.com)$`)
-	return r.MatchString(email)
-}
-
-func validKeyForUser(userid, email string, key []byte) (ok bool) {
+// validKeyForUser checks that key is a single OpenPGP key for email,
+// with valid self-signatures, and returns it. If it isn't, the Error
+// says why.
+func validKeyForUser(userid, email string, key []byte) (*openpgp.Entity, *Error) {
 	el, err := openpgp.ReadKeyRing(bytes.NewBuffer(key))
 	if err != nil {
-		glog.Errorf("error reading keyring: %s", err)
-		return false
+		return nil, invalidKey("error reading keyring: %s", err)
 	}
 	// Check that there's only one keypair included,
 	if len(el) != 1 {
-		glog.Errorf("Expected one entity, got %d.\n%+v", len(el), el)
-		return false
+		return nil, invalidKey("expected one key, got %d", len(el))
+	}
+	e := el[0]
+	// that its self-signatures hold up,
+	if kerr := checkSelfSignatures(e, time.Now()); kerr != nil {
+		return nil, kerr
 	}
 	// that there's only one UID packet for the keypair,
-	identities := el[0].Identities
+	identities := e.Identities
 	if len(identities) != 1 {
-		glog.Errorf("Expected one identity, got %d.\n%+v", len(identities), identities)
-		return false
+		return nil, &Error{Code: CodeKeyUserID, Message: fmt.Sprintf("expected one user ID, got %d", len(identities))}
 	}
-	var uidEmail string
 	for _, v := range identities {
 		// This loop will only execute once...
 		u := v.UserId
 		if u.Name != "" || u.Comment != "" {
-			glog.Errorf("too many fields filled (names and comments prohibited): got %+v", u)
-			return false
+			return nil, &Error{Code: CodeKeyUserID, Message: fmt.Sprintf("the user ID may only hold an email address (names and comments prohibited): got %q", u.Id)}
 		}
-		uidEmail = u.Email
-		if uidEmail == "" || uidEmail != email {
-			glog.Errorf("email address in identity did not agree with email address passed in: got %s, wanted %s", uidEmail, email)
-			return false
+		if u.Email == "" || u.Email != email {
+			return nil, &Error{Code: CodeKeyUserID, Message: fmt.Sprintf("the key is for %q, not %s", u.Email, email)}
 		}
 	}
 
-	// and, finally,
-	// FIXME(OSS): authentication-mechanism-specific checks.
-	if userid == email {
-		err = nil
-	} else {
-		err = fmt.Errorf("userid != email")
+	// and, finally, that the principal that requireAuth
+	// authenticated (email) is the user the key is for.
+	if userid != email {
+		return nil, &Error{Code: CodeKeyUserID, Message: fmt.Sprintf("the key is for %s, not %s", email, userid)}
 	}
+	return e, nil
+}
 
+func invalidKey(format string, args ...interface{}) *Error {
+	return &Error{Code: CodeInvalidKey, Message: fmt.Sprintf(format, args...)}
+}
+
+// dkeyOf returns the DKey in a signed DKey from the store, without
+// checking the signature, which is our own.
+func dkeyOf(jws string) (*DKey, error) {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a compact JWS")
+	}
+	// JWS, unlike yenc.RawURL64, doesn't pad.
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		glog.Error(err)
+		return nil, err
+	}
+	dkey := new(DKey)
+	if err := json.Unmarshal(payload, dkey); err != nil {
+		return nil, err
+	}
+	return dkey, nil
+}
+
+// checkSelfSignatures checks, over and above what parsing the key
+// already did, that e's user IDs and subkeys carry valid
+// self-signatures, and that neither e nor they have been revoked or
+// have expired as of now.
+func checkSelfSignatures(e *openpgp.Entity, now time.Time) *Error {
+	pk := e.PrimaryKey
+	if len(e.Revocations) > 0 {
+		return &Error{Code: CodeKeyRevoked, Message: "the key has been revoked"}
+	}
+	if pk.CreationTime.After(now.Add(clockSkew)) {
+		return invalidKey("the key was created in the future")
+	}
+	for name, id := range e.Identities {
+		sig := id.SelfSignature
+		if sig == nil {
+			return invalidKey("user ID %q is not self-signed", name)
+		}
+		if err := pk.VerifyUserIdSignature(name, pk, sig); err != nil {
+			return invalidKey("user ID %q: %s", name, err)
+		}
+		if sig.CreationTime.After(now.Add(clockSkew)) {
+			return invalidKey("user ID %q was self-signed in the future", name)
+		}
+		if expired(pk.CreationTime, sig, now) {
+			return &Error{Code: CodeKeyExpired, Message: "the key has expired"}
+		}
+	}
+	for i, sub := range e.Subkeys {
+		if sub.Sig == nil {
+			return invalidKey("subkey %d is not bound to the key", i)
+		}
+		if sub.Sig.SigType == packet.SigTypeSubkeyRevocation {
+			return &Error{Code: CodeKeyRevoked, Message: fmt.Sprintf("subkey %d has been revoked", i)}
+		}
+		if err := pk.VerifyKeySignature(sub.PublicKey, sub.Sig); err != nil {
+			return invalidKey("subkey %d: %s", i, err)
+		}
+		if expired(sub.PublicKey.CreationTime, sub.Sig, now) {
+			return &Error{Code: CodeKeyExpired, Message: fmt.Sprintf("subkey %d has expired", i)}
+		}
+	}
+	return nil
+}
+
+// clockSkew is how far in the future a key or signature may claim to
+// have been made.
+const clockSkew = 10 * time.Minute
+
+// expired reports whether a key created at created has expired as of
+// now, according to sig.
+func expired(created time.Time, sig *packet.Signature, now time.Time) bool {
+	if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
 		return false
 	}
-	return true
+	return now.After(created.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second))
 }
@@ -0,0 +1,85 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// A Mailer sends plain-text email.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// message formats an RFC 5322 message.
+func message(from, to, subject, body string) ([]byte, error) {
+	if strings.ContainsAny(from+to+subject, "\r\n") {
+		return nil, errors.New("mail: newline in header")
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return buf.Bytes(), nil
+}
+
+// An SMTPMailer sends mail through an SMTP server.
+type SMTPMailer struct {
+	// Addr is the server's host:port.
+	Addr string
+	// Auth, if not nil, is used to authenticate to the server.
+	Auth smtp.Auth
+	From string
+}
+
+// Send implements Mailer.
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	msg, err := message(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, msg)
+}
+
+// A DropMailer writes each message to a new file in a directory,
+// instead of sending it. It is meant for tests and development.
+type DropMailer struct {
+	Dir  string
+	From string
+}
+
+// Send implements Mailer.
+func (m *DropMailer) Send(to, subject, body string) error {
+	msg, err := message(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(m.Dir, "mail-*.eml")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(msg); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// newMailer returns the Mailer described by c.
+func newMailer(c *Config) Mailer {
+	if c.MailDropDir != "" {
+		return &DropMailer{Dir: c.MailDropDir, From: c.MailFrom}
+	}
+	return &SMTPMailer{Addr: c.SMTPAddr, From: c.MailFrom}
+}
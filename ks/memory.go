@@ -0,0 +1,248 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// memory is a KeyShop that keeps everything in process memory. It
+// is meant for tests and throwaway development servers; nothing
+// survives a restart.
+type memory struct {
+	mu      sync.RWMutex
+	keys    map[string]map[string][]byte
+	history map[device][]HistoryEntry
+	pending map[string]Pending
+	// pendingOf is the id of each device's pending registration, and
+	// expiries holds every id, in the order they expire. An id stays
+	// in expiries after it's taken, until it would have expired.
+	pendingOf map[device]string
+	expiries  []expiry
+	// owners is the fingerprint index.
+	owners map[string]map[device]bool
+	// epoch is 0 until a MapRoot is stored.
+	epoch uint64
+	root  []byte
+}
+
+// A device identifies a single device of a single user.
+type device struct {
+	userid, deviceid string
+}
+
+// An expiry is when the registration pending under id expires.
+type expiry struct {
+	expires int64
+	id      string
+}
+
+// openMemory is the memory backend's constructor; it ignores fn. There
+// is nothing for another process to read, so it can't be opened
+// read-only.
+func openMemory(fn string, readOnly bool) (KeyShop, error) {
+	if readOnly {
+		return nil, errors.New("a memory store can't be read from outside the server")
+	}
+	return newMemory(), nil
+}
+
+func newMemory() *memory {
+	return &memory{
+		keys:      make(map[string]map[string][]byte),
+		history:   make(map[device][]HistoryEntry),
+		pending:   make(map[string]Pending),
+		pendingOf: make(map[device]string),
+		owners:    make(map[string]map[device]bool),
+	}
+}
+
+func (m *memory) NewOrUpdate(userid, deviceid string, dkey []byte) (status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices, ok := m.keys[userid]
+	if !ok {
+		devices = make(map[string][]byte)
+		m.keys[userid] = devices
+	}
+	d := device{userid, deviceid}
+	if old, ok := devices[deviceid]; ok {
+		m.unindex(d, old)
+	}
+	devices[deviceid] = append([]byte(nil), dkey...)
+	for _, id := range keyIDs(dkey) {
+		if m.owners[id] == nil {
+			m.owners[id] = make(map[device]bool)
+		}
+		m.owners[id][d] = true
+	}
+	m.history[d] = append(m.history[d], HistoryEntry{
+		Timestamp: time.Now().UTC().Unix(),
+		DKey:      string(dkey),
+	})
+	return http.StatusOK
+}
+
+func (m *memory) Get(userid string) (keys map[string]string, status int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	devices, ok := m.keys[userid]
+	if !ok {
+		glog.Infof("user %s does not have any keys", userid)
+		return nil, http.StatusNotFound
+	}
+	keys = make(map[string]string, len(devices))
+	for deviceid, dkey := range devices {
+		keys[deviceid] = string(dkey)
+	}
+	return keys, http.StatusOK
+}
+
+func (m *memory) Revoke(userid, deviceid string, revocation []byte) (status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices, ok := m.keys[userid]
+	if !ok {
+		return http.StatusNotFound
+	}
+	old, ok := devices[deviceid]
+	if !ok {
+		return http.StatusNotFound
+	}
+	d := device{userid, deviceid}
+	m.unindex(d, old)
+	delete(devices, deviceid)
+	if len(devices) == 0 {
+		delete(m.keys, userid)
+	}
+	m.history[d] = append(m.history[d], HistoryEntry{
+		Timestamp:  time.Now().UTC().Unix(),
+		Revocation: string(revocation),
+	})
+	return http.StatusOK
+}
+
+// unindex removes d from the owners of the key in dkey. The caller
+// must hold m.mu.
+func (m *memory) unindex(d device, dkey []byte) {
+	for _, id := range keyIDs(dkey) {
+		delete(m.owners[id], d)
+		if len(m.owners[id]) == 0 {
+			delete(m.owners, id)
+		}
+	}
+}
+
+func (m *memory) History(userid, deviceid string) (entries []HistoryEntry, status int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	h, ok := m.history[device{userid, deviceid}]
+	if !ok {
+		return nil, http.StatusNotFound
+	}
+	return append([]HistoryEntry(nil), h...), http.StatusOK
+}
+
+func (m *memory) ForEach(fn func(userid string, keys map[string]string) error) error {
+	// Copy everything out first, so that fn doesn't run with the
+	// lock held.
+	m.mu.RLock()
+	users := make(map[string]map[string]string, len(m.keys))
+	for userid, devices := range m.keys {
+		keys := make(map[string]string, len(devices))
+		for deviceid, dkey := range devices {
+			keys[deviceid] = string(dkey)
+		}
+		users[userid] = keys
+	}
+	m.mu.RUnlock()
+	for userid, keys := range users {
+		if err := fn(userid, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memory) PutPending(id string, p *Pending) (status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC().Unix()
+	for len(m.expiries) > 0 && m.expiries[0].expires < now {
+		m.deletePending(m.expiries[0].id)
+		m.expiries = m.expiries[1:]
+	}
+	d := device{p.UserID, p.DeviceID}
+	if old, ok := m.pendingOf[d]; ok {
+		m.deletePending(old)
+	}
+	m.pending[id] = *p
+	m.pendingOf[d] = id
+	i := sort.Search(len(m.expiries), func(i int) bool { return m.expiries[i].expires > p.Expires })
+	m.expiries = append(m.expiries, expiry{})
+	copy(m.expiries[i+1:], m.expiries[i:])
+	m.expiries[i] = expiry{p.Expires, id}
+	return http.StatusOK
+}
+
+// deletePending removes the registration pending under id, if any.
+// m.mu must be held.
+func (m *memory) deletePending(id string) {
+	p, ok := m.pending[id]
+	if !ok {
+		return
+	}
+	delete(m.pending, id)
+	if d := (device{p.UserID, p.DeviceID}); m.pendingOf[d] == id {
+		delete(m.pendingOf, d)
+	}
+}
+
+func (m *memory) TakePending(id string) (p *Pending, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending, ok := m.pending[id]
+	if !ok {
+		return nil, http.StatusNotFound
+	}
+	m.deletePending(id)
+	return &pending, http.StatusOK
+}
+
+func (m *memory) PutMapRoot(epoch uint64, root []byte) (status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.epoch, m.root = epoch, append([]byte(nil), root...)
+	return http.StatusOK
+}
+
+func (m *memory) MapRoot() (epoch uint64, root []byte, status int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.epoch == 0 {
+		return 0, nil, http.StatusNotFound
+	}
+	return m.epoch, m.root, http.StatusOK
+}
+
+func (m *memory) Owners(keyid string) (owners []Owner, status int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for d := range m.owners[keyid] {
+		owners = append(owners, Owner{UserID: d.userid, DeviceID: d.deviceid})
+	}
+	if len(owners) == 0 {
+		return nil, http.StatusNotFound
+	}
+	return owners, http.StatusOK
+}
+
+func (m *memory) Close() error {
+	return nil
+}
@@ -0,0 +1,319 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/square/go-jose"
+)
+
+const (
+	// How far apart our clock and the IdP's may be.
+	oidcSkew = time.Minute
+	// How often to look for new keys at a JWKS URL, and how often,
+	// at most, an unknown key ID makes us look early.
+	jwksMaxAge     = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// oidcAlgorithms are the signature algorithms accepted on ID tokens.
+var oidcAlgorithms = map[string]bool{
+	string(jose.RS256): true,
+	string(jose.ES256): true,
+}
+
+// An OIDCAuthenticator accepts OpenID Connect ID tokens, in an
+// "Authorization: Bearer" header, from a single issuer. The token's
+// verified email address is the principal.
+type OIDCAuthenticator struct {
+	issuer   string
+	audience string
+	keys     *jwks
+	now      func() time.Time
+}
+
+// NewOIDCAuthenticator returns an OIDCAuthenticator for ID tokens
+// from issuer, addressed to audience (the keyshop's client ID), and
+// signed by a key in the JWKS at keys, which is either a file name or
+// an http(s) URL. The JWKS is loaded now, and again whenever it
+// changes.
+func NewOIDCAuthenticator(issuer, audience, keys string) (*OIDCAuthenticator, error) {
+	if issuer == "" || audience == "" {
+		return nil, errors.New("oidc: issuer and audience are required")
+	}
+	k := &jwks{src: keys, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return &OIDCAuthenticator{issuer: issuer, audience: audience, keys: k, now: time.Now}, nil
+}
+
+type idClaims struct {
+	Audience      audience `json:"aud"`
+	Email         string   `json:"email"`
+	EmailVerified trueish  `json:"email_verified"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Issuer        string   `json:"iss"`
+	NotBefore     int64    `json:"nbf"`
+	Subject       string   `json:"sub"`
+}
+
+// audience is an "aud" claim, which may be a string or an array of
+// them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a audience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// trueish is a boolean claim; some IdPs send "true" as a string.
+type trueish bool
+
+func (t *trueish) UnmarshalJSON(b []byte) error {
+	switch string(b) {
+	case "true", `"true"`:
+		*t = true
+	default:
+		*t = false
+	}
+	return nil
+}
+
+// Authenticate implements Authenticator.
+func (a *OIDCAuthenticator) Authenticate(r *http.Request, forwrite bool) (*Principal, error) {
+	authz := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(authz) < len(prefix) || !strings.EqualFold(authz[:len(prefix)], prefix) {
+		return nil, ErrNoCredentials
+	}
+	claims, err := a.verify(strings.TrimSpace(authz[len(prefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %s", err)
+	}
+	return &Principal{UserID: claims.Email, Method: "oidc"}, nil
+}
+
+func (a *OIDCAuthenticator) verify(tok string) (*idClaims, error) {
+	if strings.Count(tok, ".") != 2 {
+		return nil, errors.New("malformed token")
+	}
+	obj, err := jose.ParseSigned(tok)
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	header := obj.Signatures[0].Header
+	if !oidcAlgorithms[header.Algorithm] {
+		return nil, fmt.Errorf("unacceptable algorithm %q", header.Algorithm)
+	}
+	var payload []byte
+	verified := false
+	for _, k := range a.keys.lookup(header.KeyID) {
+		if k.Algorithm != "" && k.Algorithm != header.Algorithm {
+			continue
+		}
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if payload, err = obj.Verify(k.Key); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("no key %q in the JWKS verifies the token", header.KeyID)
+	}
+
+	c := new(idClaims)
+	if err := json.Unmarshal(payload, c); err != nil {
+		return nil, err
+	}
+	now := a.now()
+	switch {
+	case c.Issuer != a.issuer:
+		return nil, fmt.Errorf("wrong issuer %q", c.Issuer)
+	case !c.Audience.contains(a.audience):
+		return nil, fmt.Errorf("wrong audience %q", c.Audience)
+	case c.Expiry == 0 || !now.Before(time.Unix(c.Expiry, 0).Add(oidcSkew)):
+		return nil, errors.New("expired")
+	case c.NotBefore != 0 && now.Add(oidcSkew).Before(time.Unix(c.NotBefore, 0)):
+		return nil, errors.New("not valid yet")
+	case c.IssuedAt != 0 && now.Add(oidcSkew).Before(time.Unix(c.IssuedAt, 0)):
+		return nil, errors.New("issued in the future")
+	case c.Email == "":
+		return nil, errors.New("no email address")
+	case !bool(c.EmailVerified):
+		return nil, fmt.Errorf("email address %s is not verified", c.Email)
+	}
+	return c, nil
+}
+
+// jwks is a JSON Web Key Set, loaded from a file or a URL, and
+// reloaded when it changes.
+type jwks struct {
+	src    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    []jose.JsonWebKey
+	modTime time.Time // of the file
+	loaded  time.Time // when we last looked at the source
+	// loading is closed when the reload in progress, if any, is
+	// done.
+	loading chan struct{}
+}
+
+func (k *jwks) isURL() bool {
+	return strings.HasPrefix(k.src, "https://") || strings.HasPrefix(k.src, "http://")
+}
+
+// load reads the JWKS from its source.
+func (k *jwks) load() error {
+	var b []byte
+	var modTime time.Time
+	if k.isURL() {
+		resp, err := k.client.Get(k.src)
+		if err != nil {
+			return fmt.Errorf("oidc: error fetching JWKS: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("oidc: error fetching JWKS: %s", resp.Status)
+		}
+		if b, err = ioutil.ReadAll(resp.Body); err != nil {
+			return fmt.Errorf("oidc: error fetching JWKS: %s", err)
+		}
+	} else {
+		fi, err := os.Stat(k.src)
+		if err != nil {
+			return fmt.Errorf("oidc: error reading JWKS: %s", err)
+		}
+		modTime = fi.ModTime()
+		if b, err = ioutil.ReadFile(k.src); err != nil {
+			return fmt.Errorf("oidc: error reading JWKS: %s", err)
+		}
+	}
+	var set struct {
+		Keys []jose.JsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return fmt.Errorf("oidc: error parsing JWKS: %s", err)
+	}
+	var keys []jose.JsonWebKey
+	for _, key := range set.Keys {
+		if key.IsPublic() {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("oidc: no public keys in JWKS " + k.src)
+	}
+	k.mu.Lock()
+	k.keys, k.modTime, k.loaded = keys, modTime, time.Now()
+	k.mu.Unlock()
+	glog.Infof("loaded %d keys from JWKS %s", len(keys), k.src)
+	return nil
+}
+
+// stale reports whether the JWKS should be reloaded before looking
+// for kid. The caller must hold k.mu.
+func (k *jwks) stale(kid string) bool {
+	age := time.Since(k.loaded)
+	if !k.isURL() {
+		// Stat'ing a file is cheap, but not free.
+		if age < time.Second {
+			return false
+		}
+		fi, err := os.Stat(k.src)
+		k.loaded = time.Now()
+		return err == nil && !fi.ModTime().Equal(k.modTime)
+	}
+	if age >= jwksMaxAge {
+		return true
+	}
+	return age >= jwksMinRefresh && len(k.find(kid)) == 0
+}
+
+// find returns the keys with kid; an empty kid matches every key.
+// The caller must hold k.mu.
+func (k *jwks) find(kid string) []jose.JsonWebKey {
+	var keys []jose.JsonWebKey
+	for _, key := range k.keys {
+		if kid == "" || key.KeyID == kid {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// lookup returns the keys that might have signed a token with kid,
+// reloading the JWKS first if it has changed. If reloading fails, the
+// keys we already have are kept.
+//
+// Only one reload runs at a time; lookups for kids we don't have wait
+// for it, and the rest don't. A reload counts from when it starts, so
+// tokens with made-up kids can't make us fetch the JWKS more than once
+// every jwksMinRefresh.
+func (k *jwks) lookup(kid string) []jose.JsonWebKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch {
+	case k.loading == nil && k.stale(kid):
+		k.loaded = time.Now()
+		done := make(chan struct{})
+		k.loading = done
+		k.mu.Unlock()
+		if err := k.load(); err != nil {
+			glog.Errorf("%s; keeping the keys we have", err)
+		}
+		k.mu.Lock()
+		k.loading = nil
+		close(done)
+	case k.loading != nil && len(k.find(kid)) == 0:
+		done := k.loading
+		k.mu.Unlock()
+		<-done
+		k.mu.Lock()
+	}
+	return k.find(kid)
+}
+
+// initOIDC adds an OIDCAuthenticator to the chain, if the config
+// names an ID token issuer.
+func (s *Server) initOIDC() error {
+	c := s.config
+	if c.OIDCIssuer == "" {
+		return nil
+	}
+	a, err := NewOIDCAuthenticator(c.OIDCIssuer, c.OIDCAudience, c.OIDCKeys)
+	if err != nil {
+		return err
+	}
+	glog.Infof("accepting ID tokens from %s", c.OIDCIssuer)
+	s.AddAuthenticator(a)
+	return nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testClientID = "keyshop-extension"
+)
+
+// testIdP mints ID tokens, and publishes its keys in a JWKS file.
+type testIdP struct {
+	t    *testing.T
+	fn   string
+	keys map[string]*jose.JsonWebKey // private keys, by key ID
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{t: t, fn: filepath.Join(t.TempDir(), "jwks.json"), keys: make(map[string]*jose.JsonWebKey)}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.keys["rsa1"] = &jose.JsonWebKey{Key: rsaKey, KeyID: "rsa1", Algorithm: "RS256", Use: "sig"}
+	idp.keys["ec1"] = &jose.JsonWebKey{Key: ecKey, KeyID: "ec1", Algorithm: "ES256", Use: "sig"}
+	idp.publish()
+	return idp
+}
+
+// publish writes the public half of every key to the JWKS file.
+func (idp *testIdP) publish() {
+	var set struct {
+		Keys []jose.JsonWebKey `json:"keys"`
+	}
+	for _, k := range idp.keys {
+		pub := *k
+		switch priv := k.Key.(type) {
+		case *rsa.PrivateKey:
+			pub.Key = &priv.PublicKey
+		case *ecdsa.PrivateKey:
+			pub.Key = &priv.PublicKey
+		}
+		set.Keys = append(set.Keys, pub)
+	}
+	b, err := json.Marshal(&set)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(idp.fn, b, 0644); err != nil {
+		idp.t.Fatal(err)
+	}
+	// Make sure the change is visible, however coarse the file
+	// system's timestamps.
+	later := time.Now().Add(time.Duration(len(idp.keys)) * time.Minute)
+	os.Chtimes(idp.fn, later, later)
+}
+
+func (idp *testIdP) mint(kid string, claims map[string]interface{}) string {
+	k := idp.keys[kid]
+	signer, err := jose.NewSigner(jose.SignatureAlgorithm(k.Algorithm), k)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	tok, err := obj.CompactSerialize()
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return tok
+}
+
+func idClaimsFor(email string) map[string]interface{} {
+	now := time.Now().Unix()
+	return map[string]interface{}{
+		"iss":            testIssuer,
+		"aud":            testClientID,
+		"sub":            "12345",
+		"email":          email,
+		"email_verified": true,
+		"iat":            now,
+		"exp":            now + 600,
+	}
+}
+
+func authenticateWith(a Authenticator, tok string) (*Principal, error) {
+	r := httptest.NewRequest("GET", "/v1/k/alice@example.com", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	return a.Authenticate(r, true)
+}
+
+func TestOIDC(t *testing.T) {
+	idp := newTestIdP(t)
+	a, err := NewOIDCAuthenticator(testIssuer, testClientID, idp.fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kid := range []string{"rsa1", "ec1"} {
+		p, err := authenticateWith(a, idp.mint(kid, idClaimsFor("alice@example.com")))
+		if err != nil {
+			t.Fatalf("%s: %s", kid, err)
+		}
+		if p.UserID != "alice@example.com" {
+			t.Fatalf("%s: got principal %+v", kid, p)
+		}
+	}
+
+	bad := map[string]func(c map[string]interface{}){
+		"wrong issuer":         func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong audience":       func(c map[string]interface{}) { c["aud"] = []string{"someone-else"} },
+		"expired":              func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":            func(c map[string]interface{}) { delete(c, "exp") },
+		"unverified email":     func(c map[string]interface{}) { c["email_verified"] = false },
+		"no email_verified":    func(c map[string]interface{}) { delete(c, "email_verified") },
+		"no email":             func(c map[string]interface{}) { delete(c, "email") },
+		"issued in the future": func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() },
+	}
+	for name, mutate := range bad {
+		c := idClaimsFor("alice@example.com")
+		mutate(c)
+		if _, err := authenticateWith(a, idp.mint("rsa1", c)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	if _, err := authenticateWith(a, "not-a-token"); err == nil {
+		t.Errorf("garbage: accepted")
+	}
+	r := httptest.NewRequest("GET", "/v1/k/alice@example.com", nil)
+	if _, err := a.Authenticate(r, false); err != ErrNoCredentials {
+		t.Errorf("no Authorization header: got %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestOIDCRejectsHMAC(t *testing.T) {
+	idp := newTestIdP(t)
+	a, err := NewOIDCAuthenticator(testIssuer, testClientID, idp.fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.HS256, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(idClaimsFor("alice@example.com"))
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, _ := obj.CompactSerialize()
+	if _, err := authenticateWith(a, tok); err == nil {
+		t.Fatalf("HS256 ID token accepted")
+	}
+}
+
+func TestOIDCReload(t *testing.T) {
+	idp := newTestIdP(t)
+	a, err := NewOIDCAuthenticator(testIssuer, testClientID, idp.fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.keys["ec2"] = &jose.JsonWebKey{Key: ecKey, KeyID: "ec2", Algorithm: "ES256"}
+	tok := idp.mint("ec2", idClaimsFor("alice@example.com"))
+
+	// Pretend we last looked a while ago.
+	a.keys.loaded = time.Now().Add(-time.Hour)
+	if _, err := authenticateWith(a, tok); err == nil {
+		t.Fatalf("token signed with an unpublished key accepted")
+	}
+	idp.publish()
+	a.keys.loaded = time.Now().Add(-time.Hour)
+	if _, err := authenticateWith(a, tok); err != nil {
+		t.Fatalf("token signed with a newly published key: %s", err)
+	}
+}
+
+func TestOIDCReloadsOnce(t *testing.T) {
+	idp := newTestIdP(t)
+	var fetches int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		http.ServeFile(w, r, idp.fn)
+	}))
+	defer srv.Close()
+	a, err := NewOIDCAuthenticator(testIssuer, testClientID, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens with kids we don't have, all at once, make one fetch.
+	a.keys.loaded = time.Now().Add(-time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a.keys.lookup(fmt.Sprintf("unknown%d", i))
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("%d fetches of the JWKS, want 2", n)
+	}
+	// Nor can more of them make another one straight away.
+	a.keys.lookup("unknown")
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("%d fetches of the JWKS, want 2", n)
+	}
+}
+
+func TestServerOIDC(t *testing.T) {
+	idp := newTestIdP(t)
+	c := DefaultConfig()
+	c.OIDCIssuer, c.OIDCAudience, c.OIDCKeys = testIssuer, testClientID, idp.fn
+	s, _ := testServerWith(t, c)
+	r := httptest.NewRequest("GET", "/v1/k/alice@example.com", nil)
+	r.Header.Set("Authorization", "Bearer "+idp.mint("ec1", idClaimsFor("bob@example.com")))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("GET with an ID token: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
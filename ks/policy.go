@@ -0,0 +1,250 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/golang/glog"
+)
+
+// Codes for the errors that a Policy rejects requests with.
+const (
+	CodeInvalidUserID    = "invalid_userid"
+	CodeDomainNotServed  = "domain_not_served"
+	CodeLocalPartRefused = "local_part_not_allowed"
+	CodeDenied           = "denied"
+	CodeTooManyDevices   = "too_many_devices"
+)
+
+// A Policy decides which userids a keyshop serves. It is loaded from
+// a JSON file, e.g.:
+//
+//	{
+//	  "domains": ["example.com", "example.org"],
+//	  "local_part": "[a-z][a-z0-9.]{2,63}",
+//	  "max_devices": 8,
+//	  "deny": ["root@example.com", "@lists.example.com"],
+//	  "keys": {"algorithms": ["ecdh", "ecdsa"]}
+//	}
+//
+// An empty Policy serves any well-formed email address, and only
+// accepts OpenPGP keys unless it lists other types. A keyshop run
+// without a policy file uses an empty one.
+type Policy struct {
+	// Domains are the email domains that are served. If empty,
+	// every domain is.
+	Domains []string `json:"domains"`
+	// LocalPart, if set, is a regular expression that the part of
+	// the address before the @ has to match in full.
+	LocalPart string `json:"local_part"`
+	// MaxDevices is the most devices a user may register keys
+	// for; 0 means there is no limit.
+	MaxDevices int `json:"max_devices"`
+	// Deny lists addresses that are refused, whatever else the
+	// policy says. An entry starting with @ refuses a whole domain.
+	Deny []string `json:"deny"`
+	// Types are the types of key that may be registered, e.g.
+	// KeyTypePGP. If empty, only OpenPGP keys are.
+	Types []string `json:"types"`
+	// Keys limits the OpenPGP keys that may be registered. Other
+	// types of key can't be checked against it, so a policy that
+	// sets it may only accept OpenPGP keys.
+	Keys KeyPolicy `json:"keys"`
+
+	localPart *regexp.Regexp
+	domains   map[string]bool
+	deny      map[string]bool
+	types     map[string]bool
+}
+
+// LoadPolicy reads a Policy from a JSON file.
+func LoadPolicy(fn string) (*Policy, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Policy)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("error parsing policy %s: %s", fn, err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("error in policy %s: %s", fn, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) compile() error {
+	if p.LocalPart != "" {
+		// Go's regexps aren't anchored by default.
+		re, err := regexp.Compile(`^(?:` + p.LocalPart + `)$`)
+		if err != nil {
+			return err
+		}
+		p.localPart = re
+	}
+	if p.MaxDevices < 0 {
+		return fmt.Errorf("negative max_devices")
+	}
+	if len(p.Types) == 0 {
+		p.Types = []string{KeyTypePGP}
+	}
+	p.types = make(map[string]bool)
+	for _, t := range p.Types {
+		if keyTypes[t] == nil {
+			return fmt.Errorf("unknown key type %q", t)
+		}
+		if t != KeyTypePGP && p.Keys.limited() {
+			return fmt.Errorf("keys only limits OpenPGP keys, so types can't include %q", t)
+		}
+		p.types[t] = true
+	}
+	if err := p.Keys.compile(); err != nil {
+		return err
+	}
+	p.domains = make(map[string]bool)
+	for _, d := range p.Domains {
+		p.domains[strings.ToLower(d)] = true
+	}
+	p.deny = make(map[string]bool)
+	for _, d := range p.Deny {
+		p.deny[strings.ToLower(d)] = true
+	}
+	return nil
+}
+
+// splitAddress splits an email address into its local part and its
+// domain, if it looks like one.
+func splitAddress(userid string) (local, domain string, ok bool) {
+	at := strings.LastIndex(userid, "@")
+	if at <= 0 || at == len(userid)-1 || len(userid) > 254 {
+		return "", "", false
+	}
+	for _, r := range userid {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "", "", false
+		}
+	}
+	local, domain = userid[:at], userid[at+1:]
+	if strings.Contains(local, "@") || !strings.Contains(domain, ".") {
+		return "", "", false
+	}
+	return local, domain, true
+}
+
+// CheckUser returns an Error if userid isn't served.
+func (p *Policy) CheckUser(userid string) *Error {
+	local, domain, ok := splitAddress(userid)
+	if !ok {
+		return &Error{Code: CodeInvalidUserID, Message: fmt.Sprintf("%q is not an email address", userid)}
+	}
+	domain = strings.ToLower(domain)
+	if p.deny[strings.ToLower(userid)] || p.deny["@"+domain] {
+		return &Error{Code: CodeDenied, Message: fmt.Sprintf("%s is not served here", userid)}
+	}
+	if len(p.domains) > 0 && !p.domains[domain] {
+		return &Error{Code: CodeDomainNotServed, Message: fmt.Sprintf("addresses @%s are not served here", domain)}
+	}
+	if p.localPart != nil && !p.localPart.MatchString(local) {
+		return &Error{Code: CodeLocalPartRefused, Message: fmt.Sprintf("%q is not an acceptable name before the @", local)}
+	}
+	return nil
+}
+
+// CheckKey returns an Error if pk may not be registered.
+func (p *Policy) CheckKey(pk *parsedKey) *Error {
+	if p.types != nil && !p.types[pk.Type] {
+		return &Error{
+			Code:    CodeKeyTypeRefused,
+			Message: fmt.Sprintf("%s keys are not accepted here; %s are", pk.Type, strings.Join(p.Types, ", ")),
+		}
+	}
+	if pk.entity != nil {
+		return p.Keys.CheckKey(pk.entity)
+	}
+	return nil
+}
+
+// CheckDevices returns an Error if a user who has keys for devices
+// may not register one for deviceid.
+func (p *Policy) CheckDevices(devices map[string]string, deviceid string) *Error {
+	if p.MaxDevices == 0 {
+		return nil
+	}
+	if _, ok := devices[deviceid]; ok || len(devices) < p.MaxDevices {
+		return nil
+	}
+	return &Error{
+		Code:    CodeTooManyDevices,
+		Message: fmt.Sprintf("at most %d devices may be registered; revoke one first", p.MaxDevices),
+	}
+}
+
+// allowUser writes a 403 and returns false if the policy doesn't
+// serve userid.
+func (s *Server) allowUser(w http.ResponseWriter, userid string) bool {
+	if e := s.policy.CheckUser(userid); e != nil {
+		glog.Infof("policy: %s: %s", userid, e.Message)
+		writeError(w, http.StatusForbidden, e)
+		return false
+	}
+	return true
+}
+
+// allowDevice writes a 403 and returns false if the policy doesn't let
+// userid register a key for deviceid.
+func (s *Server) allowDevice(w http.ResponseWriter, userid, deviceid string) bool {
+	status, e := s.checkDevices(userid, deviceid)
+	if e != nil {
+		writeError(w, status, e)
+		return false
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return false
+	}
+	return true
+}
+
+// checkDevices returns a 403 and an Error if the policy doesn't let
+// userid register a key for deviceid, and the store's status if it
+// can't tell.
+func (s *Server) checkDevices(userid, deviceid string) (status int, e *Error) {
+	keys, status := s.store.Get(userid)
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return status, nil
+	}
+	if e := s.policy.CheckDevices(keys, deviceid); e != nil {
+		glog.Infof("policy: %s/%s: %s", userid, deviceid, e.Message)
+		return http.StatusForbidden, e
+	}
+	return http.StatusOK, nil
+}
+
+// initPolicy loads the policy named in the config, if any.
+func (s *Server) initPolicy() error {
+	fn := s.config.PolicyFn
+	if fn == "" {
+		// Compiled like a loaded one, so that no policy file
+		// behaves the same as an empty one.
+		p := new(Policy)
+		if err := p.compile(); err != nil {
+			return err
+		}
+		s.policy = p
+		return nil
+	}
+	p, err := LoadPolicy(fn)
+	if err != nil {
+		return err
+	}
+	glog.Infof("loaded registration policy from %s", fn)
+	s.policy = p
+	return nil
+}
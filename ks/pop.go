@@ -0,0 +1,152 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/yahoo/keyshop/yenc"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Proof of possession: before registering a key, the client GETs a
+// Challenge, and makes a detached OpenPGP signature, with the key
+// being registered, over
+//
+//	keyshop-pop:<nonce>:<FINGERPRINT>
+//
+// where FINGERPRINT is the key's fingerprint in upper-case hex. The
+// nonce and the signature go in the POST's popNonceHeader and
+// popSignatureHeader headers; the signature is base64url-encoded,
+// like the key.
+const (
+	popNonceHeader     = "X-Keyshop-Nonce"
+	popSignatureHeader = "X-Keyshop-Signature"
+	// How long a nonce may be used for, and how many may be
+	// outstanding at once.
+	challengeTTL    = 5 * time.Minute
+	maxChallenges   = 1 << 16
+	maxSignatureLen = 4096
+)
+
+// popMessage returns what the client signs to prove that it holds the
+// private key for fingerprint.
+func popMessage(nonce string, fingerprint [20]byte) []byte {
+	return []byte(fmt.Sprintf("keyshop-pop:%s:%X", nonce, fingerprint))
+}
+
+type challenge struct {
+	userid  string
+	expires time.Time
+}
+
+// challenges holds the nonces that have been handed out, but not yet
+// used. Each can be used once, by the user it was issued to.
+type challenges struct {
+	mu     sync.Mutex
+	nonces map[string]challenge
+}
+
+func newChallenges() *challenges {
+	return &challenges{nonces: make(map[string]challenge)}
+}
+
+var errTooManyChallenges = errors.New("too many outstanding challenges")
+
+func (c *challenges) issue(userid string) (nonce string, expires time.Time, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", expires, err
+	}
+	nonce = yenc.RawURL64.EncodeToString(b)
+	now := time.Now()
+	expires = now.Add(challengeTTL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.nonces) >= maxChallenges {
+		for n, ch := range c.nonces {
+			if now.After(ch.expires) {
+				delete(c.nonces, n)
+			}
+		}
+		if len(c.nonces) >= maxChallenges {
+			return "", expires, errTooManyChallenges
+		}
+	}
+	c.nonces[nonce] = challenge{userid: userid, expires: expires}
+	return nonce, expires, nil
+}
+
+// redeem uses up nonce, and reports whether it was issued to userid
+// and is still good.
+func (c *challenges) redeem(nonce, userid string) bool {
+	c.mu.Lock()
+	ch, ok := c.nonces[nonce]
+	delete(c.nonces, nonce)
+	c.mu.Unlock()
+	return ok && ch.userid == userid && time.Now().Before(ch.expires)
+}
+
+// GET /v1/challenge/<userid>
+// Returns:
+//   200 StatusOK                : The body is a Challenge, good for one POST by userid
+//   401 StatusUnauthorized      : If the requester isn't authenticated
+//   403 StatusForbidden         : If the requester isn't userid, or the policy doesn't serve them
+//   503 StatusServiceUnavailable: If too many challenges are outstanding
+func (s *Server) challenge(w http.ResponseWriter, r *http.Request) {
+	userid := mux.Vars(r)["userid"]
+	if !requireSelf(w, r, userid) || !s.allowUser(w, userid) {
+		return
+	}
+	nonce, expires, err := s.challenges.issue(userid)
+	switch err {
+	case nil:
+	case errTooManyChallenges:
+		glog.Warningf("challenge: %s", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+		glog.Errorf("error issuing challenge: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &Challenge{Nonce: nonce, Expires: expires.UTC().Unix()})
+}
+
+// checkPossession checks that the POST r, by userid, proves that its
+// sender holds the private half of e.
+func (s *Server) checkPossession(r *http.Request, userid string, e *openpgp.Entity) error {
+	nonce := r.Header.Get(popNonceHeader)
+	encSig := strings.TrimSpace(r.Header.Get(popSignatureHeader))
+	if nonce == "" || encSig == "" {
+		return errors.New("no proof of possession")
+	}
+	if !s.challenges.redeem(nonce, userid) {
+		return errors.New("unknown, used or expired nonce")
+	}
+	if len(encSig) > maxSignatureLen {
+		return errors.New("signature too long")
+	}
+	sig, err := yenc.RawURL64.DecodeString(encSig)
+	if err != nil {
+		return fmt.Errorf("invalid base64 in signature: %s", err)
+	}
+	msg := popMessage(nonce, e.PrimaryKey.Fingerprint)
+	signer, err := openpgp.CheckDetachedSignature(openpgp.EntityList{e}, bytes.NewReader(msg), bytes.NewReader(sig))
+	if err != nil {
+		return fmt.Errorf("bad signature: %s", err)
+	}
+	if signer != e {
+		return errors.New("signed by another key")
+	}
+	return nil
+}
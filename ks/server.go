@@ -0,0 +1,220 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/yahoo/keyshop/ks/kauth"
+	"github.com/yahoo/keyshop/ks/tlog"
+)
+
+// An Authority signs statements on behalf of the keyshop.
+// *kauth.Kauth is the usual implementation; *kauth.Remote asks
+// kauthd, which keeps the private key out of the keyshop's process.
+type Authority interface {
+	Sign(msg []byte) ([]byte, error)
+}
+
+// A Server is a single keyshop: its configuration, its store, and
+// the key authority that signs its answers. It serves the /v1/k API.
+type Server struct {
+	config *Config
+	store  KeyShop
+	ka     Authority
+	log    *tlog.Log
+	sth    signedHead
+	dir    *directory
+	auth   []Authenticator
+	mailer Mailer
+	policy *Policy
+	// Nonces for proof of possession.
+	challenges *challenges
+	router     *mux.Router
+}
+
+// NewServer opens the store and the key authority described by c,
+// and returns a Server using them.
+func NewServer(c *Config) (*Server, error) {
+	glog.Infof("initializing %s storage", c.Backend)
+	store, err := OpenStore(c)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open %s keystore at %s: %s", c.Backend, c.DbFn, err)
+	}
+	ka, err := openKauth(c)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	log := tlog.NewMemory()
+	if c.Backend != "memory" && c.LogFn != "" {
+		glog.Infof("opening transparency log at %s", c.LogFn)
+		if log, err = tlog.Open(c.LogFn); err != nil {
+			closeKauth(ka)
+			store.Close()
+			return nil, fmt.Errorf("couldn't open transparency log at %s: %s", c.LogFn, err)
+		}
+	}
+	s, err := newServer(c, store, ka, log)
+	if err != nil {
+		closeKauth(ka)
+		log.Close()
+		store.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openKauth returns the key authority described by c: kauthd, if c
+// names its socket, and otherwise the stub in this process.
+func openKauth(c *Config) (Authority, error) {
+	if c.KauthAddr != "" {
+		glog.Infof("connecting to kauthd at %s", c.KauthAddr)
+		secret, err := ioutil.ReadFile(c.KauthSecretFn)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kauthd secret: %s", err)
+		}
+		ka, err := kauth.Dial(c.KauthAddr, secret)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to kauthd: %s", err)
+		}
+		return ka, nil
+	}
+	glog.Infof("initializing stub key authority")
+	b, err := ioutil.ReadFile(c.KauthFn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading kauth PEM file: %s", err)
+	}
+	ka, err := kauth.New(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing kauth PEM file: %s", err)
+	}
+	return ka, nil
+}
+
+// NewServerWith returns a Server using an already opened store and
+// key authority. Its transparency log is kept in memory.
+func NewServerWith(c *Config, store KeyShop, ka Authority) (*Server, error) {
+	return newServer(c, store, ka, tlog.NewMemory())
+}
+
+func newServer(c *Config, store KeyShop, ka Authority, log *tlog.Log) (*Server, error) {
+	s := &Server{
+		config:     c,
+		store:      store,
+		ka:         ka,
+		log:        log,
+		mailer:     newMailer(c),
+		challenges: newChallenges(),
+		router:     mux.NewRouter(),
+	}
+	if err := s.initTokens(); err != nil {
+		return nil, err
+	}
+	if err := s.initClientCerts(); err != nil {
+		return nil, err
+	}
+	if err := s.initOIDC(); err != nil {
+		return nil, err
+	}
+	if err := s.initPolicy(); err != nil {
+		return nil, err
+	}
+	if err := s.initDirectory(); err != nil {
+		return nil, err
+	}
+	s.routes()
+	return s, nil
+}
+
+func (s *Server) routes() {
+	r := s.router.PathPrefix("/v1/k").Subrouter()
+	// GET /v1/k/{userid} returns the signed UKeys for a user.
+	r.HandleFunc("/{userid}", s.requireAuth(s.get, false)).Methods("GET")
+	// POST /v1/k/{userid}/{deviceid}
+	// The body of the request is the key to associate with
+	// this user's device {deviceid}
+	// It requires that
+	//    {userid}
+	//    the authenticated principal
+	//    body.userid
+	// are identical.
+	r.HandleFunc("/{userid}/{deviceid}", s.requireAuth(s.post, true)).Methods("POST")
+	// DELETE /v1/k/{userid}/{deviceid} revokes the key for the
+	// device, and returns a signed Revocation.
+	r.HandleFunc("/{userid}/{deviceid}", s.requireAuth(s.del, true)).Methods("DELETE")
+	// GET /v1/k/{userid}/{deviceid}/history returns the signed
+	// KeyHistory for the device.
+	r.HandleFunc("/{userid}/{deviceid}/history", s.requireAuth(s.history, false)).Methods("GET")
+
+	// GET /v1/fp/{fingerprint} returns the signed KeyOwners of an
+	// OpenPGP fingerprint or key ID.
+	s.router.HandleFunc("/v1/fp/{fingerprint}", s.requireAuth(s.owners, false)).Methods("GET")
+
+	// GET /v1/challenge/{userid} returns a Challenge, whose nonce
+	// the user signs with a key to prove they hold it. It isn't
+	// under /v1/k, where it would clash with a device named
+	// "challenge".
+	s.router.HandleFunc("/v1/challenge/{userid}", s.requireAuth(s.challenge, true)).Methods("GET")
+
+	// GET /v1/confirm/{token} registers the key that was held
+	// until its user followed the link mailed to them. The token
+	// is the only credential needed.
+	s.router.HandleFunc("/v1/confirm/{token}", s.confirm).Methods("GET")
+
+	// The transparency log is public, so none of these require
+	// authentication.
+	l := s.router.PathPrefix("/v1/log").Subrouter()
+	// GET /v1/log/sth returns a TreeHead for the log's current
+	// size, signed when the log grew to it.
+	l.HandleFunc("/sth", s.treeHead).Methods("GET")
+	// GET /v1/log/inclusion?hash={leafhash}&size={treesize}
+	// returns an InclusionProof for a logged DKey.
+	l.HandleFunc("/inclusion", s.inclusion).Methods("GET")
+	// GET /v1/log/consistency?first={size}&second={size}
+	// returns a ConsistencyProof between two tree heads.
+	l.HandleFunc("/consistency", s.consistency).Methods("GET")
+
+	// GET /v1/map/root returns the signed MapRoot for the latest
+	// epoch of the key directory. It is public, too.
+	s.router.HandleFunc("/v1/map/root", s.mapRoot).Methods("GET")
+
+	// GET /.well-known/jwks.json returns the kauth's keys, by
+	// kid, so that anyone can check what it signed.
+	s.router.HandleFunc("/.well-known/jwks.json", s.jwks).Methods("GET")
+
+	s.wkdRoutes()
+	s.hkpRoutes()
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Close stops publishing epochs, and closes the server's store and
+// transparency log, and its connection to the kauth, if it has one.
+func (s *Server) Close() error {
+	s.closeDirectory()
+	err := s.log.Close()
+	if serr := s.store.Close(); serr != nil {
+		err = serr
+	}
+	if kerr := closeKauth(s.ka); kerr != nil {
+		err = kerr
+	}
+	return err
+}
+
+// closeKauth closes ka's connection to kauthd, if it has one.
+func closeKauth(ka Authority) error {
+	if c, ok := ka.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
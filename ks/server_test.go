@@ -0,0 +1,1238 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose"
+	"github.com/yahoo/keyshop/ks/kauth"
+	"github.com/yahoo/keyshop/ks/tlog"
+	"github.com/yahoo/keyshop/ks/token"
+	"github.com/yahoo/keyshop/yenc"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// testServer returns a Server using an in-memory store and a freshly
+// generated key authority, along with the authority's public key.
+// Everyone is who they say they are.
+func testServer(t *testing.T) (*Server, *ecdsa.PublicKey) {
+	c := DefaultConfig()
+	c.SkipAuth = true
+	return testServerWith(t, c)
+}
+
+// testServerWith is testServer with the given configuration.
+func testServerWith(t *testing.T, c *Config) (*Server, *ecdsa.PublicKey) {
+	ka, pub := testKauth(t)
+	c.Backend = "memory"
+	s, err := NewServerWith(c, newMemory(), ka)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, pub
+}
+
+// testKauth returns a freshly generated key authority, and its public
+// key.
+func testKauth(t *testing.T) (*kauth.Kauth, *ecdsa.PublicKey) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka, err := kauth.New(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ka, &priv.PublicKey
+}
+
+// testEntity returns a new OpenPGP key, with its private key, with a
+// single UID for email.
+func testEntity(t *testing.T, email string) *openpgp.Entity {
+	e, err := openpgp.NewEntity("", "", email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// testKey returns a binary OpenPGP key with a single UID for email.
+func testKey(t *testing.T, email string) []byte {
+	return serializeKey(t, testEntity(t, email))
+}
+
+// serializeKey returns the public half of e, in binary.
+func serializeKey(t *testing.T, e *openpgp.Entity) []byte {
+	var buf bytes.Buffer
+	if err := e.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// do sends a request to s, and returns the response.
+func do(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// verify checks that a response body is a JWS signed by pub, and
+// unmarshals its payload into v.
+func verify(t *testing.T, pub *ecdsa.PublicKey, body []byte, v interface{}) {
+	obj, err := jose.ParseSigned(string(body))
+	if err != nil {
+		t.Fatalf("parsing JWS %q: %s", body, err)
+	}
+	payload, err := obj.Verify(pub)
+	if err != nil {
+		t.Fatalf("verifying JWS: %s", err)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		t.Fatalf("unmarshalling %s: %s", payload, err)
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	s, pub := testServer(t)
+	const userid = "alice@example.com"
+
+	w := do(s, "GET", "/v1/k/"+userid, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("GET before POST: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	var ukeys UKeys
+	verify(t, pub, w.Body.Bytes(), &ukeys)
+	if ukeys.UserID != userid || len(ukeys.Keys) != 0 {
+		t.Fatalf("GET before POST: got %+v", ukeys)
+	}
+
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	w = do(s, "POST", "/v1/k/"+userid+"/laptop", key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	var dkey DKey
+	dkeyJWS := w.Body.Bytes()
+	verify(t, pub, dkeyJWS, &dkey)
+	if dkey.UserID != userid || dkey.DeviceID != "laptop" || dkey.Key != key {
+		t.Fatalf("POST: got %+v", dkey)
+	}
+
+	w = do(s, "GET", "/v1/k/"+userid, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d", w.Code)
+	}
+	verify(t, pub, w.Body.Bytes(), &ukeys)
+	if _, ok := ukeys.Keys["laptop"]; !ok || len(ukeys.Keys) != 1 {
+		t.Fatalf("GET: got %+v", ukeys)
+	}
+
+	w = do(s, "DELETE", "/v1/k/"+userid+"/laptop", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE: got %d", w.Code)
+	}
+	var rev Revocation
+	verify(t, pub, w.Body.Bytes(), &rev)
+	if !rev.Revoked || rev.UserID != userid || rev.DeviceID != "laptop" {
+		t.Fatalf("DELETE: got %+v", rev)
+	}
+
+	if w = do(s, "DELETE", "/v1/k/"+userid+"/laptop", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("second DELETE: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w = do(s, "GET", "/v1/k/"+userid, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w = do(s, "GET", "/v1/k/"+userid+"/laptop/history", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET history: got %d", w.Code)
+	}
+	var history KeyHistory
+	verify(t, pub, w.Body.Bytes(), &history)
+	if len(history.Entries) != 2 || history.Entries[0].DKey != string(dkeyJWS) ||
+		history.Entries[1].DKey != "" {
+		t.Fatalf("GET history: got %+v", history)
+	}
+	var revoked Revocation
+	verify(t, pub, []byte(history.Entries[1].Revocation), &revoked)
+	if revoked != rev {
+		t.Fatalf("GET history: revocation %+v, want %+v", revoked, rev)
+	}
+}
+
+func TestServerRejectsMismatchedKey(t *testing.T) {
+	s, _ := testServer(t)
+	key := yenc.RawURL64.EncodeToString(testKey(t, "mallory@example.com"))
+	if w := do(s, "POST", "/v1/k/alice@example.com/laptop", key); w.Code != http.StatusUnauthorized {
+		t.Fatalf("POST of another user's key: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	a, _ := testServer(t)
+	b, _ := testServer(t)
+	const userid = "alice@example.com"
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	if w := do(a, "POST", "/v1/k/"+userid+"/laptop", key); w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	if w := do(b, "GET", "/v1/k/"+userid, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET on the other server: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestServerLogsDKeys(t *testing.T) {
+	s, pub := testServer(t)
+	const userid = "alice@example.com"
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	w := do(s, "POST", "/v1/k/"+userid+"/laptop", key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	leaf := yenc.RawURL64.EncodeToString(tlog.LeafHash(w.Body.Bytes()))
+
+	var sth TreeHead
+	signed := do(s, "GET", "/v1/log/sth", "").Body.Bytes()
+	verify(t, pub, signed, &sth)
+	if sth.TreeSize != 1 {
+		t.Fatalf("STH: got %+v", sth)
+	}
+	root, _ := yenc.RawURL64.DecodeString(sth.RootHash)
+	// ECDSA signatures are randomized, so only the same signature
+	// is byte for byte the same.
+	if again := do(s, "GET", "/v1/log/sth", "").Body.Bytes(); !bytes.Equal(again, signed) {
+		t.Fatalf("the tree head was signed again without the log growing")
+	}
+
+	w = do(s, "GET", "/v1/log/inclusion?hash="+leaf, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("inclusion: got %d", w.Code)
+	}
+	var proof InclusionProof
+	if err := json.Unmarshal(w.Body.Bytes(), &proof); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := yenc.RawURL64.DecodeString(leaf)
+	if !tlog.VerifyInclusion(raw, proof.LeafIndex, proof.TreeSize, decodeHashes(t, proof.AuditPath), root) {
+		t.Fatalf("inclusion proof %+v did not verify against %+v", proof, sth)
+	}
+
+	if w = do(s, "GET", "/v1/log/consistency?first=2", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("consistency past the end of the log: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func decodeHashes(t *testing.T, enc []string) [][]byte {
+	hashes := make([][]byte, len(enc))
+	for i, e := range enc {
+		h, err := yenc.RawURL64.DecodeString(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[i] = h
+	}
+	return hashes
+}
+
+// verifyUKeys checks the directory proof in ukeys against its signed
+// MapRoot, and returns the root's epoch.
+func verifyUKeys(t *testing.T, pub *ecdsa.PublicKey, ukeys *UKeys) uint64 {
+	var root MapRoot
+	verify(t, pub, []byte(ukeys.Root), &root)
+	hash, err := yenc.RawURL64.DecodeString(root.RootHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyMapProof(ukeys.Proof, hash, ukeys.UserID, ukeys.Keys); err != nil {
+		t.Fatalf("directory proof for %s did not verify: %s", ukeys.UserID, err)
+	}
+	return root.Epoch
+}
+
+func TestServerDirectoryProofs(t *testing.T) {
+	s, pub := testServer(t)
+	const userid = "alice@example.com"
+
+	var ukeys UKeys
+	verify(t, pub, do(s, "GET", "/v1/k/"+userid, "").Body.Bytes(), &ukeys)
+	first := verifyUKeys(t, pub, &ukeys)
+
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	if w := do(s, "POST", "/v1/k/"+userid+"/laptop", key); w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	verify(t, pub, do(s, "GET", "/v1/k/"+userid, "").Body.Bytes(), &ukeys)
+	if epoch := verifyUKeys(t, pub, &ukeys); epoch <= first {
+		t.Fatalf("epoch did not advance after POST: %d, then %d", first, epoch)
+	}
+
+	// The same proof must not verify for a different key set.
+	ukeys.Keys["phone"] = ukeys.Keys["laptop"]
+	var root MapRoot
+	verify(t, pub, []byte(ukeys.Root), &root)
+	hash, _ := yenc.RawURL64.DecodeString(root.RootHash)
+	if err := VerifyMapProof(ukeys.Proof, hash, userid, ukeys.Keys); err == nil {
+		t.Fatalf("directory proof verified for the wrong keys")
+	}
+
+	var latest MapRoot
+	verify(t, pub, do(s, "GET", "/v1/map/root", "").Body.Bytes(), &latest)
+	if latest.Epoch != root.Epoch || latest.RootHash != root.RootHash {
+		t.Fatalf("latest root %+v, but GET used %+v", latest, root)
+	}
+}
+
+func TestServerDirectoryEpochsSurviveRestart(t *testing.T) {
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.Backend = "bolt"
+	c.DbFn = filepath.Join(t.TempDir(), "ks.db")
+	ka, pub := testKauth(t)
+	open := func() *Server {
+		store, err := OpenStore(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewServerWith(c, store, ka)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	const userid = "alice@example.com"
+
+	s := open()
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	if w := do(s, "POST", "/v1/k/"+userid+"/laptop", key); w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	var before MapRoot
+	verify(t, pub, do(s, "GET", "/v1/map/root", "").Body.Bytes(), &before)
+	s.Close()
+
+	s = open()
+	defer s.Close()
+	var after MapRoot
+	verify(t, pub, do(s, "GET", "/v1/map/root", "").Body.Bytes(), &after)
+	if after.Epoch <= before.Epoch {
+		t.Fatalf("epoch went from %d to %d over a restart", before.Epoch, after.Epoch)
+	}
+	if after.RootHash != before.RootHash {
+		t.Fatalf("root hash changed over a restart")
+	}
+}
+
+// unpublishable is a store that fails to store map roots while fail
+// is set.
+type unpublishable struct {
+	KeyShop
+	fail bool
+}
+
+func (u *unpublishable) PutMapRoot(epoch uint64, root []byte) int {
+	if u.fail {
+		return http.StatusInternalServerError
+	}
+	return u.KeyShop.PutMapRoot(epoch, root)
+}
+
+func TestServerDirectoryPublishFails(t *testing.T) {
+	c := DefaultConfig()
+	c.SkipAuth = true
+	ka, pub := testKauth(t)
+	store := &unpublishable{KeyShop: newMemory()}
+	s, err := NewServerWith(c, store, ka)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	const userid = "alice@example.com"
+
+	store.fail = true
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	if w := do(s, "POST", "/v1/k/"+userid+"/laptop", key); w.Code != http.StatusInternalServerError {
+		t.Fatalf("POST that couldn't be published: got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	// The key is stored, but no proof of it could verify.
+	if w := do(s, "GET", "/v1/k/"+userid, ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET before publishing: got %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	store.fail = false
+	s.dir.mu.Lock()
+	err = s.publishLocked()
+	s.dir.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := do(s, "GET", "/v1/k/"+userid, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET after publishing: got %d", w.Code)
+	}
+	var ukeys UKeys
+	verify(t, pub, w.Body.Bytes(), &ukeys)
+	verifyUKeys(t, pub, &ukeys)
+	if _, ok := ukeys.Keys["laptop"]; !ok {
+		t.Fatalf("GET after publishing: got %+v", ukeys)
+	}
+}
+
+// headerAuth is an Authenticator that believes the X-Test-User header.
+type headerAuth struct{}
+
+func (headerAuth) Authenticate(r *http.Request, forwrite bool) (*Principal, error) {
+	userid := r.Header.Get("X-Test-User")
+	if userid == "" {
+		return nil, ErrNoCredentials
+	}
+	return &Principal{UserID: userid, Method: "test"}, nil
+}
+
+func TestServerRequiresAuth(t *testing.T) {
+	s, _ := testServerWith(t, DefaultConfig())
+	s.AddAuthenticator(headerAuth{})
+
+	const userid = "alice@example.com"
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	as := func(who, method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if who != "" {
+			r.Header.Set("X-Test-User", who)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := as("", "GET", "/v1/k/"+userid, ""); code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated GET: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := as("", "POST", "/v1/k/"+userid+"/laptop", key); code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated POST: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := as("mallory@example.com", "POST", "/v1/k/"+userid+"/laptop", key); code != http.StatusForbidden {
+		t.Fatalf("POST as another user: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := as(userid, "POST", "/v1/k/"+userid+"/laptop", key); code != http.StatusOK {
+		t.Fatalf("POST as the user: got %d", code)
+	}
+	if code := as("mallory@example.com", "GET", "/v1/k/"+userid, ""); code != http.StatusOK {
+		t.Fatalf("GET as another user: got %d", code)
+	}
+	if code := as("mallory@example.com", "DELETE", "/v1/k/"+userid+"/laptop", ""); code != http.StatusForbidden {
+		t.Fatalf("DELETE as another user: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := as("", "GET", "/v1/map/root", ""); code != http.StatusOK {
+		t.Fatalf("unauthenticated GET of the map root: got %d", code)
+	}
+}
+
+func TestServerTokens(t *testing.T) {
+	secret := bytes.Repeat([]byte("k"), token.MinSecretLen)
+	c := DefaultConfig()
+	c.TokenSecretFn = filepath.Join(t.TempDir(), "token.key")
+	if err := ioutil.WriteFile(c.TokenSecretFn, secret, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := testServerWith(t, c)
+
+	const userid = "alice@example.com"
+	mint := func(sub, scope string) string {
+		tok, err := token.Mint(&token.Claims{
+			Audience: c.TokenAudience,
+			Expiry:   time.Now().Add(time.Hour).Unix(),
+			IssuedAt: time.Now().Unix(),
+			Scope:    scope,
+			Subject:  sub,
+		}, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	with := func(tok, method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	if code := with(mint(userid, token.ScopeRead), "POST", "/v1/k/"+userid+"/laptop", key); code != http.StatusUnauthorized {
+		t.Fatalf("POST with a read token: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := with(mint("mallory@example.com", token.ScopeWrite), "POST", "/v1/k/"+userid+"/laptop", key); code != http.StatusForbidden {
+		t.Fatalf("POST with another user's token: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := with(mint(userid, token.ScopeWrite), "POST", "/v1/k/"+userid+"/laptop", key); code != http.StatusOK {
+		t.Fatalf("POST with a write token: got %d", code)
+	}
+	if code := with(mint("bob@example.com", token.ScopeRead), "GET", "/v1/k/"+userid, ""); code != http.StatusOK {
+		t.Fatalf("GET with a read token: got %d", code)
+	}
+	if code := with("garbage", "GET", "/v1/k/"+userid, ""); code != http.StatusUnauthorized {
+		t.Fatalf("GET with a bad token: got %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// testCert returns a certificate for email, issued by a fresh CA, and
+// the CA certificate.
+func testCert(t *testing.T, email string) (leaf, ca *x509.Certificate) {
+	caPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caPriv.PublicKey, caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &priv.PublicKey, caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return leaf, ca
+}
+
+func TestServerClientCerts(t *testing.T) {
+	const userid = "alice@example.com"
+	alice, ca := testCert(t, userid)
+	stranger, _ := testCert(t, userid)
+
+	c := DefaultConfig()
+	c.ClientCAFn = filepath.Join(t.TempDir(), "clientca.pem")
+	if err := ioutil.WriteFile(c.ClientCAFn, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := testServerWith(t, c)
+
+	with := func(cert *x509.Certificate, method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	if code := with(stranger, "POST", "/v1/k/"+userid+"/laptop", key); code != http.StatusUnauthorized {
+		t.Fatalf("POST with a certificate from another CA: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := with(alice, "POST", "/v1/k/"+userid+"/laptop", key); code != http.StatusOK {
+		t.Fatalf("POST with the user's certificate: got %d", code)
+	}
+	if code := with(alice, "DELETE", "/v1/k/bob@example.com/laptop", ""); code != http.StatusForbidden {
+		t.Fatalf("DELETE of another user's key: got %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestServerConfirmEmail(t *testing.T) {
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.ConfirmEmail = true
+	c.MailDropDir = t.TempDir()
+	s, pub := testServerWith(t, c)
+
+	const userid = "alice@example.com"
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	if w := do(s, "POST", "/v1/k/"+userid+"/laptop", key); w.Code != http.StatusAccepted {
+		t.Fatalf("POST: got %d, want %d", w.Code, http.StatusAccepted)
+	}
+	if w := do(s, "GET", "/v1/k/"+userid, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET of a pending key: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	mail, err := filepath.Glob(filepath.Join(c.MailDropDir, "*.eml"))
+	if err != nil || len(mail) != 1 {
+		t.Fatalf("got mail %v, %v; want one message", mail, err)
+	}
+	msg, err := ioutil.ReadFile(mail[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(msg, []byte("To: "+userid+"\r\n")) {
+		t.Fatalf("mail not addressed to %s:\n%s", userid, msg)
+	}
+	prefix := c.PublicURL + "/v1/confirm/"
+	i := bytes.Index(msg, []byte(prefix))
+	if i < 0 {
+		t.Fatalf("no confirmation link in mail:\n%s", msg)
+	}
+	link := strings.Fields(string(msg[i:]))[0]
+	path := strings.TrimPrefix(link, c.PublicURL)
+
+	if w := do(s, "GET", "/v1/confirm/bogus", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET of a bogus confirmation link: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	w := do(s, "GET", path, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET of the confirmation link: got %d", w.Code)
+	}
+	var dkey DKey
+	verify(t, pub, w.Body.Bytes(), &dkey)
+	if dkey.UserID != userid || dkey.DeviceID != "laptop" {
+		t.Fatalf("confirmed DKey: got %+v", dkey)
+	}
+	if w := do(s, "GET", path, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("second GET of the confirmation link: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w = do(s, "GET", "/v1/k/"+userid, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET after confirming: got %d", w.Code)
+	}
+	var ukeys UKeys
+	verify(t, pub, w.Body.Bytes(), &ukeys)
+	verifyUKeys(t, pub, &ukeys)
+	if _, ok := ukeys.Keys["laptop"]; !ok {
+		t.Fatalf("GET after confirming: got %+v", ukeys)
+	}
+}
+
+func TestServerProofOfPossession(t *testing.T) {
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.RequirePoP = true
+	s, _ := testServerWith(t, c)
+
+	const userid = "alice@example.com"
+	e := testEntity(t, userid)
+	key := yenc.RawURL64.EncodeToString(serializeKey(t, e))
+	nonce := func() string {
+		w := do(s, "GET", "/v1/challenge/"+userid, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET challenge: got %d", w.Code)
+		}
+		var ch Challenge
+		if err := json.Unmarshal(w.Body.Bytes(), &ch); err != nil {
+			t.Fatal(err)
+		}
+		return ch.Nonce
+	}
+	sign := func(signer *openpgp.Entity, nonce string) string {
+		var sig bytes.Buffer
+		msg := popMessage(nonce, e.PrimaryKey.Fingerprint)
+		if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(msg), nil); err != nil {
+			t.Fatal(err)
+		}
+		return yenc.RawURL64.EncodeToString(sig.Bytes())
+	}
+	post := func(nonce, sig string) int {
+		r := httptest.NewRequest("POST", "/v1/k/"+userid+"/laptop", strings.NewReader(key))
+		r.Header.Set(popNonceHeader, nonce)
+		r.Header.Set(popSignatureHeader, sig)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := post("", ""); code != http.StatusUnauthorized {
+		t.Fatalf("POST without a proof: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	n := nonce()
+	if code := post(n, sign(testEntity(t, userid), n)); code != http.StatusUnauthorized {
+		t.Fatalf("POST signed by another key: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := post(n, sign(e, n)); code != http.StatusUnauthorized {
+		t.Fatalf("POST reusing a nonce: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	n = nonce()
+	if code := post(n, sign(e, n)); code != http.StatusOK {
+		t.Fatalf("POST with a proof: got %d", code)
+	}
+}
+
+func TestServerRejectsBadSelfSignatures(t *testing.T) {
+	s, _ := testServer(t)
+	const userid = "alice@example.com"
+
+	// A key made an hour ago, good for a minute.
+	anHourAgo := time.Now().Add(-time.Hour)
+	e, err := openpgp.NewEntity("", "", userid, &packet.Config{Time: func() time.Time { return anHourAgo }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lifetime := uint32(60)
+	for _, id := range e.Identities {
+		id.SelfSignature.KeyLifetimeSecs = &lifetime
+		if err := id.SelfSignature.SignUserId(id.UserId.Id, e.PrimaryKey, e.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := yenc.RawURL64.EncodeToString(serializeKey(t, e))
+	w := do(s, "POST", "/v1/k/"+userid+"/laptop", key)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("POST of an expired key: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	var kerr Error
+	if err := json.Unmarshal(w.Body.Bytes(), &kerr); err != nil || kerr.Code != CodeKeyExpired {
+		t.Fatalf("POST of an expired key: got %s, want code %s", w.Body, CodeKeyExpired)
+	}
+
+	e = testEntity(t, userid)
+	other := testEntity(t, userid)
+	for _, id := range e.Identities {
+		if err := id.SelfSignature.SignUserId(id.UserId.Id, e.PrimaryKey, other.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key = yenc.RawURL64.EncodeToString(serializeKey(t, e))
+	if w := do(s, "POST", "/v1/k/"+userid+"/laptop", key); w.Code != http.StatusUnauthorized {
+		t.Fatalf("POST of a key with a bad self-signature: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestServerPolicy(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "policy.json")
+	policy := `{
+		"domains": ["example.com"],
+		"local_part": "[a-z][a-z0-9]{2,15}",
+		"max_devices": 2,
+		"deny": ["root@example.com"]
+	}`
+	if err := ioutil.WriteFile(fn, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.PolicyFn = fn
+	s, _ := testServerWith(t, c)
+
+	refused := map[string]string{
+		"alice@example.org": CodeDomainNotServed,
+		"Al@example.com":    CodeLocalPartRefused,
+		"root@example.com":  CodeDenied,
+		"alice":             CodeInvalidUserID,
+	}
+	for userid, code := range refused {
+		for _, method := range []string{"GET", "POST"} {
+			path, body := "/v1/k/"+userid, ""
+			if method == "POST" {
+				path += "/laptop"
+				body = yenc.RawURL64.EncodeToString(testKey(t, userid))
+			}
+			w := do(s, method, path, body)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("%s %s: got %d, want %d", method, path, w.Code, http.StatusForbidden)
+			}
+			var e Error
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Code != code || e.Message == "" {
+				t.Fatalf("%s %s: got %s (%v), want code %s", method, path, w.Body, err, code)
+			}
+		}
+	}
+
+	const userid = "alice@example.com"
+	key := yenc.RawURL64.EncodeToString(testKey(t, userid))
+	for _, device := range []string{"laptop", "phone", "laptop"} {
+		if w := do(s, "POST", "/v1/k/"+userid+"/"+device, key); w.Code != http.StatusOK {
+			t.Fatalf("POST for %s: got %d", device, w.Code)
+		}
+	}
+	w := do(s, "POST", "/v1/k/"+userid+"/tablet", key)
+	var e Error
+	if w.Code != http.StatusForbidden || json.Unmarshal(w.Body.Bytes(), &e) != nil || e.Code != CodeTooManyDevices {
+		t.Fatalf("POST for a third device: got %d %s", w.Code, w.Body)
+	}
+	if w := do(s, "DELETE", "/v1/k/"+userid+"/phone", ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/v1/k/"+userid+"/tablet", key); w.Code != http.StatusOK {
+		t.Fatalf("POST for a third device after revoking one: got %d", w.Code)
+	}
+
+	// Registrations made at once mustn't get past the limit either.
+	const bob = "bob@example.com"
+	key = yenc.RawURL64.EncodeToString(testKey(t, bob))
+	codes := make(chan int, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- do(s, "POST", fmt.Sprintf("/v1/k/%s/device%d", bob, i), key).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	registered := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			registered++
+		}
+	}
+	if keys, _ := s.store.Get(bob); registered != 2 || len(keys) != 2 {
+		t.Fatalf("%d concurrent POSTs for new devices: %d succeeded, and %d devices are registered; want 2",
+			cap(codes), registered, len(keys))
+	}
+}
+
+func TestLoadPolicyRejectsBadRegexp(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "policy.json")
+	if err := ioutil.WriteFile(fn, []byte(`{"local_part": "[a-"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPolicy(fn); err == nil {
+		t.Fatal("LoadPolicy accepted a bad regexp")
+	}
+}
+
+// doWithType sends a request, with a body of contentType, to s.
+func doWithType(s *Server, method, path, contentType string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestServerKeyFormats(t *testing.T) {
+	s, pub := testServer(t)
+	const userid = "alice@example.com"
+	e := testEntity(t, userid)
+	binary := serializeKey(t, e)
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.Write(binary)
+	aw.Close()
+	// A secret keyring, sent by mistake, is stored without its
+	// secrets.
+	var secret bytes.Buffer
+	if err := e.SerializePrivate(&secret, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := yenc.RawURL64.EncodeToString(binary)
+
+	for _, test := range []struct {
+		device, contentType string
+		body                []byte
+	}{
+		{"base64", "", []byte(want)},
+		{"text", "text/plain; charset=us-ascii", []byte(want + "\n")},
+		{"armored", "application/pgp-keys", armored.Bytes()},
+		{"binary", "application/octet-stream", binary},
+		{"secret", "application/octet-stream", secret.Bytes()},
+	} {
+		w := doWithType(s, "POST", "/v1/k/"+userid+"/"+test.device, test.contentType, test.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST %s: got %d", test.device, w.Code)
+		}
+		var dkey DKey
+		verify(t, pub, w.Body.Bytes(), &dkey)
+		if dkey.Key != want {
+			t.Fatalf("POST %s: stored %s, want %s", test.device, dkey.Key, want)
+		}
+	}
+
+	var armoredSecret bytes.Buffer
+	aw, err = armor.Encode(&armoredSecret, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.Write(secret.Bytes())
+	aw.Close()
+	for name, body := range map[string][]byte{
+		"armored secret key": armoredSecret.Bytes(),
+		"binary as armor":    binary,
+	} {
+		if w := doWithType(s, "POST", "/v1/k/"+userid+"/bad", "application/pgp-keys", body); w.Code != http.StatusBadRequest {
+			t.Errorf("POST of %s: got %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestServerFingerprints(t *testing.T) {
+	s, pub := testServer(t)
+	const userid = "alice@example.com"
+	e := testEntity(t, userid)
+	key := yenc.RawURL64.EncodeToString(serializeKey(t, e))
+	if w := do(s, "POST", "/v1/k/"+userid+"/laptop", key); w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+
+	fp := fmt.Sprintf("%x", e.PrimaryKey.Fingerprint)
+	for _, id := range []string{fp, "0x" + strings.ToUpper(fp), fmt.Sprintf("%016X", e.Subkeys[0].PublicKey.KeyId)} {
+		w := do(s, "GET", "/v1/fp/"+id, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /v1/fp/%s: got %d", id, w.Code)
+		}
+		var owners KeyOwners
+		verify(t, pub, w.Body.Bytes(), &owners)
+		if len(owners.Owners) != 1 || owners.Owners[0] != (Owner{UserID: userid, DeviceID: "laptop"}) {
+			t.Fatalf("GET /v1/fp/%s: got %+v", id, owners)
+		}
+	}
+
+	if w := do(s, "GET", "/v1/fp/DEADBEEF", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("GET of a short key ID: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "DELETE", "/v1/k/"+userid+"/laptop", ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: got %d", w.Code)
+	}
+	w := do(s, "GET", "/v1/fp/"+fp, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("GET of a revoked key's fingerprint: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	var owners KeyOwners
+	verify(t, pub, w.Body.Bytes(), &owners)
+	if len(owners.Owners) != 0 {
+		t.Fatalf("GET of a revoked key's fingerprint: got %+v", owners)
+	}
+}
+
+func TestServerWKD(t *testing.T) {
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.WKD = true
+	s, _ := testServerWith(t, c)
+
+	const userid = "joe.doe@example.org"
+	e1, e2 := testEntity(t, userid), testEntity(t, userid)
+	for device, e := range map[string]*openpgp.Entity{"laptop": e1, "phone": e2} {
+		if w := do(s, "POST", "/v1/k/"+userid+"/"+device, yenc.RawURL64.EncodeToString(serializeKey(t, e))); w.Code != http.StatusOK {
+			t.Fatalf("POST: got %d", w.Code)
+		}
+	}
+
+	const hash = "iy9q119eutrkn8s1mk4r39qejnbu3n5q"
+	for _, test := range []struct {
+		host, path string
+	}{
+		{"example.org", "/.well-known/openpgpkey/hu/" + hash + "?l=joe.doe"},
+		{"example.org:443", "/.well-known/openpgpkey/hu/" + hash + "?l=joe.doe"},
+		{"openpgpkey.example.org", "/.well-known/openpgpkey/example.org/hu/" + hash + "?l=joe.doe"},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s%s: got %d", test.host, test.path, w.Code)
+		}
+		el, err := openpgp.ReadKeyRing(w.Body)
+		if err != nil || len(el) != 2 {
+			t.Fatalf("GET %s%s: got %d keys, %v", test.host, test.path, len(el), err)
+		}
+		if el[0].PrimaryKey.KeyId != e1.PrimaryKey.KeyId || el[1].PrimaryKey.KeyId != e2.PrimaryKey.KeyId {
+			t.Fatalf("GET %s%s: got the wrong keys", test.host, test.path)
+		}
+	}
+
+	for _, path := range []string{
+		"/.well-known/openpgpkey/hu/" + hash,
+		"/.well-known/openpgpkey/hu/" + hash + "?l=jane.doe",
+		"/.well-known/openpgpkey/example.com/hu/" + hash + "?l=joe.doe",
+	} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = "example.org"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+	if w := do(s, "GET", "/.well-known/openpgpkey/policy", ""); w.Code != http.StatusOK {
+		t.Errorf("GET of the policy file: got %d", w.Code)
+	}
+
+	s, _ = testServer(t)
+	if w := do(s, "GET", "/.well-known/openpgpkey/example.org/hu/"+hash+"?l=joe.doe", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET with WKD off: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestServerHKP(t *testing.T) {
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.HKP = true
+	s, _ := testServerWith(t, c)
+
+	const userid = "alice@example.com"
+	e := testEntity(t, userid)
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.Write(serializeKey(t, e))
+	aw.Close()
+	form := url.Values{"keytext": {armored.String()}}.Encode()
+	w := doWithType(s, "POST", "/pks/add", "application/x-www-form-urlencoded", []byte(form))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /pks/add: got %d %s", w.Code, w.Body)
+	}
+	if w := doWithType(s, "POST", "/pks/add", "application/x-www-form-urlencoded", []byte("keytext=junk")); w.Code != http.StatusBadRequest {
+		t.Fatalf("POST /pks/add of junk: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+	for _, search := range []string{userid, "Alice <" + userid + ">", "0x" + fp, fmt.Sprintf("0x%016X", e.PrimaryKey.KeyId)} {
+		w := do(s, "GET", "/pks/lookup?op=get&options=mr&search="+url.QueryEscape(search), "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("get %s: got %d", search, w.Code)
+		}
+		el, err := openpgp.ReadArmoredKeyRing(w.Body)
+		if err != nil || len(el) != 1 || el[0].PrimaryKey.KeyId != e.PrimaryKey.KeyId {
+			t.Fatalf("get %s: got %v, %v", search, el, err)
+		}
+	}
+
+	w = do(s, "GET", "/pks/lookup?op=index&options=mr&search="+url.QueryEscape(userid), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("index: got %d", w.Code)
+	}
+	index := w.Body.String()
+	if !strings.HasPrefix(index, "info:1:1\n") || !strings.Contains(index, "\npub:"+fp+":1:2048:") ||
+		!strings.Contains(index, "\nuid:<"+userid+">:") {
+		t.Fatalf("index: got\n%s", index)
+	}
+
+	for path, want := range map[string]int{
+		"/pks/lookup?op=get&search=bob@example.com":              http.StatusNotFound,
+		"/pks/lookup?op=get&search=0xDEADBEEFDEADBEEF":           http.StatusNotFound,
+		"/pks/lookup?op=get&search=0xDEADBEEF":                   http.StatusBadRequest,
+		"/pks/lookup?op=get":                                     http.StatusBadRequest,
+		"/pks/lookup?op=stats&search=" + url.QueryEscape(userid): http.StatusNotImplemented,
+	} {
+		if w := do(s, "GET", path, ""); w.Code != want {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+// unreadableOwner is a store in which fp also belongs to userid, whose
+// keys can't be read.
+type unreadableOwner struct {
+	KeyShop
+	fp, userid string
+}
+
+func (u unreadableOwner) Owners(keyid string) ([]Owner, int) {
+	owners, status := u.KeyShop.Owners(keyid)
+	if keyid == u.fp {
+		owners, status = append(owners, Owner{UserID: u.userid, DeviceID: hkpDevice}), http.StatusOK
+	}
+	return owners, status
+}
+
+func (u unreadableOwner) Get(userid string) (map[string]string, int) {
+	if userid == u.userid {
+		return nil, http.StatusInternalServerError
+	}
+	return u.KeyShop.Get(userid)
+}
+
+func TestServerHKPSearch(t *testing.T) {
+	c := DefaultConfig()
+	c.HKP = true
+	s, _ := testServerWith(t, c)
+	s.AddAuthenticator(headerAuth{})
+
+	const userid = "alice@example.com"
+	e := testEntity(t, userid)
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.Write(serializeKey(t, e))
+	aw.Close()
+	as := func(who, method, path, contentType, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		if who != "" {
+			r.Header.Set("X-Test-User", who)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	form := url.Values{"keytext": {armored.String()}}.Encode()
+	if code := as(userid, "POST", "/pks/add", "application/x-www-form-urlencoded", form); code != http.StatusOK {
+		t.Fatalf("POST /pks/add: got %d", code)
+	}
+
+	// Anyone may look up an address, but only the authenticated may
+	// find out whose a fingerprint is.
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+	byAddress := "/pks/lookup?op=get&search=" + url.QueryEscape(userid)
+	byFingerprint := "/pks/lookup?op=get&search=0x" + fp
+	if code := as("", "GET", byAddress, "", ""); code != http.StatusOK {
+		t.Errorf("unauthenticated search by address: got %d, want %d", code, http.StatusOK)
+	}
+	if code := as("", "GET", byFingerprint, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated search by fingerprint: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := as("bob@example.com", "GET", byFingerprint, "", ""); code != http.StatusOK {
+		t.Errorf("authenticated search by fingerprint: got %d, want %d", code, http.StatusOK)
+	}
+
+	// An owner whose keys can't be read doesn't hide the others'.
+	s.store = unreadableOwner{KeyShop: s.store, fp: fp, userid: "bob@example.com"}
+	found, status := s.hkpSearch("0x" + fp)
+	if status != http.StatusOK || len(found) != 1 || found[0].userid != userid {
+		t.Fatalf("search with an unreadable owner: got %d %+v", status, found)
+	}
+	if _, status := s.hkpSearch("bob@example.com"); status != http.StatusInternalServerError {
+		t.Fatalf("search for only the unreadable owner: got %d, want %d", status, http.StatusInternalServerError)
+	}
+}
+
+func TestServerJWKS(t *testing.T) {
+	s, pub := testServer(t)
+	w := do(s, "GET", "/.well-known/jwks.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET jwks.json: got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/jwk-set+json" {
+		t.Errorf("Content-Type: got %q", ct)
+	}
+	var set jose.JsonWebKeySet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].KeyID == "" || set.Keys[0].Algorithm != "ES256" {
+		t.Fatalf("got %+v", set.Keys)
+	}
+
+	// The STH is signed by the published key, and says so.
+	obj, err := jose.ParseSigned(do(s, "GET", "/v1/log/sth", "").Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := obj.Signatures[0].Header.KeyID; kid != set.Keys[0].KeyID {
+		t.Fatalf("STH kid: got %q, want %q", kid, set.Keys[0].KeyID)
+	}
+	if _, err := obj.Verify(set.Keys[0].Key); err != nil {
+		t.Fatalf("verifying STH with the published key: %s", err)
+	}
+	if k, ok := set.Keys[0].Key.(*ecdsa.PublicKey); !ok || k.X.Cmp(pub.X) != 0 || k.Y.Cmp(pub.Y) != 0 {
+		t.Fatalf("published key is not the kauth's")
+	}
+}
+
+func TestServerKauthd(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka, err := kauth.New(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef")
+	d := kauth.NewDaemon(ka, secret, func(msg []byte) (string, error) {
+		return CheckStatement(msg, time.Now(), time.Minute)
+	})
+	sock := filepath.Join(t.TempDir(), "kauthd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go d.Serve(l)
+
+	remote, err := kauth.Dial(sock, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfig()
+	c.SkipAuth = true
+	c.Backend = "memory"
+	s, err := NewServerWith(c, newMemory(), remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Everything the keyshop signs is a statement kauthd will sign.
+	const userid = "alice@example.com"
+	e := testEntity(t, userid)
+	fp := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+	for _, req := range []struct{ method, path, body string }{
+		{"POST", "/v1/k/" + userid + "/laptop", yenc.RawURL64.EncodeToString(serializeKey(t, e))},
+		{"GET", "/v1/k/" + userid, ""},
+		{"GET", "/v1/k/" + userid + "/laptop/history", ""},
+		{"GET", "/v1/fp/" + fp, ""},
+		{"GET", "/v1/log/sth", ""},
+		{"GET", "/v1/map/root", ""},
+		{"DELETE", "/v1/k/" + userid + "/laptop", ""},
+	} {
+		w := do(s, req.method, req.path, req.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: got %d", req.method, req.path, w.Code)
+		}
+		if _, err := jose.ParseSigned(w.Body.String()); err != nil {
+			t.Fatalf("%s %s: %s", req.method, req.path, err)
+		}
+	}
+	if _, err := remote.Sign([]byte(`{"sub":"mallory@example.com"}`)); err == nil {
+		t.Fatal("kauthd signed an arbitrary blob")
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+//
+// Package smt implements a sparse Merkle tree: a map from 256-bit
+// indices to values whose root hash commits to every entry, and to
+// the absence of every other index.
+//
+// Empty subtrees hash to 32 zero bytes, and a subtree holding a
+// single entry hashes to that entry's leaf hash, so the tree is only
+// as deep as it needs to be to separate its entries.
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"sync"
+)
+
+// Size is the length, in bytes, of indices and hashes.
+const Size = sha256.Size
+
+var empty = make([]byte, Size)
+
+// Index returns the tree index for key.
+func Index(key []byte) []byte {
+	h := sha256.Sum256(key)
+	return h[:]
+}
+
+// ValueHash returns the hash stored in the tree for value.
+func ValueHash(value []byte) []byte {
+	h := sha256.Sum256(value)
+	return h[:]
+}
+
+func leafHash(index, value []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(index)
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	if bytes.Equal(left, empty) && bytes.Equal(right, empty) {
+		return empty
+	}
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// bit returns the bit of index at depth, most significant first.
+func bit(index []byte, depth int) byte {
+	return (index[depth/8] >> uint(7-depth%8)) & 1
+}
+
+// A node is the root of a subtree with at least one entry. A subtree
+// with a single entry is a leaf, which holds it, wherever it is in the
+// tree; any other is an interior node, either of whose children may be
+// nil, for an empty subtree. Each node caches its hash.
+type node struct {
+	index, value []byte // for a leaf
+	left, right  *node  // for an interior node
+	hash         []byte
+}
+
+func (n *node) isLeaf() bool {
+	return n.index != nil
+}
+
+// hashOf returns n's hash, or the empty subtree's if n is nil.
+func hashOf(n *node) []byte {
+	if n == nil {
+		return empty
+	}
+	return n.hash
+}
+
+func newLeaf(index, value []byte) *node {
+	return &node{index: index, value: value, hash: leafHash(index, value)}
+}
+
+func newInterior(left, right *node) *node {
+	return &node{left: left, right: right, hash: nodeHash(hashOf(left), hashOf(right))}
+}
+
+// set returns the subtree n, at depth, with index set to value. Only
+// the nodes on the path to index are rehashed.
+func set(n *node, depth int, index, value []byte) *node {
+	switch {
+	case n == nil:
+		return newLeaf(index, value)
+	case n.isLeaf() && bytes.Equal(n.index, index):
+		return newLeaf(index, value)
+	case n.isLeaf():
+		// Push the entry that's here down a level, until the two
+		// paths part.
+		if bit(n.index, depth) == 0 {
+			n = newInterior(n, nil)
+		} else {
+			n = newInterior(nil, n)
+		}
+	}
+	if bit(index, depth) == 0 {
+		n.left = set(n.left, depth+1, index, value)
+	} else {
+		n.right = set(n.right, depth+1, index, value)
+	}
+	n.hash = nodeHash(hashOf(n.left), hashOf(n.right))
+	return n
+}
+
+// remove returns the subtree n, at depth, without index.
+func remove(n *node, depth int, index []byte) *node {
+	switch {
+	case n == nil:
+		return nil
+	case n.isLeaf():
+		if bytes.Equal(n.index, index) {
+			return nil
+		}
+		return n
+	}
+	if bit(index, depth) == 0 {
+		n.left = remove(n.left, depth+1, index)
+	} else {
+		n.right = remove(n.right, depth+1, index)
+	}
+	// A subtree left with a single entry is that entry's leaf.
+	switch {
+	case n.left == nil && n.right == nil:
+		return nil
+	case n.left == nil && n.right.isLeaf():
+		return n.right
+	case n.right == nil && n.left.isLeaf():
+		return n.left
+	}
+	n.hash = nodeHash(hashOf(n.left), hashOf(n.right))
+	return n
+}
+
+// A Tree is a sparse Merkle tree. It is safe for concurrent use. Set
+// only rehashes the path to the entry it changes, so Set, Root and
+// Prove take time in proportion to the tree's depth, not its size.
+type Tree struct {
+	mu   sync.RWMutex
+	root *node
+}
+
+// New returns an empty tree.
+func New() *Tree {
+	return new(Tree)
+}
+
+// Set sets the value hash at index; a nil value hash removes it.
+func (t *Tree) Set(index, valueHash []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if valueHash == nil {
+		t.root = remove(t.root, 0, index)
+	} else {
+		t.root = set(t.root, 0, append([]byte(nil), index...), append([]byte(nil), valueHash...))
+	}
+}
+
+// Root returns the tree's root hash.
+func (t *Tree) Root() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return hashOf(t.root)
+}
+
+// A Proof shows that an index has a particular value hash in a tree,
+// or that it has none.
+//
+// Siblings holds the sibling hashes on the path from the root to the
+// index, until that path reaches an empty subtree, or a subtree with
+// a single entry. That entry, if any, is in Index and Value; for a
+// proof of absence, it is an entry for another index that shares the
+// path so far.
+type Proof struct {
+	Siblings [][]byte
+	Index    []byte
+	Value    []byte
+}
+
+// Prove returns a proof of the value hash at index, or of its absence.
+func (t *Tree) Prove(index []byte) *Proof {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p := new(Proof)
+	n := t.root
+	for depth := 0; n != nil && !n.isLeaf(); depth++ {
+		if bit(index, depth) == 0 {
+			p.Siblings = append(p.Siblings, hashOf(n.right))
+			n = n.left
+		} else {
+			p.Siblings = append(p.Siblings, hashOf(n.left))
+			n = n.right
+		}
+	}
+	if n != nil {
+		p.Index = n.index
+		p.Value = n.value
+	}
+	return p
+}
+
+var (
+	errMalformed = errors.New("smt: malformed proof")
+	errValue     = errors.New("smt: proof is for a different value")
+	errRoot      = errors.New("smt: proof does not match root")
+)
+
+// Verify checks that p proves that index has valueHash in the tree
+// with the given root; a nil valueHash checks that index is absent.
+func (p *Proof) Verify(root, index, valueHash []byte) error {
+	if len(index) != Size || len(p.Siblings) > 8*Size {
+		return errMalformed
+	}
+	h := empty
+	if p.Index != nil {
+		if len(p.Index) != Size || len(p.Value) != Size {
+			return errMalformed
+		}
+		// The entry has to sit on the path to index.
+		for depth := range p.Siblings {
+			if bit(p.Index, depth) != bit(index, depth) {
+				return errMalformed
+			}
+		}
+		h = leafHash(p.Index, p.Value)
+	}
+	switch {
+	case valueHash == nil:
+		if p.Index != nil && bytes.Equal(p.Index, index) {
+			return errValue
+		}
+	case p.Index == nil || !bytes.Equal(p.Index, index) || !bytes.Equal(p.Value, valueHash):
+		return errValue
+	}
+	for depth := len(p.Siblings) - 1; depth >= 0; depth-- {
+		if bit(index, depth) == 0 {
+			h = nodeHash(h, p.Siblings[depth])
+		} else {
+			h = nodeHash(p.Siblings[depth], h)
+		}
+	}
+	if !bytes.Equal(h, root) {
+		return errRoot
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestEmptyTree(t *testing.T) {
+	tr := New()
+	root := tr.Root()
+	if !bytes.Equal(root, empty) {
+		t.Fatalf("empty root: got %x", root)
+	}
+	index := Index([]byte("alice@example.com"))
+	if err := tr.Prove(index).Verify(root, index, nil); err != nil {
+		t.Fatalf("absence in the empty tree: %s", err)
+	}
+}
+
+func TestProofs(t *testing.T) {
+	tr := New()
+	for n := 0; n < 40; n++ {
+		tr.Set(Index([]byte(fmt.Sprintf("user%d", n))), ValueHash([]byte(fmt.Sprintf("keys%d", n))))
+		root := tr.Root()
+		for i := 0; i <= n; i++ {
+			index := Index([]byte(fmt.Sprintf("user%d", i)))
+			value := ValueHash([]byte(fmt.Sprintf("keys%d", i)))
+			p := tr.Prove(index)
+			if err := p.Verify(root, index, value); err != nil {
+				t.Fatalf("%d entries: proof for user%d: %s", n+1, i, err)
+			}
+			if err := p.Verify(root, index, nil); err == nil {
+				t.Fatalf("%d entries: proof of presence for user%d verified absence", n+1, i)
+			}
+			if err := p.Verify(root, index, ValueHash([]byte("other"))); err == nil {
+				t.Fatalf("%d entries: proof for user%d verified another value", n+1, i)
+			}
+		}
+		absent := Index([]byte("nobody"))
+		if err := tr.Prove(absent).Verify(root, absent, nil); err != nil {
+			t.Fatalf("%d entries: proof of absence: %s", n+1, err)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tr := New()
+	a, b := Index([]byte("a")), Index([]byte("b"))
+	tr.Set(a, ValueHash([]byte("1")))
+	before := tr.Root()
+	tr.Set(b, ValueHash([]byte("2")))
+	tr.Set(b, nil)
+	if !bytes.Equal(tr.Root(), before) {
+		t.Fatalf("removing an entry did not restore the root")
+	}
+	if err := tr.Prove(b).Verify(before, b, nil); err != nil {
+		t.Fatalf("absence after removal: %s", err)
+	}
+}
+
+func TestProofAgainstOtherRoot(t *testing.T) {
+	tr := New()
+	a := Index([]byte("a"))
+	tr.Set(a, ValueHash([]byte("1")))
+	tr.Set(Index([]byte("b")), ValueHash([]byte("2")))
+	p := tr.Prove(a)
+	tr.Set(a, ValueHash([]byte("3")))
+	if err := p.Verify(tr.Root(), a, ValueHash([]byte("1"))); err == nil {
+		t.Fatalf("stale proof verified against the new root")
+	}
+}
+
+// rootOf computes the root hash of a tree holding entries, which maps
+// index to value hash, from scratch.
+func rootOf(entries map[string][]byte) []byte {
+	indices := make([]string, 0, len(entries))
+	for i := range entries {
+		indices = append(indices, i)
+	}
+	sort.Strings(indices)
+	var hash func(indices []string, depth int) []byte
+	hash = func(indices []string, depth int) []byte {
+		switch len(indices) {
+		case 0:
+			return empty
+		case 1:
+			return leafHash([]byte(indices[0]), entries[indices[0]])
+		}
+		i := sort.Search(len(indices), func(i int) bool {
+			return bit([]byte(indices[i]), depth) == 1
+		})
+		return nodeHash(hash(indices[:i], depth+1), hash(indices[i:], depth+1))
+	}
+	return hash(indices, 0)
+}
+
+func TestIncrementalRoot(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tr := New()
+	entries := make(map[string][]byte)
+	for n := 0; n < 2000; n++ {
+		index := Index([]byte(fmt.Sprintf("user%d", r.Intn(200))))
+		if r.Intn(3) == 0 {
+			tr.Set(index, nil)
+			delete(entries, string(index))
+		} else {
+			value := ValueHash([]byte(fmt.Sprintf("keys%d", n)))
+			tr.Set(index, value)
+			entries[string(index)] = value
+		}
+		if root := tr.Root(); !bytes.Equal(root, rootOf(entries)) {
+			t.Fatalf("after %d changes, with %d entries: root %x, want %x", n+1, len(entries), root, rootOf(entries))
+		}
+	}
+	root := tr.Root()
+	for i, value := range entries {
+		if err := tr.Prove([]byte(i)).Verify(root, []byte(i), value); err != nil {
+			t.Fatalf("proof for %x: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	_ "modernc.org/sqlite"
+)
+
+// The statements below stick to SQL that SQLite and most other
+// databases understand, so that another database/sql driver can be
+// slotted in without touching the queries.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS keys (
+		userid   TEXT    NOT NULL,
+		deviceid TEXT    NOT NULL,
+		dkey     BLOB    NOT NULL,
+		updated  INTEGER NOT NULL,
+		PRIMARY KEY (userid, deviceid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS history (
+		seq      INTEGER PRIMARY KEY AUTOINCREMENT,
+		userid   TEXT    NOT NULL,
+		deviceid TEXT    NOT NULL,
+		dkey     BLOB    NOT NULL,
+		t        INTEGER NOT NULL,
+		revocation BLOB
+	)`,
+	`CREATE INDEX IF NOT EXISTS history_device ON history (userid, deviceid, seq)`,
+	`CREATE TABLE IF NOT EXISTS pending (
+		id       TEXT    NOT NULL PRIMARY KEY,
+		userid   TEXT    NOT NULL,
+		deviceid TEXT    NOT NULL,
+		dkey     BLOB    NOT NULL,
+		expires  INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS pending_device ON pending (userid, deviceid)`,
+	`CREATE INDEX IF NOT EXISTS pending_expires ON pending (expires)`,
+	`CREATE TABLE IF NOT EXISTS owners (
+		keyid    TEXT    NOT NULL,
+		userid   TEXT    NOT NULL,
+		deviceid TEXT    NOT NULL,
+		PRIMARY KEY (keyid, userid, deviceid)
+	)`,
+	// maproot has a single row, whose id is 1.
+	`CREATE TABLE IF NOT EXISTS maproot (
+		id       INTEGER NOT NULL PRIMARY KEY,
+		epoch    INTEGER NOT NULL,
+		root     BLOB    NOT NULL
+	)`,
+}
+
+// sqlStore is a KeyShop backed by a SQL database; by default, a
+// SQLite file, using a pure-Go driver.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func openSQL(fn string, readOnly bool) (KeyShop, error) {
+	dsn := fn
+	if readOnly {
+		dsn = "file:" + fn + "?mode=ro"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer; serialize access rather
+	// than fail with SQLITE_BUSY under load.
+	db.SetMaxOpenConns(1)
+	if readOnly {
+		// sql.Open doesn't open the file.
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &sqlStore{db: db}, nil
+	}
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	s := &sqlStore{db: db}
+	if err := s.addRevocations(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.reindex(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// addRevocations adds the revocation column to the history table of a
+// database from before revocations were recorded there.
+func (s *sqlStore) addRevocations() error {
+	rows, err := s.db.Query(`SELECT revocation FROM history LIMIT 0`)
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = s.db.Exec(`ALTER TABLE history ADD COLUMN revocation BLOB`)
+	return err
+}
+
+// reindex builds the fingerprint index of a database from before
+// there was one.
+func (s *sqlStore) reindex() error {
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM owners`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT userid, deviceid, dkey FROM keys`)
+		if err != nil {
+			return err
+		}
+		type entry struct {
+			userid, deviceid string
+			dkey             []byte
+		}
+		var entries []entry
+		for rows.Next() {
+			var e entry
+			if err := rows.Scan(&e.userid, &e.deviceid, &e.dkey); err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := sqlIndex(tx, e.userid, e.deviceid, e.dkey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sqlIndex makes userid/deviceid the only owner, among its devices,
+// of the key in dkey.
+func sqlIndex(tx *sql.Tx, userid, deviceid string, dkey []byte) error {
+	if _, err := tx.Exec(`DELETE FROM owners WHERE userid = ? AND deviceid = ?`, userid, deviceid); err != nil {
+		return err
+	}
+	for _, id := range keyIDs(dkey) {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO owners (keyid, userid, deviceid) VALUES (?, ?, ?)`,
+			id, userid, deviceid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) NewOrUpdate(userid, deviceid string, dkey []byte) (status int) {
+	err := s.inTx(func(tx *sql.Tx) error {
+		t := time.Now().UTC().Unix()
+		_, err := tx.Exec(`INSERT OR REPLACE INTO keys (userid, deviceid, dkey, updated) VALUES (?, ?, ?, ?)`,
+			userid, deviceid, dkey, t)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO history (userid, deviceid, dkey, t) VALUES (?, ?, ?, ?)`,
+			userid, deviceid, dkey, t)
+		if err != nil {
+			return err
+		}
+		return sqlIndex(tx, userid, deviceid, dkey)
+	})
+	if err != nil {
+		glog.Errorf("error storing %s/%s: %s", userid, deviceid, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// inTx runs f in a transaction, committing it if f succeeds.
+func (s *sqlStore) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Get(userid string) (keys map[string]string, status int) {
+	rows, err := s.db.Query(`SELECT deviceid, dkey FROM keys WHERE userid = ?`, userid)
+	if err != nil {
+		glog.Errorf("error trying to get keys for %s: %s", userid, err)
+		return nil, http.StatusInternalServerError
+	}
+	defer rows.Close()
+	keys = make(map[string]string)
+	for rows.Next() {
+		var deviceid string
+		var dkey []byte
+		if err := rows.Scan(&deviceid, &dkey); err != nil {
+			glog.Errorf("error reading keys for %s: %s", userid, err)
+			return nil, http.StatusInternalServerError
+		}
+		keys[deviceid] = string(dkey)
+	}
+	if err := rows.Err(); err != nil {
+		glog.Errorf("error reading keys for %s: %s", userid, err)
+		return nil, http.StatusInternalServerError
+	}
+	if len(keys) == 0 {
+		glog.Infof("user %s does not have any keys", userid)
+		return nil, http.StatusNotFound
+	}
+	return keys, http.StatusOK
+}
+
+func (s *sqlStore) Revoke(userid, deviceid string, revocation []byte) (status int) {
+	var n int64
+	err := s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM keys WHERE userid = ? AND deviceid = ?`, userid, deviceid)
+		if err != nil {
+			return err
+		}
+		if n, err = res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM owners WHERE userid = ? AND deviceid = ?`, userid, deviceid)
+		if err != nil {
+			return err
+		}
+		// A revocation has no DKey.
+		_, err = tx.Exec(`INSERT INTO history (userid, deviceid, dkey, t, revocation) VALUES (?, ?, '', ?, ?)`,
+			userid, deviceid, time.Now().UTC().Unix(), revocation)
+		return err
+	})
+	if err != nil {
+		glog.Errorf("error revoking key for %s/%s: %s", userid, deviceid, err)
+		return http.StatusInternalServerError
+	}
+	if n == 0 {
+		glog.Infof("no key to revoke for %s/%s", userid, deviceid)
+		return http.StatusNotFound
+	}
+	return http.StatusOK
+}
+
+func (s *sqlStore) History(userid, deviceid string) (entries []HistoryEntry, status int) {
+	rows, err := s.db.Query(`SELECT t, dkey, revocation FROM history WHERE userid = ? AND deviceid = ? ORDER BY seq`,
+		userid, deviceid)
+	if err != nil {
+		glog.Errorf("error reading history for %s/%s: %s", userid, deviceid, err)
+		return nil, http.StatusInternalServerError
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e HistoryEntry
+		var dkey, revocation []byte
+		if err := rows.Scan(&e.Timestamp, &dkey, &revocation); err != nil {
+			glog.Errorf("error reading history for %s/%s: %s", userid, deviceid, err)
+			return nil, http.StatusInternalServerError
+		}
+		e.DKey, e.Revocation = string(dkey), string(revocation)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		glog.Errorf("error reading history for %s/%s: %s", userid, deviceid, err)
+		return nil, http.StatusInternalServerError
+	}
+	if len(entries) == 0 {
+		return nil, http.StatusNotFound
+	}
+	return entries, http.StatusOK
+}
+
+func (s *sqlStore) ForEach(fn func(userid string, keys map[string]string) error) error {
+	rows, err := s.db.Query(`SELECT userid, deviceid, dkey FROM keys ORDER BY userid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var current string
+	var keys map[string]string
+	for rows.Next() {
+		var userid, deviceid string
+		var dkey []byte
+		if err := rows.Scan(&userid, &deviceid, &dkey); err != nil {
+			return err
+		}
+		if keys != nil && userid != current {
+			if err := fn(current, keys); err != nil {
+				return err
+			}
+			keys = nil
+		}
+		if keys == nil {
+			current, keys = userid, make(map[string]string)
+		}
+		keys[deviceid] = string(dkey)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if keys != nil {
+		return fn(current, keys)
+	}
+	return nil
+}
+
+func (s *sqlStore) PutPending(id string, p *Pending) (status int) {
+	err := s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM pending WHERE expires < ?`, time.Now().UTC().Unix()); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM pending WHERE userid = ? AND deviceid = ?`, p.UserID, p.DeviceID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO pending (id, userid, deviceid, dkey, expires) VALUES (?, ?, ?, ?, ?)`,
+			id, p.UserID, p.DeviceID, []byte(p.DKey), p.Expires)
+		return err
+	})
+	if err != nil {
+		glog.Errorf("error storing pending registration for %s/%s: %s", p.UserID, p.DeviceID, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+func (s *sqlStore) TakePending(id string) (p *Pending, status int) {
+	err := s.inTx(func(tx *sql.Tx) error {
+		var dkey []byte
+		p = new(Pending)
+		err := tx.QueryRow(`SELECT userid, deviceid, dkey, expires FROM pending WHERE id = ?`, id).
+			Scan(&p.UserID, &p.DeviceID, &dkey, &p.Expires)
+		if err != nil {
+			return err
+		}
+		p.DKey = string(dkey)
+		_, err = tx.Exec(`DELETE FROM pending WHERE id = ?`, id)
+		return err
+	})
+	switch err {
+	case sql.ErrNoRows:
+		return nil, http.StatusNotFound
+	case nil:
+		return p, http.StatusOK
+	default:
+		glog.Errorf("error taking pending registration: %s", err)
+		return nil, http.StatusInternalServerError
+	}
+}
+
+func (s *sqlStore) PutMapRoot(epoch uint64, root []byte) (status int) {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO maproot (id, epoch, root) VALUES (1, ?, ?)`, int64(epoch), root)
+	if err != nil {
+		glog.Errorf("error storing map root for epoch %d: %s", epoch, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+func (s *sqlStore) MapRoot() (epoch uint64, root []byte, status int) {
+	var e int64
+	err := s.db.QueryRow(`SELECT epoch, root FROM maproot WHERE id = 1`).Scan(&e, &root)
+	switch err {
+	case sql.ErrNoRows:
+		return 0, nil, http.StatusNotFound
+	case nil:
+		return uint64(e), root, http.StatusOK
+	default:
+		glog.Errorf("error reading map root: %s", err)
+		return 0, nil, http.StatusInternalServerError
+	}
+}
+
+func (s *sqlStore) Owners(keyid string) (owners []Owner, status int) {
+	rows, err := s.db.Query(`SELECT userid, deviceid FROM owners WHERE keyid = ?`, keyid)
+	if err != nil {
+		glog.Errorf("error looking up owners of %s: %s", keyid, err)
+		return nil, http.StatusInternalServerError
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o Owner
+		if err := rows.Scan(&o.UserID, &o.DeviceID); err != nil {
+			glog.Errorf("error looking up owners of %s: %s", keyid, err)
+			return nil, http.StatusInternalServerError
+		}
+		owners = append(owners, o)
+	}
+	if err := rows.Err(); err != nil {
+		glog.Errorf("error looking up owners of %s: %s", keyid, err)
+		return nil, http.StatusInternalServerError
+	}
+	if len(owners) == 0 {
+		return nil, http.StatusNotFound
+	}
+	return owners, http.StatusOK
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yahoo/keyshop/yenc"
+)
+
+// A statement is one of the kinds of JSON object that the kauth signs
+// for a keyshop, told apart by the members it has.
+type statement struct {
+	kind     string
+	required []string
+	optional []string
+	// check returns an error if msg, strictly decoded, isn't well
+	// formed; it returns the statement's timestamp.
+	check func(dec *json.Decoder) (int64, error)
+}
+
+var statements = []statement{
+	{"DKey", []string{"deviceid", "key", "t", "userid"}, []string{"type"}, checkDKey},
+	{"UKeys", []string{"keys", "t", "userid"}, []string{"proof", "root", "types"}, checkUKeys},
+	{"Revocation", []string{"deviceid", "revoked", "t", "userid"}, nil, checkRevocation},
+	{"KeyHistory", []string{"deviceid", "history", "t", "userid"}, nil, checkKeyHistory},
+	{"TreeHead", []string{"root", "size", "t"}, nil, checkTreeHead},
+	{"MapRoot", []string{"epoch", "root", "t"}, nil, checkMapRoot},
+	{"KeyOwners", []string{"keyid", "owners", "t"}, nil, checkKeyOwners},
+}
+
+// CheckStatement checks that msg is a well-formed statement of a kind
+// that a keyshop has the kauth sign, made within skew of now, and
+// returns its kind (e.g. "DKey"). A key authority that signs for a
+// keyshop in another process, like kauthd, uses it to refuse to sign
+// anything else.
+func CheckStatement(msg []byte, now time.Time, skew time.Duration) (string, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &members); err != nil {
+		return "", fmt.Errorf("not a JSON object: %s", err)
+	}
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, st := range statements {
+		if !st.matches(members) {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.DisallowUnknownFields()
+		t, err := st.check(dec)
+		if err != nil {
+			return st.kind, fmt.Errorf("malformed %s: %s", st.kind, err)
+		}
+		if d := now.Sub(time.Unix(t, 0)); d > skew || d < -skew {
+			return st.kind, fmt.Errorf("%s made at %d, not within %s of now", st.kind, t, skew)
+		}
+		return st.kind, nil
+	}
+	return "", fmt.Errorf("not a statement the keyshop signs: has %s", strings.Join(names, ", "))
+}
+
+// matches reports whether a statement of this kind has members.
+func (st *statement) matches(members map[string]json.RawMessage) bool {
+	for _, name := range st.required {
+		if _, ok := members[name]; !ok {
+			return false
+		}
+	}
+	n := len(st.required)
+	for _, name := range st.optional {
+		if _, ok := members[name]; ok {
+			n++
+		}
+	}
+	return n == len(members)
+}
+
+// isJWS reports whether s looks like a compact-serialized JWS.
+func isJWS(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+func checkDKey(dec *json.Decoder) (int64, error) {
+	var v DKey
+	if err := dec.Decode(&v); err != nil {
+		return 0, err
+	}
+	if v.UserID == "" || v.DeviceID == "" || v.Key == "" {
+		return 0, errors.New("no userid, deviceid or key")
+	}
+	if _, ok := keyTypes[v.Type]; v.Type != "" && !ok {
+		return 0, fmt.Errorf("unknown key type %q", v.Type)
+	}
+	return v.Timestamp, nil
+}
+
+func checkUKeys(dec *json.Decoder) (int64, error) {
+	var v UKeys
+	if err := dec.Decode(&v); err != nil {
+		return 0, err
+	}
+	if v.UserID == "" {
+		return 0, errors.New("no userid")
+	}
+	for deviceid, dkey := range v.Keys {
+		if !isJWS(dkey) {
+			return 0, fmt.Errorf("the key for %s is not a signed DKey", deviceid)
+		}
+	}
+	if v.Root != "" && !isJWS(v.Root) {
+		return 0, errors.New("root is not a signed MapRoot")
+	}
+	return v.Timestamp, nil
+}
+
+func checkRevocation(dec *json.Decoder) (int64, error) {
+	var v Revocation
+	if err := dec.Decode(&v); err != nil {
+		return 0, err
+	}
+	if v.UserID == "" || v.DeviceID == "" || !v.Revoked {
+		return 0, errors.New("no userid or deviceid, or not revoked")
+	}
+	return v.Timestamp, nil
+}
+
+func checkKeyHistory(dec *json.Decoder) (int64, error) {
+	var v KeyHistory
+	if err := dec.Decode(&v); err != nil {
+		return 0, err
+	}
+	if v.UserID == "" || v.DeviceID == "" {
+		return 0, errors.New("no userid or deviceid")
+	}
+	for i, e := range v.Entries {
+		if (e.DKey == "") == (e.Revocation == "") || !isJWS(e.DKey+e.Revocation) {
+			return 0, fmt.Errorf("entry %d is not a signed DKey or Revocation", i)
+		}
+	}
+	return v.Timestamp, nil
+}
+
+func checkTreeHead(dec *json.Decoder) (int64, error) {
+	var v TreeHead
+	if err := dec.Decode(&v); err != nil {
+		return 0, err
+	}
+	if v.TreeSize < 0 {
+		return 0, errors.New("negative size")
+	}
+	if _, err := yenc.RawURL64.DecodeString(v.RootHash); err != nil {
+		return 0, fmt.Errorf("root: %s", err)
+	}
+	return v.Timestamp, nil
+}
+
+func checkMapRoot(dec *json.Decoder) (int64, error) {
+	var v MapRoot
+	if err := dec.Decode(&v); err != nil {
+		return 0, err
+	}
+	if _, err := yenc.RawURL64.DecodeString(v.RootHash); err != nil {
+		return 0, fmt.Errorf("root: %s", err)
+	}
+	return v.Timestamp, nil
+}
+
+func checkKeyOwners(dec *json.Decoder) (int64, error) {
+	var v KeyOwners
+	if err := dec.Decode(&v); err != nil {
+		return 0, err
+	}
+	if id, ok := normalizeKeyID(v.KeyID); !ok || id != v.KeyID {
+		return 0, fmt.Errorf("bad key ID %q", v.KeyID)
+	}
+	for _, o := range v.Owners {
+		if o.UserID == "" || o.DeviceID == "" {
+			return 0, errors.New("an owner has no userid or deviceid")
+		}
+	}
+	return v.Timestamp, nil
+}
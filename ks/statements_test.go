@@ -0,0 +1,51 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckStatement(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		v    interface{}
+		kind string
+	}{
+		{&DKey{DeviceID: "laptop", Key: "AAAA", Timestamp: now.Unix(), UserID: "alice@example.com"}, "DKey"},
+		{&UKeys{Keys: map[string]string{"laptop": "a.b.c"}, Timestamp: now.Unix(), UserID: "alice@example.com"}, "UKeys"},
+		{&Revocation{DeviceID: "laptop", Revoked: true, Timestamp: now.Unix(), UserID: "alice@example.com"}, "Revocation"},
+		{&TreeHead{RootHash: "AAAA", Timestamp: now.Unix(), TreeSize: 1}, "TreeHead"},
+		{&MapRoot{Epoch: 2, RootHash: "AAAA", Timestamp: now.Unix()}, "MapRoot"},
+		{&KeyOwners{KeyID: "0123456789ABCDEF", Owners: []Owner{}, Timestamp: now.Unix()}, "KeyOwners"},
+	} {
+		msg, err := json.Marshal(test.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind, err := CheckStatement(msg, now, time.Minute); kind != test.kind || err != nil {
+			t.Errorf("%s: got %q, %v; want %q", msg, kind, err, test.kind)
+		}
+	}
+
+	t0 := now.Unix()
+	for _, msg := range []string{
+		`"a string"`,
+		`{"sub":"alice@example.com","exp":1}`,
+		`{"deviceid":"laptop","key":"AAAA","t":` + strconv.FormatInt(t0, 10) + `,"userid":"alice@example.com","extra":1}`,
+		`{"deviceid":"laptop","key":"","t":` + strconv.FormatInt(t0, 10) + `,"userid":"alice@example.com"}`,
+		`{"deviceid":"laptop","key":"AAAA","t":` + strconv.FormatInt(t0, 10) + `,"userid":"alice@example.com","type":"rot13"}`,
+		`{"deviceid":"laptop","key":"AAAA","t":` + strconv.FormatInt(t0-3600, 10) + `,"userid":"alice@example.com"}`,
+		`{"deviceid":"laptop","revoked":false,"t":` + strconv.FormatInt(t0, 10) + `,"userid":"alice@example.com"}`,
+		`{"keys":{"laptop":"not a JWS"},"t":` + strconv.FormatInt(t0, 10) + `,"userid":"alice@example.com"}`,
+		`{"root":"AAAA","size":-1,"t":` + strconv.FormatInt(t0, 10) + `}`,
+		`{"keyid":"0x0123456789abcdef","owners":[],"t":` + strconv.FormatInt(t0, 10) + `}`,
+	} {
+		if kind, err := CheckStatement([]byte(msg), now, time.Minute); err == nil {
+			t.Errorf("%s: accepted as a %s", msg, kind)
+		}
+	}
+}
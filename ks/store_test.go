@@ -0,0 +1,359 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yahoo/keyshop/yenc"
+	"golang.org/x/crypto/openpgp"
+)
+
+// openTestStores returns one store for each backend, keyed by
+// backend name.
+func openTestStores(t *testing.T) map[string]KeyShop {
+	dir := t.TempDir()
+	stores := make(map[string]KeyShop)
+	for name := range backends {
+		s, err := OpenStore(&Config{Backend: name, DbFn: filepath.Join(dir, name+".db")})
+		if err != nil {
+			t.Fatalf("opening %s store: %s", name, err)
+		}
+		t.Cleanup(func() { s.Close() })
+		stores[name] = s
+	}
+	return stores
+}
+
+func TestStoreContract(t *testing.T) {
+	for name, s := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, status := s.Get("a@example.com"); status != http.StatusNotFound {
+				t.Fatalf("Get on an empty store: got %d, want %d", status, http.StatusNotFound)
+			}
+			if status := s.NewOrUpdate("a@example.com", "laptop", []byte("k1")); status != http.StatusOK {
+				t.Fatalf("NewOrUpdate: got %d", status)
+			}
+			if status := s.NewOrUpdate("a@example.com", "phone", []byte("k2")); status != http.StatusOK {
+				t.Fatalf("NewOrUpdate: got %d", status)
+			}
+			if status := s.NewOrUpdate("a@example.com", "laptop", []byte("k3")); status != http.StatusOK {
+				t.Fatalf("NewOrUpdate (overwrite): got %d", status)
+			}
+			keys, status := s.Get("a@example.com")
+			if status != http.StatusOK {
+				t.Fatalf("Get: got %d", status)
+			}
+			if len(keys) != 2 || keys["laptop"] != "k3" || keys["phone"] != "k2" {
+				t.Fatalf("Get: got %v", keys)
+			}
+
+			if status := s.Revoke("a@example.com", "tablet", []byte("r0")); status != http.StatusNotFound {
+				t.Fatalf("Revoke of an unknown device: got %d, want %d", status, http.StatusNotFound)
+			}
+			if status := s.Revoke("b@example.com", "laptop", []byte("r0")); status != http.StatusNotFound {
+				t.Fatalf("Revoke for an unknown user: got %d, want %d", status, http.StatusNotFound)
+			}
+			if status := s.Revoke("a@example.com", "laptop", []byte("r1")); status != http.StatusOK {
+				t.Fatalf("Revoke: got %d", status)
+			}
+			keys, _ = s.Get("a@example.com")
+			if len(keys) != 1 || keys["phone"] != "k2" {
+				t.Fatalf("Get after Revoke: got %v", keys)
+			}
+
+			s.NewOrUpdate("b@example.com", "laptop", []byte("k4"))
+			users := make(map[string]map[string]string)
+			err := s.ForEach(func(userid string, keys map[string]string) error {
+				users[userid] = keys
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ForEach: %s", err)
+			}
+			if len(users) != 2 || users["a@example.com"]["phone"] != "k2" || users["b@example.com"]["laptop"] != "k4" {
+				t.Fatalf("ForEach: got %v", users)
+			}
+
+			if status := s.Revoke("a@example.com", "phone", []byte("r2")); status != http.StatusOK {
+				t.Fatalf("Revoke: got %d", status)
+			}
+			if _, status := s.Get("a@example.com"); status != http.StatusNotFound {
+				t.Fatalf("Get after revoking every device: got %d, want %d", status, http.StatusNotFound)
+			}
+
+			entries, status := s.History("a@example.com", "laptop")
+			if status != http.StatusOK {
+				t.Fatalf("History: got %d", status)
+			}
+			if len(entries) != 3 || entries[0].DKey != "k1" || entries[1].DKey != "k3" ||
+				entries[2].DKey != "" || entries[2].Revocation != "r1" {
+				t.Fatalf("History: got %+v", entries)
+			}
+			entries, _ = s.History("a@example.com", "phone")
+			if len(entries) != 2 || entries[0].DKey != "k2" || entries[1].Revocation != "r2" {
+				t.Fatalf("History of a revoked device: got %+v", entries)
+			}
+			if _, status := s.History("a@example.com", "tablet"); status != http.StatusNotFound {
+				t.Fatalf("History of an unknown device: got %d, want %d", status, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestStorePending(t *testing.T) {
+	now := time.Now().Unix()
+	for name, s := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			p := &Pending{UserID: "a@example.com", DeviceID: "laptop", DKey: "k1", Expires: now + 60}
+			if status := s.PutPending("id1", p); status != http.StatusOK {
+				t.Fatalf("PutPending: got %d", status)
+			}
+			s.PutPending("old", &Pending{UserID: "b@example.com", DeviceID: "laptop", DKey: "k2", Expires: now - 60})
+			if _, status := s.Get("a@example.com"); status != http.StatusNotFound {
+				t.Fatalf("Get with only a pending key: got %d, want %d", status, http.StatusNotFound)
+			}
+			got, status := s.TakePending("id1")
+			if status != http.StatusOK || *got != *p {
+				t.Fatalf("TakePending: got %+v, %d", got, status)
+			}
+			if _, status := s.TakePending("id1"); status != http.StatusNotFound {
+				t.Fatalf("second TakePending: got %d, want %d", status, http.StatusNotFound)
+			}
+			// Storing another registration discards the expired one.
+			s.PutPending("id2", p)
+			if _, status := s.TakePending("old"); status != http.StatusNotFound {
+				t.Fatalf("TakePending of an expired registration: got %d, want %d", status, http.StatusNotFound)
+			}
+			// A newer registration for the device replaces id2, whose
+			// link would otherwise overwrite the newer key.
+			newer := &Pending{UserID: "a@example.com", DeviceID: "laptop", DKey: "k3", Expires: now + 120}
+			s.PutPending("id3", newer)
+			s.PutPending("id4", &Pending{UserID: "a@example.com", DeviceID: "phone", DKey: "k4", Expires: now + 60})
+			if _, status := s.TakePending("id2"); status != http.StatusNotFound {
+				t.Fatalf("TakePending of a replaced registration: got %d, want %d", status, http.StatusNotFound)
+			}
+			if got, status := s.TakePending("id3"); status != http.StatusOK || *got != *newer {
+				t.Fatalf("TakePending of the newer registration: got %+v, %d", got, status)
+			}
+			if _, status := s.TakePending("id4"); status != http.StatusOK {
+				t.Fatalf("TakePending of another device's registration: got %d", status)
+			}
+		})
+	}
+}
+
+func TestStoreIndexesOldPending(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "bolt.db")
+	db, err := bolt.Open(fn, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(pendingBucket)
+		if err != nil {
+			return err
+		}
+		for id, p := range map[string]Pending{
+			"stale":   {UserID: "a@example.com", DeviceID: "laptop", DKey: "k1", Expires: now + 60},
+			"latest":  {UserID: "a@example.com", DeviceID: "laptop", DKey: "k2", Expires: now + 120},
+			"expired": {UserID: "b@example.com", DeviceID: "laptop", DKey: "k3", Expires: now - 60},
+		} {
+			v, _ := json.Marshal(&p)
+			if err := b.Put([]byte(id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenStore(&Config{Backend: "bolt", DbFn: fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.PutPending("new", &Pending{UserID: "c@example.com", DeviceID: "laptop", DKey: "k4", Expires: now + 60})
+	for id, want := range map[string]int{
+		"stale":   http.StatusNotFound,
+		"latest":  http.StatusOK,
+		"expired": http.StatusNotFound,
+		"new":     http.StatusOK,
+	} {
+		if _, status := s.TakePending(id); status != want {
+			t.Errorf("TakePending(%q): got %d, want %d", id, status, want)
+		}
+	}
+}
+
+func TestStoreMapRoot(t *testing.T) {
+	for name, s := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, _, status := s.MapRoot(); status != http.StatusNotFound {
+				t.Fatalf("MapRoot on an empty store: got %d, want %d", status, http.StatusNotFound)
+			}
+			s.PutMapRoot(1, []byte("r1"))
+			if status := s.PutMapRoot(2, []byte("r2")); status != http.StatusOK {
+				t.Fatalf("PutMapRoot: got %d", status)
+			}
+			epoch, root, status := s.MapRoot()
+			if status != http.StatusOK || epoch != 2 || string(root) != "r2" {
+				t.Fatalf("MapRoot: got %d, %q, %d", epoch, root, status)
+			}
+		})
+	}
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+	m := newMemory()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			deviceid := fmt.Sprintf("device%d", i)
+			m.NewOrUpdate("a@example.com", deviceid, []byte(deviceid))
+			m.Get("a@example.com")
+		}(i)
+	}
+	wg.Wait()
+	keys, _ := m.Get("a@example.com")
+	if len(keys) != 16 {
+		t.Fatalf("got %d keys, want 16", len(keys))
+	}
+}
+
+// unsignedDKey returns a DKey for e in the form the store keeps it in,
+// but without a real signature, which the store doesn't check.
+func unsignedDKey(t *testing.T, userid, deviceid string, e *openpgp.Entity) []byte {
+	payload, err := json.Marshal(&DKey{
+		UserID:   userid,
+		DeviceID: deviceid,
+		Key:      yenc.RawURL64.EncodeToString(serializeKey(t, e)),
+		Type:     KeyTypePGP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte("e30." + base64.RawURLEncoding.EncodeToString(payload) + ".c2ln")
+}
+
+func checkOwners(t *testing.T, s KeyShop, keyid string, want ...Owner) {
+	t.Helper()
+	owners, status := s.Owners(keyid)
+	if len(want) == 0 {
+		if status != http.StatusNotFound {
+			t.Fatalf("Owners(%s): got %d %v, want none", keyid, status, owners)
+		}
+		return
+	}
+	if status != http.StatusOK || len(owners) != len(want) {
+		t.Fatalf("Owners(%s): got %d %v, want %v", keyid, status, owners, want)
+	}
+	for _, w := range want {
+		found := false
+		for _, o := range owners {
+			found = found || o == w
+		}
+		if !found {
+			t.Fatalf("Owners(%s): got %v, want %v", keyid, owners, want)
+		}
+	}
+}
+
+func TestStoreOwners(t *testing.T) {
+	const userid = "a@example.com"
+	e1, e2 := testEntity(t, userid), testEntity(t, userid)
+	fp1 := fmt.Sprintf("%X", e1.PrimaryKey.Fingerprint)
+	sub1 := fmt.Sprintf("%016X", e1.Subkeys[0].PublicKey.KeyId)
+	fp2 := fmt.Sprintf("%X", e2.PrimaryKey.Fingerprint)
+	laptop, phone := Owner{UserID: userid, DeviceID: "laptop"}, Owner{UserID: userid, DeviceID: "phone"}
+
+	for name, s := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			checkOwners(t, s, fp1)
+			s.NewOrUpdate(userid, "laptop", unsignedDKey(t, userid, "laptop", e1))
+			s.NewOrUpdate(userid, "phone", unsignedDKey(t, userid, "phone", e1))
+			checkOwners(t, s, fp1, laptop, phone)
+			checkOwners(t, s, sub1, laptop, phone)
+
+			// Overwriting a device's key moves it in the index.
+			s.NewOrUpdate(userid, "laptop", unsignedDKey(t, userid, "laptop", e2))
+			checkOwners(t, s, fp1, phone)
+			checkOwners(t, s, fp2, laptop)
+
+			s.Revoke(userid, "phone", []byte("r"))
+			checkOwners(t, s, fp1)
+			checkOwners(t, s, sub1)
+			checkOwners(t, s, fp2, laptop)
+		})
+	}
+}
+
+func TestOpenStoreReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"bolt", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			c := &Config{Backend: name, DbFn: filepath.Join(dir, name+".db")}
+			if _, err := OpenStoreReadOnly(c); err == nil {
+				t.Fatalf("opened a store that doesn't exist")
+			}
+			s, err := OpenStore(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.NewOrUpdate("a@example.com", "laptop", []byte("k1"))
+			s.Close()
+
+			if s, err = OpenStoreReadOnly(c); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if keys, status := s.Get("a@example.com"); status != http.StatusOK || keys["laptop"] != "k1" {
+				t.Fatalf("Get: got %v, %d", keys, status)
+			}
+			if status := s.NewOrUpdate("a@example.com", "phone", []byte("k2")); status == http.StatusOK {
+				t.Fatalf("NewOrUpdate on a read-only store succeeded")
+			}
+		})
+	}
+	if _, err := OpenStoreReadOnly(&Config{Backend: "memory"}); err == nil {
+		t.Fatalf("opened a memory store read-only")
+	}
+}
+
+func TestBoltBuildsOwnersIndex(t *testing.T) {
+	const userid = "a@example.com"
+	e := testEntity(t, userid)
+	fn := filepath.Join(t.TempDir(), "bolt.db")
+	s, err := openBolt(fn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.NewOrUpdate(userid, "laptop", unsignedDKey(t, userid, "laptop", e))
+	// Pretend the database predates the index.
+	err = s.(*state).db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(ownersBucket)
+	})
+	s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openBolt(fn, false); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkOwners(t, s, fmt.Sprintf("%X", e.PrimaryKey.Fingerprint), Owner{UserID: userid, DeviceID: "laptop"})
+}
@@ -0,0 +1,355 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+//
+// Package tlog implements an append-only Merkle tree log, in the
+// style of Certificate Transparency (RFC 6962). Keyshop adds every
+// DKey it signs to the log, so that clients and auditors can check
+// that the key they were given is the one everyone else sees.
+package tlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	leavesBucket  = []byte("leaves")
+	entriesBucket = []byte("entries")
+
+	errRange = errors.New("tlog: index out of range")
+)
+
+// LeafHash returns the RFC 6962 hash of a log entry.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n.
+func split(n int64) int64 {
+	k := int64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// A Log is an append-only Merkle tree log. Leaf hashes are kept in
+// memory; if the log was opened from a file, leaves and entries are
+// also persisted there.
+type Log struct {
+	mu    sync.RWMutex
+	db    *bolt.DB
+	index map[string]int64
+	// levels[h][i] is the hash of the complete subtree of the 2^h
+	// leaves from i*2^h; levels[0] is the leaves. Every other node
+	// of a tree of any size is hashed from O(log n) of them.
+	levels [][][]byte
+}
+
+// NewMemory returns an empty log that lives only in memory.
+func NewMemory() *Log {
+	return &Log{index: make(map[string]int64)}
+}
+
+// Open opens (or creates) the log stored in the bolt file fn.
+func Open(fn string) (*Log, error) {
+	db, err := bolt.Open(fn, 0600, &bolt.Options{
+		Timeout: 1 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	l := NewMemory()
+	l.db = db
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(entriesBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(leavesBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if binary.BigEndian.Uint64(k) != uint64(l.size()) {
+				return fmt.Errorf("tlog: leaf %x out of sequence", k)
+			}
+			l.add(append([]byte(nil), v...))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) add(leaf []byte) int64 {
+	i := l.size()
+	if len(l.levels) == 0 {
+		l.levels = [][][]byte{nil}
+	}
+	l.levels[0] = append(l.levels[0], leaf)
+	if _, ok := l.index[string(leaf)]; !ok {
+		l.index[string(leaf)] = i
+	}
+	// Hash each subtree that the leaf completes.
+	for h := 0; len(l.levels[h])%2 == 0; h++ {
+		if h+1 == len(l.levels) {
+			l.levels = append(l.levels, nil)
+		}
+		n := len(l.levels[h])
+		l.levels[h+1] = append(l.levels[h+1], nodeHash(l.levels[h][n-2], l.levels[h][n-1]))
+	}
+	return i
+}
+
+func (l *Log) size() int64 {
+	if len(l.levels) == 0 {
+		return 0
+	}
+	return int64(len(l.levels[0]))
+}
+
+// Size returns the number of entries in the log.
+func (l *Log) Size() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.size()
+}
+
+// Append adds data to the log, and returns its index.
+func (l *Log) Append(data []byte) (int64, error) {
+	leaf := LeafHash(data)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.db != nil {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(l.size()))
+		err := l.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket(leavesBucket).Put(k, leaf); err != nil {
+				return err
+			}
+			return tx.Bucket(entriesBucket).Put(k, data)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return l.add(leaf), nil
+}
+
+// Head returns the current size and root hash of the log.
+func (l *Log) Head() (size int64, root []byte) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	size = l.size()
+	return size, l.hash(0, size)
+}
+
+// Root returns the root hash of the log when it had size entries.
+func (l *Log) Root(size int64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if size < 0 || size > l.size() {
+		return nil, errRange
+	}
+	return l.hash(0, size), nil
+}
+
+// Index returns the index of the first entry with the given leaf hash.
+func (l *Log) Index(leaf []byte) (int64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i, ok := l.index[string(leaf)]
+	return i, ok
+}
+
+// Entry returns the data logged at index, if the log was opened from
+// a file. (In-memory logs only keep leaf hashes.)
+func (l *Log) Entry(index int64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if index < 0 || index >= l.size() || l.db == nil {
+		return nil, errRange
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(index))
+	var data []byte
+	err := l.db.View(func(tx *bolt.Tx) error {
+		data = append(data, tx.Bucket(entriesBucket).Get(k)...)
+		return nil
+	})
+	return data, err
+}
+
+// hash returns MTH(D[lo:hi]), as defined in RFC 6962, section 2.1.
+// Every subtree that RFC 6962 splits a tree into starts at a multiple
+// of its size, so a complete one is in l.levels.
+func (l *Log) hash(lo, hi int64) []byte {
+	n := hi - lo
+	if n == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	if n&(n-1) == 0 {
+		h := 0
+		for int64(1)<<uint(h) < n {
+			h++
+		}
+		return l.levels[h][lo/n]
+	}
+	k := split(n)
+	return nodeHash(l.hash(lo, lo+k), l.hash(lo+k, hi))
+}
+
+// InclusionProof returns the audit path for the entry at index in
+// the tree of the given size (RFC 6962, section 2.1.1).
+func (l *Log) InclusionProof(index, size int64) ([][]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if size < 1 || size > l.size() || index < 0 || index >= size {
+		return nil, errRange
+	}
+	return l.path(index, 0, size), nil
+}
+
+func (l *Log) path(m, lo, hi int64) [][]byte {
+	n := hi - lo
+	if n <= 1 {
+		return nil
+	}
+	k := split(n)
+	if m < k {
+		return append(l.path(m, lo, lo+k), l.hash(lo+k, hi))
+	}
+	return append(l.path(m-k, lo+k, hi), l.hash(lo, lo+k))
+}
+
+// ConsistencyProof returns the proof that the tree of size first is
+// a prefix of the tree of size second (RFC 6962, section 2.1.2).
+func (l *Log) ConsistencyProof(first, second int64) ([][]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if first < 0 || first > second || second > l.size() {
+		return nil, errRange
+	}
+	if first == 0 || first == second {
+		return nil, nil
+	}
+	return l.subproof(first, 0, second, true), nil
+}
+
+func (l *Log) subproof(m, lo, hi int64, complete bool) [][]byte {
+	n := hi - lo
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{l.hash(lo, hi)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(l.subproof(m, lo, lo+k, complete), l.hash(lo+k, hi))
+	}
+	return append(l.subproof(m-k, lo+k, hi, false), l.hash(lo, lo+k))
+}
+
+// Close closes the log's file, if it has one.
+func (l *Log) Close() error {
+	if l.db == nil {
+		return nil
+	}
+	return l.db.Close()
+}
+
+// VerifyInclusion checks that proof shows that leaf is at index in
+// the tree of the given size with the given root.
+func VerifyInclusion(leaf []byte, index, size int64, proof [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistency checks that proof shows that the tree of size
+// first with root firstRoot is a prefix of the tree of size second
+// with root secondRoot.
+func VerifyConsistency(first, second int64, firstRoot, secondRoot []byte, proof [][]byte) bool {
+	switch {
+	case first < 0 || first > second:
+		return false
+	case first == second:
+		return len(proof) == 0 && bytes.Equal(firstRoot, secondRoot)
+	case first == 0:
+		// The empty tree is a prefix of every tree.
+		return len(proof) == 0
+	case len(proof) == 0:
+		return false
+	}
+	if first&(first-1) == 0 {
+		// first is a power of two, so its root is a node of the
+		// second tree, and the proof leaves it out.
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
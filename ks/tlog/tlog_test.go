@@ -0,0 +1,136 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package tlog
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+const maxSize = 33
+
+func testLog(t *testing.T, n int) *Log {
+	l := NewMemory()
+	for i := 0; i < n; i++ {
+		if _, err := l.Append([]byte(fmt.Sprintf("entry %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l
+}
+
+func TestEmptyRoot(t *testing.T) {
+	_, root := NewMemory().Head()
+	// SHA-256 of the empty string.
+	want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got := hex.EncodeToString(root); got != want {
+		t.Fatalf("empty root: got %s, want %s", got, want)
+	}
+}
+
+func TestInclusion(t *testing.T) {
+	l := testLog(t, maxSize)
+	for size := int64(1); size <= maxSize; size++ {
+		root, err := l.Root(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < size; i++ {
+			proof, err := l.InclusionProof(i, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := LeafHash([]byte(fmt.Sprintf("entry %d", i)))
+			if !VerifyInclusion(leaf, i, size, proof, root) {
+				t.Fatalf("inclusion proof for %d in %d did not verify", i, size)
+			}
+			if VerifyInclusion(LeafHash([]byte("bogus")), i, size, proof, root) {
+				t.Fatalf("inclusion proof for %d in %d verified a bogus leaf", i, size)
+			}
+		}
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	l := testLog(t, maxSize)
+	for second := int64(1); second <= maxSize; second++ {
+		secondRoot, _ := l.Root(second)
+		for first := int64(1); first <= second; first++ {
+			firstRoot, _ := l.Root(first)
+			proof, err := l.ConsistencyProof(first, second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyConsistency(first, second, firstRoot, secondRoot, proof) {
+				t.Fatalf("consistency proof %d -> %d did not verify", first, second)
+			}
+			if first != second && VerifyConsistency(first, second, LeafHash(nil), secondRoot, proof) {
+				t.Fatalf("consistency proof %d -> %d verified a bogus root", first, second)
+			}
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "log.db")
+	l, err := Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		l.Append([]byte(fmt.Sprintf("entry %d", i)))
+	}
+	size, root := l.Head()
+	l.Close()
+
+	if l, err = Open(fn); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	size2, root2 := l.Head()
+	if size2 != size || !bytes.Equal(root2, root) {
+		t.Fatalf("reopened log has size %d, root %x; want %d, %x", size2, root2, size, root)
+	}
+	if i, ok := l.Index(LeafHash([]byte("entry 3"))); !ok || i != 3 {
+		t.Fatalf("Index: got %d, %v", i, ok)
+	}
+	if data, err := l.Entry(3); err != nil || string(data) != "entry 3" {
+		t.Fatalf("Entry: got %q, %v", data, err)
+	}
+}
+
+// rootOf computes MTH(leaves) as RFC 6962 defines it, without the
+// cached subtrees. leaves must not be empty.
+func rootOf(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 1:
+		return leaves[0]
+	}
+	k := split(int64(len(leaves)))
+	return nodeHash(rootOf(leaves[:k]), rootOf(leaves[k:]))
+}
+
+func TestCachedSubtrees(t *testing.T) {
+	l := NewMemory()
+	var leaves [][]byte
+	for n := int64(1); n <= 100; n++ {
+		data := []byte(fmt.Sprintf("entry %d", n))
+		l.Append(data)
+		leaves = append(leaves, LeafHash(data))
+		if size := l.Size(); size != n {
+			t.Fatalf("Size: got %d, want %d", size, n)
+		}
+		for size := int64(1); size <= n; size++ {
+			root, err := l.Root(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := rootOf(leaves[:size]); !bytes.Equal(root, want) {
+				t.Fatalf("root of %d of %d entries: got %x, want %x", size, n, root, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+//
+// Package token mints and verifies short-lived bearer tokens for the
+// keyshop API. A token is a compact-serialized JWS whose payload is a
+// set of Claims, MACed with HS256 under a shared secret, or signed by
+// the key authority with ES256, ES384 or ES512, as its key's curve
+// requires.
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+// Scopes a token may be granted. A write token may also read.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// MinSecretLen is the shortest HMAC secret that will be accepted.
+const MinSecretLen = 32
+
+// DefaultMaxLifetime is the longest a token may be good for, from
+// when it was issued to when it expires, unless a Verifier says
+// otherwise.
+const DefaultMaxLifetime = 24 * time.Hour
+
+// skew is how far in the future a token's issue time may be, to allow
+// for the minter's clock being ahead of ours.
+const skew = time.Minute
+
+// Claims are what a token says about its bearer.
+type Claims struct {
+	Audience string `json:"aud"`
+	Expiry   int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	Scope    string `json:"scope"`
+	// Subject is the bearer's userid (an email address).
+	Subject string `json:"sub"`
+}
+
+// Allows reports whether the claims' scope allows writes, if forwrite
+// is true, or reads otherwise.
+func (c *Claims) Allows(forwrite bool) bool {
+	switch c.Scope {
+	case ScopeWrite:
+		return true
+	case ScopeRead:
+		return !forwrite
+	}
+	return false
+}
+
+// Errors returned by Verify.
+var (
+	ErrMalformed = errors.New("token: malformed token")
+	ErrSignature = errors.New("token: bad signature")
+	ErrExpired   = errors.New("token: expired")
+	ErrAudience  = errors.New("token: wrong audience")
+	ErrLifetime  = errors.New("token: good for too long")
+	ErrIssuedAt  = errors.New("token: issued in the future")
+)
+
+// ecAlgorithms gives the JWS algorithm for an ECDSA key on each curve.
+var ecAlgorithms = map[elliptic.Curve]jose.SignatureAlgorithm{
+	elliptic.P256(): jose.ES256,
+	elliptic.P384(): jose.ES384,
+	elliptic.P521(): jose.ES512,
+}
+
+// algorithm returns the JWS algorithm to use with key.
+func algorithm(key interface{}) (jose.SignatureAlgorithm, error) {
+	var curve elliptic.Curve
+	switch k := key.(type) {
+	case []byte:
+		if len(k) < MinSecretLen {
+			return "", fmt.Errorf("token: HMAC secret is %d bytes; need at least %d", len(k), MinSecretLen)
+		}
+		return jose.HS256, nil
+	case *ecdsa.PrivateKey:
+		curve = k.Curve
+	case *ecdsa.PublicKey:
+		curve = k.Curve
+	default:
+		return "", fmt.Errorf("token: unsupported key type %T", key)
+	}
+	alg, ok := ecAlgorithms[curve]
+	if !ok {
+		return "", fmt.Errorf("token: unsupported curve %s", curve.Params().Name)
+	}
+	return alg, nil
+}
+
+// Mint returns a token carrying c. key is either an HMAC secret
+// ([]byte), or the key authority's *ecdsa.PrivateKey.
+func Mint(c *Claims, key interface{}) (string, error) {
+	alg, err := algorithm(key)
+	if err != nil {
+		return "", err
+	}
+	signer, err := jose.NewSigner(alg, key)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+// A Verifier checks tokens for a single audience.
+type Verifier struct {
+	// MaxLifetime is the longest a token may be good for, from its
+	// iat to its exp. A stolen token is no use for longer than that,
+	// whatever its exp.
+	MaxLifetime time.Duration
+
+	audience string
+	keys     []interface{}
+	now      func() time.Time
+}
+
+// NewVerifier returns a Verifier for tokens addressed to audience,
+// and signed by any of keys. Each key is either an HMAC secret
+// ([]byte), or the key authority's *ecdsa.PublicKey.
+func NewVerifier(audience string, keys ...interface{}) (*Verifier, error) {
+	if audience == "" {
+		return nil, errors.New("token: no audience")
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("token: no keys")
+	}
+	for _, k := range keys {
+		if _, err := algorithm(k); err != nil {
+			return nil, err
+		}
+	}
+	return &Verifier{MaxLifetime: DefaultMaxLifetime, audience: audience, keys: keys, now: time.Now}, nil
+}
+
+// Verify checks tok's signature, expiry, lifetime and audience, and
+// returns its claims.
+func (v *Verifier) Verify(tok string) (*Claims, error) {
+	// Only the compact serialization, with exactly one signature.
+	if strings.Count(tok, ".") != 2 {
+		return nil, ErrMalformed
+	}
+	obj, err := jose.ParseSigned(tok)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var payload []byte
+	verified := false
+	for _, k := range v.keys {
+		if payload, err = obj.Verify(k); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrSignature
+	}
+	c := new(Claims)
+	if err := json.Unmarshal(payload, c); err != nil || c.Subject == "" || c.Expiry == 0 {
+		return nil, ErrMalformed
+	}
+	now := v.now()
+	if now.Unix() >= c.Expiry {
+		return nil, ErrExpired
+	}
+	if time.Unix(c.IssuedAt, 0).After(now.Add(skew)) {
+		return nil, ErrIssuedAt
+	}
+	if time.Duration(c.Expiry-c.IssuedAt)*time.Second > v.MaxLifetime {
+		return nil, ErrLifetime
+	}
+	if c.Audience != v.audience {
+		return nil, ErrAudience
+	}
+	return c, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package token
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func claims(scope string, ttl time.Duration) *Claims {
+	now := time.Now()
+	return &Claims{
+		Audience: "keyshop",
+		Expiry:   now.Add(ttl).Unix(),
+		IssuedAt: now.Unix(),
+		Scope:    scope,
+		Subject:  "alice@example.com",
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, MinSecretLen)
+	v, err := NewVerifier("keyshop", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := Mint(claims(ScopeWrite, time.Hour), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := v.Verify(tok)
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if c.Subject != "alice@example.com" || !c.Allows(true) {
+		t.Fatalf("Verify: got %+v", c)
+	}
+
+	other := bytes.Repeat([]byte{8}, MinSecretLen)
+	tok, _ = Mint(claims(ScopeWrite, time.Hour), other)
+	if _, err := v.Verify(tok); err != ErrSignature {
+		t.Fatalf("token MACed with another secret: got %v, want %v", err, ErrSignature)
+	}
+	if _, err := Mint(claims(ScopeWrite, time.Hour), secret[:MinSecretLen-1]); err == nil {
+		t.Fatalf("minted with a short secret")
+	}
+}
+
+func TestES256(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := bytes.Repeat([]byte{7}, MinSecretLen)
+	v, err := NewVerifier("keyshop", secret, &priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := Mint(claims(ScopeRead, time.Hour), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := v.Verify(tok)
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if !c.Allows(false) || c.Allows(true) {
+		t.Fatalf("read token: got %+v", c)
+	}
+}
+
+func TestECDSACurves(t *testing.T) {
+	for _, test := range []struct {
+		curve elliptic.Curve
+		alg   string
+	}{
+		{elliptic.P256(), "ES256"},
+		{elliptic.P384(), "ES384"},
+		{elliptic.P521(), "ES512"},
+	} {
+		name := test.curve.Params().Name
+		priv, err := ecdsa.GenerateKey(test.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := NewVerifier("keyshop", &priv.PublicKey)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		tok, err := Mint(claims(ScopeRead, time.Hour), priv)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		header, err := base64.RawURLEncoding.DecodeString(strings.Split(tok, ".")[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h struct{ Alg string }
+		if err := json.Unmarshal(header, &h); err != nil || h.Alg != test.alg {
+			t.Errorf("%s: signed with %s, want %s", name, header, test.alg)
+		}
+		if _, err := v.Verify(tok); err != nil {
+			t.Errorf("%s: Verify: %s", name, err)
+		}
+	}
+}
+
+func TestRejects(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, MinSecretLen)
+	v, err := NewVerifier("keyshop", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := Mint(claims(ScopeWrite, -time.Minute), secret)
+	if _, err := v.Verify(expired); err != ErrExpired {
+		t.Fatalf("expired token: got %v, want %v", err, ErrExpired)
+	}
+	c := claims(ScopeWrite, 30*24*time.Hour)
+	tooLong, _ := Mint(c, secret)
+	if _, err := v.Verify(tooLong); err != ErrLifetime {
+		t.Fatalf("token good for 30 days: got %v, want %v", err, ErrLifetime)
+	}
+	c = claims(ScopeWrite, time.Hour)
+	c.IssuedAt = 0
+	noIssuedAt, _ := Mint(c, secret)
+	if _, err := v.Verify(noIssuedAt); err != ErrLifetime {
+		t.Fatalf("token without iat: got %v, want %v", err, ErrLifetime)
+	}
+	c = claims(ScopeWrite, 2*time.Hour)
+	c.IssuedAt = time.Now().Add(time.Hour).Unix()
+	future, _ := Mint(c, secret)
+	if _, err := v.Verify(future); err != ErrIssuedAt {
+		t.Fatalf("token issued in the future: got %v, want %v", err, ErrIssuedAt)
+	}
+	c = claims(ScopeWrite, time.Hour)
+	c.Audience = "elsewhere"
+	elsewhere, _ := Mint(c, secret)
+	if _, err := v.Verify(elsewhere); err != ErrAudience {
+		t.Fatalf("token for another audience: got %v, want %v", err, ErrAudience)
+	}
+	for _, tok := range []string{"", "a.b", "a.b.c", "a.b.c.d"} {
+		if _, err := v.Verify(tok); err != ErrMalformed {
+			t.Fatalf("Verify(%q): got %v, want %v", tok, err, ErrMalformed)
+		}
+	}
+}
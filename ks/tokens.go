@@ -0,0 +1,80 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/yahoo/keyshop/ks/token"
+)
+
+// A TokenAuthenticator accepts short-lived bearer tokens, as minted
+// by mintoken, in an "Authorization: Bearer" header. The token's
+// subject is the principal, and its scope has to allow writes for
+// requests that change keys.
+type TokenAuthenticator struct {
+	v *token.Verifier
+}
+
+// NewTokenAuthenticator returns a TokenAuthenticator that checks
+// tokens with v.
+func NewTokenAuthenticator(v *token.Verifier) *TokenAuthenticator {
+	return &TokenAuthenticator{v: v}
+}
+
+// Authenticate implements Authenticator.
+func (a *TokenAuthenticator) Authenticate(r *http.Request, forwrite bool) (*Principal, error) {
+	authz := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(authz) < len(prefix) || !strings.EqualFold(authz[:len(prefix)], prefix) {
+		return nil, ErrNoCredentials
+	}
+	claims, err := a.v.Verify(strings.TrimSpace(authz[len(prefix):]))
+	if err != nil {
+		return nil, err
+	}
+	if !claims.Allows(forwrite) {
+		return nil, fmt.Errorf("token scope %q does not allow writes", claims.Scope)
+	}
+	return &Principal{UserID: claims.Subject, Method: "token"}, nil
+}
+
+// initTokens adds a TokenAuthenticator to the chain, if the config
+// names a token secret, or trusts tokens signed by the kauth.
+func (s *Server) initTokens() error {
+	var keys []interface{}
+	if fn := s.config.TokenSecretFn; fn != "" {
+		secret, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return fmt.Errorf("error reading token secret: %s", err)
+		}
+		keys = append(keys, secret)
+	}
+	if s.config.TokenKauth {
+		ka, ok := s.ka.(interface {
+			Public() crypto.PublicKey
+		})
+		if !ok {
+			return fmt.Errorf("kauth %T has no public key to check tokens with", s.ka)
+		}
+		keys = append(keys, ka.Public())
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	v, err := token.NewVerifier(s.config.TokenAudience, keys...)
+	if err != nil {
+		return err
+	}
+	if s.config.TokenMaxTTL > 0 {
+		v.MaxLifetime = s.config.TokenMaxTTL
+	}
+	glog.Infof("accepting bearer tokens for audience %q", s.config.TokenAudience)
+	s.AddAuthenticator(NewTokenAuthenticator(v))
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/yahoo/keyshop/yenc"
+)
+
+func encodeHashes(hashes [][]byte) []string {
+	enc := make([]string, len(hashes))
+	for i, h := range hashes {
+		enc[i] = yenc.RawURL64.EncodeToString(h)
+	}
+	return enc
+}
+
+// sizeParam parses the query parameter name as a tree size, which
+// defaults to def if it is absent.
+func sizeParam(r *http.Request, name string, def int64) (int64, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return n, err == nil && n >= 0
+}
+
+// A signedHead is the latest signed TreeHead. It is only signed once
+// for each size of the log, however often it is fetched, so that
+// anonymous GETs can't make the kauth sign at will.
+type signedHead struct {
+	mu     sync.Mutex
+	size   int64
+	signed []byte
+}
+
+// signTreeHead returns the signed TreeHead for the log's current
+// size, signing it if the log has grown since the last one.
+func (s *Server) signTreeHead() ([]byte, error) {
+	s.sth.mu.Lock()
+	defer s.sth.mu.Unlock()
+	size, root := s.log.Head()
+	if s.sth.signed != nil && s.sth.size == size {
+		return s.sth.signed, nil
+	}
+	data, err := json.Marshal(&TreeHead{
+		RootHash:  yenc.RawURL64.EncodeToString(root),
+		Timestamp: time.Now().UTC().Unix(),
+		TreeSize:  size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signed, err := s.ka.Sign(data)
+	if err != nil {
+		return nil, fmt.Errorf("error getting signature from kauth: %s", err)
+	}
+	s.sth.size, s.sth.signed = size, signed
+	return signed, nil
+}
+
+// GET /v1/log/sth
+// Returns:
+//   200 StatusOK: The body is the signed TreeHead
+//   5xx         : Random server issues that should never occur
+func (s *Server) treeHead(w http.ResponseWriter, r *http.Request) {
+	signed, err := s.signTreeHead()
+	if err != nil {
+		glog.Errorf("error signing tree head: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/jws")
+	w.Write(signed)
+}
+
+// GET /v1/log/inclusion?hash={leafhash}&size={treesize}
+// The leaf hash is the RFC 6962 leaf hash of the DKey's JWS, encoded
+// like the DKey itself; size defaults to the current size of the log.
+// Returns:
+//   200 StatusOK      : The body is an InclusionProof
+//   400 BadRequest    : If the parameters don't parse, or size is too big
+//   404 StatusNotFound: If the DKey isn't in the tree of that size
+func (s *Server) inclusion(w http.ResponseWriter, r *http.Request) {
+	leaf, err := yenc.RawURL64.DecodeString(r.URL.Query().Get("hash"))
+	if err != nil {
+		glog.Warningf("invalid leaf hash: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	current := s.log.Size()
+	size, ok := sizeParam(r, "size", current)
+	if !ok || size > current {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	index, ok := s.log.Index(leaf)
+	if !ok || index >= size {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	proof, err := s.log.InclusionProof(index, size)
+	if err != nil {
+		glog.Errorf("error computing inclusion proof for %d in %d: %s", index, size, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &InclusionProof{
+		AuditPath: encodeHashes(proof),
+		LeafIndex: index,
+		TreeSize:  size,
+	})
+}
+
+// GET /v1/log/consistency?first={size}&second={size}
+// second defaults to the current size of the log.
+// Returns:
+//   200 StatusOK  : The body is a ConsistencyProof
+//   400 BadRequest: If the sizes don't parse, or aren't in order
+func (s *Server) consistency(w http.ResponseWriter, r *http.Request) {
+	current := s.log.Size()
+	first, ok1 := sizeParam(r, "first", -1)
+	second, ok2 := sizeParam(r, "second", current)
+	if !ok1 || !ok2 || first < 0 || first > second || second > current {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	proof, err := s.log.ConsistencyProof(first, second)
+	if err != nil {
+		glog.Errorf("error computing consistency proof %d -> %d: %s", first, second, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &ConsistencyProof{
+		First:  first,
+		Proof:  encodeHashes(proof),
+		Second: second,
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package ks
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/yahoo/keyshop/yenc"
+)
+
+// The OpenPGP Web Key Directory (draft-koch-openpgp-webkey-service)
+// lets stock OpenPGP clients find a user's keys over HTTPS. A key for
+// local@domain is served at
+//
+//	https://domain/.well-known/openpgpkey/hu/HASH?l=local (direct)
+//	https://openpgpkey.domain/.well-known/openpgpkey/domain/hu/HASH?l=local (advanced)
+//
+// where HASH is the z-base-32 of the SHA-1 of the lower-cased local
+// part. Only requests that name the local part, as GnuPG's do, are
+// answered, since the hash can't be reversed.
+
+// wkdHash returns the WKD hash of the local part of an address.
+func wkdHash(local string) string {
+	h := sha1.Sum([]byte(strings.ToLower(local)))
+	return yenc.ZBase32.EncodeToString(h[:])
+}
+
+// wkdRoutes answers WKD requests, if the config asks for it. Like the
+// transparency log, they are public.
+func (s *Server) wkdRoutes() {
+	if !s.config.WKD {
+		return
+	}
+	w := s.router.PathPrefix("/.well-known/openpgpkey").Subrouter()
+	// The policy file has to exist, even if it says nothing.
+	w.HandleFunc("/policy", s.wkdPolicy).Methods("GET", "HEAD")
+	w.HandleFunc("/{domain}/policy", s.wkdPolicy).Methods("GET", "HEAD")
+	w.HandleFunc("/hu/{hash}", s.wkdKeys).Methods("GET", "HEAD")
+	w.HandleFunc("/{domain}/hu/{hash}", s.wkdKeys).Methods("GET", "HEAD")
+}
+
+func (s *Server) wkdPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+}
+
+// GET /.well-known/openpgpkey/[<domain>/]hu/<hash>?l=<local part>
+// Returns:
+//   200 StatusOK      : The body is the user's OpenPGP keys, in binary
+//   404 StatusNotFound: If the user has no OpenPGP keys, or isn't served here
+//   5xx               : Random server issues that should never occur
+func (s *Server) wkdKeys(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	domain, ok := vars["domain"]
+	if !ok {
+		// The direct method: the domain is the one asked.
+		domain = r.Host
+		if host, _, err := net.SplitHostPort(domain); err == nil {
+			domain = host
+		}
+	}
+	local := r.URL.Query().Get("l")
+	if local == "" || wkdHash(local) != vars["hash"] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	userid := local + "@" + strings.ToLower(domain)
+	glog.Infof("WKD %s", userid)
+	if s.policy.CheckUser(userid) != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	keys, status := s.store.Get(userid)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	pgpKeys, err := OpenPGPKeys(keys)
+	if err != nil {
+		glog.Errorf("bad keys for %s in the store: %s", userid, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	for _, key := range pgpKeys {
+		buf.Write(key)
+	}
+	if buf.Len() == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
+
+// OpenPGPKeys returns the distinct OpenPGP keys, in binary, in a user's
+// signed DKeys, as returned by KeyShop.Get. They are in device order,
+// so that the answer doesn't change from one call to the next.
+func OpenPGPKeys(keys map[string]string) ([][]byte, error) {
+	devices := make([]string, 0, len(keys))
+	for deviceid := range keys {
+		devices = append(devices, deviceid)
+	}
+	sort.Strings(devices)
+	var pgpKeys [][]byte
+	seen := make(map[string]bool)
+	for _, deviceid := range devices {
+		dkey, err := dkeyOf(keys[deviceid])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", deviceid, err)
+		}
+		if dkey.Type != "" && dkey.Type != KeyTypePGP || seen[dkey.Key] {
+			continue
+		}
+		seen[dkey.Key] = true
+		key, err := yenc.RawURL64.DecodeString(dkey.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", deviceid, err)
+		}
+		pgpKeys = append(pgpKeys, key)
+	}
+	return pgpKeys, nil
+}
@@ -8,6 +8,6 @@ if test -d ${tls} ; then
 else
       mkdir ${tls}
 fi
-go run ks/cmd/localcert/main.go ${domains} &&
+go run ks/cmd/localcert/main.go "$@" ${domains} &&
       cat ${domain}.server.pem ${domain}.ca.pem > ${domain}.chain.pem &&
       mv ${domain}* ${tls}
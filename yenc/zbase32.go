@@ -0,0 +1,58 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package yenc
+
+import (
+	"fmt"
+	"strings"
+)
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// ZBase32 is the human-oriented base32 of
+// http://philzimmermann.com/docs/human-oriented-base-32-encoding.txt,
+// as used by the OpenPGP Web Key Directory. It is unpadded; a partial
+// final group is encoded with zero bits.
+var ZBase32 = zbase32{}
+
+type zbase32 struct{}
+
+// EncodeToString returns the z-base-32 encoding of src.
+func (zbase32) EncodeToString(src []byte) string {
+	var out strings.Builder
+	var buf uint
+	bits := 0
+	for _, b := range src {
+		buf = buf<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out.WriteByte(zbase32Alphabet[buf>>uint(bits)&0x1f])
+		}
+	}
+	if bits > 0 {
+		out.WriteByte(zbase32Alphabet[buf<<uint(5-bits)&0x1f])
+	}
+	return out.String()
+}
+
+// DecodeString returns the bytes represented by the z-base-32 string
+// s. Trailing bits that don't make up a whole byte are dropped.
+func (zbase32) DecodeString(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s)*5/8)
+	var buf uint
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		v := strings.IndexByte(zbase32Alphabet, s[i])
+		if v < 0 {
+			return nil, fmt.Errorf("yenc: illegal z-base-32 data at input byte %d", i)
+		}
+		buf = buf<<5 | uint(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			out = append(out, byte(buf>>uint(bits)))
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2015 Yahoo
+// License: Apache 2
+package yenc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+func TestZBase32(t *testing.T) {
+	for _, test := range []struct {
+		in  []byte
+		out string
+	}{
+		{nil, ""},
+		{[]byte{0x00}, "yy"},
+		{[]byte{0xf0, 0xbf, 0xc7}, "6n9hq"},
+		{[]byte{0xd4, 0x7a, 0x04}, "4t7ye"},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff}, "99999999"},
+	} {
+		if got := ZBase32.EncodeToString(test.in); got != test.out {
+			t.Errorf("EncodeToString(%x): got %q, want %q", test.in, got, test.out)
+		}
+		got, err := ZBase32.DecodeString(test.out)
+		if err != nil || !bytes.Equal(got, test.in) {
+			t.Errorf("DecodeString(%q): got %x, %v, want %x", test.out, got, err, test.in)
+		}
+	}
+	if _, err := ZBase32.DecodeString("0lv2"); err == nil {
+		t.Errorf("DecodeString accepted characters outside the alphabet")
+	}
+}
+
+// The example from the Web Key Directory draft.
+func TestZBase32WKD(t *testing.T) {
+	h := sha1.Sum([]byte("joe.doe"))
+	if got, want := ZBase32.EncodeToString(h[:]), "iy9q119eutrkn8s1mk4r39qejnbu3n5q"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}